@@ -0,0 +1,103 @@
+// Package api holds the types shared by the objstore engines and the
+// client, so that the client can be used without importing the engines.
+package api
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by an engine when the requested key does not exist
+var ErrNotFound = errors.New("key does not exist")
+
+// ErrNoVersions is returned when versions are asked of an engine which does
+// not keep them
+var ErrNoVersions = errors.New("engine does not keep versions")
+
+// ErrNoTrash is returned when trash is asked of storage which does not keep
+// one
+var ErrNoTrash = errors.New("storage does not keep a trash")
+
+// ErrExists is returned when restoring over an object which exists
+var ErrExists = errors.New("key already exists")
+
+// ErrNoExpiry is returned when an object is given an expiry by storage
+// which does not expire objects
+var ErrNoExpiry = errors.New("storage does not expire objects")
+
+// Engine is a specific implementation of Storage
+type Engine interface {
+	WriteTo(string, io.Writer) error
+	ReadFrom(string, io.Reader) error
+	Delete(string) error
+}
+
+// Lister is implemented by engines able to enumerate the keys they hold
+type Lister interface {
+	// List calls fn for every key beginning with prefix in lexical order.
+	// Listing stops at the first error returned by fn.
+	List(prefix string, fn func(key string) error) error
+}
+
+// ObjectInfo describes a stored object
+type ObjectInfo struct {
+	Key         string
+	Size        int64
+	ContentType string
+	Metadata    map[string]string
+	Modified    time.Time
+	// Tier names the tier holding the object on engines moving objects
+	// between tiers
+	Tier string
+}
+
+// Stater is implemented by engines able to describe an object without
+// reading it
+type Stater interface {
+	Stat(key string) (*ObjectInfo, error)
+}
+
+// VersionInfo describes a version of an object
+type VersionInfo struct {
+	ID           string    `json:"id"`
+	Size         int64     `json:"size"`
+	Modified     time.Time `json:"modified"`
+	Latest       bool      `json:"latest"`
+	DeleteMarker bool      `json:"delete_marker,omitempty"`
+}
+
+// Versioner is implemented by engines keeping the earlier versions of the
+// objects they hold
+type Versioner interface {
+	// Versions returns the versions of key, newest first
+	Versions(key string) ([]VersionInfo, error)
+	// WriteVersion writes version id of key to w
+	WriteVersion(key string, id string, w io.Writer) error
+}
+
+// TrashEntry describes a deleted object held in the trash
+type TrashEntry struct {
+	Key     string    `json:"key"`
+	ID      string    `json:"id"`
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"`
+}
+
+// TrashEngine is implemented by engines keeping a trash of their own, such
+// as a remote objstore
+type TrashEngine interface {
+	// ListTrash calls fn for every trashed object whose key begins with
+	// prefix
+	ListTrash(prefix string, fn func(TrashEntry) error) error
+	// Undelete moves the trashed object id back under key. An empty id
+	// picks the latest object deleted under key.
+	Undelete(key string, id string) error
+}
+
+// ExpiringEngine is implemented by engines expiring objects themselves,
+// such as a remote objstore
+type ExpiringEngine interface {
+	ReadFromExpiring(key string, r io.Reader, expires time.Time) error
+}
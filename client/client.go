@@ -0,0 +1,580 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mshindle/objstore/api"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultRetries is the number of times a failed request is retried
+const DefaultRetries = 3
+
+// DefaultBackoff is the delay before the first retry
+const DefaultBackoff = 200 * time.Millisecond
+
+// metaHeaderPrefix starts the headers carrying user metadata
+const metaHeaderPrefix = "X-Objstore-Meta-"
+
+// checksumHeaderName carries the sha256 of an upload
+const checksumHeaderName = "X-Objstore-Checksum-Sha256"
+
+// expiresHeaderName carries the time an upload expires at
+const expiresHeaderName = "X-Objstore-Expires"
+
+// tierHeaderName names the tier holding an object
+const tierHeaderName = "X-Objstore-Tier"
+
+// ErrNotFound is returned when the server has no object under a key
+var ErrNotFound = api.ErrNotFound
+
+// ErrTruncated is returned when a listing ends before the server marked it
+// complete, such as when the connection drops
+var ErrTruncated = errors.New("listing ended before it was complete")
+
+// listTrailer is the last line of a listing
+type listTrailer struct {
+	Done  bool   `json:"done"`
+	Error string `json:"error"`
+}
+
+// Error is returned when the server answers with an unexpected status
+type Error struct {
+	Method     string
+	Key        string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.Key, e.StatusCode, e.Message)
+}
+
+// BadRequest reports whether the server refused the request, such as for
+// using "/" as a key or an upload which failed its checksum
+func (e *Error) BadRequest() bool {
+	return e.StatusCode == http.StatusBadRequest
+}
+
+// Rejected reports whether the server failed to store an object
+func (e *Error) Rejected() bool {
+	return e.StatusCode == http.StatusPreconditionFailed
+}
+
+// Unsupported reports whether the server's engine cannot carry out the
+// request, such as listing keys
+func (e *Error) Unsupported() bool {
+	return e.StatusCode == http.StatusNotImplemented
+}
+
+// Temporary reports whether the request may succeed if retried
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= http.StatusInternalServerError && e.StatusCode != http.StatusNotImplemented
+}
+
+// Client talks to an objstore server. Every call has a variant taking a
+// context. Client also implements api.Engine, api.Lister, api.Stater,
+// api.Versioner, api.TrashEngine and api.ExpiringEngine, so a remote
+// objstore can be used wherever an engine is expected.
+type Client struct {
+	base *url.URL
+
+	// HTTPClient sends the requests. Connections are pooled by its transport.
+	HTTPClient *http.Client
+	// Retries is the number of times a failed request is retried. Uploads
+	// are only retried when the reader is an io.Seeker.
+	Retries int
+	// Backoff is the delay before the first retry, doubled for each retry after it
+	Backoff time.Duration
+}
+
+// New creates a client for the objstore server at endpoint
+func New(endpoint string) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("objstore endpoint %s is not an http url", endpoint)
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   32,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	c := &Client{
+		base:       base,
+		HTTPClient: &http.Client{Transport: transport},
+		Retries:    DefaultRetries,
+		Backoff:    DefaultBackoff,
+	}
+	return c, nil
+}
+
+// Get returns a reader streaming the object under key. The caller must
+// close it.
+func (c *Client) Get(key string) (io.ReadCloser, error) {
+	return c.GetContext(context.Background(), key)
+}
+
+// GetContext is Get with a context
+func (c *Client) GetContext(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, c.url(key), key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put streams r to the server as the object under key
+func (c *Client) Put(key string, r io.Reader) error {
+	return c.PutContext(context.Background(), key, r)
+}
+
+// PutContext is Put with a context. A reader which is an io.Seeker is read
+// twice, first to send its length and sha256 for the server to check the
+// upload against.
+func (c *Client) PutContext(ctx context.Context, key string, r io.Reader) error {
+	return c.PutExpiringContext(ctx, key, r, time.Time{})
+}
+
+// PutExpiring is Put for an object the server deletes at expires
+func (c *Client) PutExpiring(key string, r io.Reader, expires time.Time) error {
+	return c.PutExpiringContext(context.Background(), key, r, expires)
+}
+
+// PutExpiringContext is PutExpiring with a context
+func (c *Client) PutExpiringContext(ctx context.Context, key string, r io.Reader, expires time.Time) error {
+	header := http.Header{}
+	if seeker, ok := r.(io.ReadSeeker); ok {
+		var err error
+		if header, err = checksumHeader(seeker); err != nil {
+			return err
+		}
+	}
+	if !expires.IsZero() {
+		header.Set(expiresHeaderName, expires.UTC().Format(time.RFC3339))
+	}
+	resp, err := c.do(ctx, http.MethodPut, c.url(key), key, r, header)
+	if err != nil && !expires.IsZero() {
+		return unsupported(err, api.ErrNoExpiry)
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// checksumHeader returns the headers describing the rest of r, leaving r
+// where it was
+func checksumHeader(r io.ReadSeeker) (http.Header, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = r.Seek(start, io.SeekStart); err != nil {
+		return nil, err
+	}
+	header := http.Header{}
+	header.Set(checksumHeaderName, hex.EncodeToString(h.Sum(nil)))
+	header.Set("Content-Length", strconv.FormatInt(n, 10))
+	return header, nil
+}
+
+// NewWriter returns a writer streaming to the object under key. The object
+// is stored once the writer is closed, which reports any upload error.
+func (c *Client) NewWriter(ctx context.Context, key string) io.WriteCloser {
+	pr, pw := io.Pipe()
+	w := &writer{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := c.PutContext(ctx, key, pr)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+	return w
+}
+
+// Delete removes the object under key
+func (c *Client) Delete(key string) error {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is Delete with a context
+func (c *Client) DeleteContext(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, c.url(key), key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Head describes the object under key without fetching it
+func (c *Client) Head(key string) (*api.ObjectInfo, error) {
+	return c.HeadContext(context.Background(), key)
+}
+
+// HeadContext is Head with a context
+func (c *Client) HeadContext(ctx context.Context, key string) (*api.ObjectInfo, error) {
+	resp, err := c.do(ctx, http.MethodHead, c.url(key), key, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	info := &api.ObjectInfo{
+		Key:         key,
+		ContentType: resp.Header.Get("Content-Type"),
+		Metadata:    map[string]string{},
+		Tier:        resp.Header.Get(tierHeaderName),
+	}
+	info.Size, _ = strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if modified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.Modified = modified
+	}
+	for name := range resp.Header {
+		if strings.HasPrefix(name, metaHeaderPrefix) {
+			info.Metadata[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = resp.Header.Get(name)
+		}
+	}
+	return info, nil
+}
+
+// List calls fn for every key on the server beginning with prefix. Listing
+// stops at the first error returned by fn.
+func (c *Client) List(prefix string, fn func(key string) error) error {
+	return c.ListContext(context.Background(), prefix, fn)
+}
+
+// ListContext is List with a context
+func (c *Client) ListContext(ctx context.Context, prefix string, fn func(key string) error) error {
+	u := *c.base
+	u.Path = c.base.Path + "/"
+	u.RawQuery = url.Values{"list": {""}, "prefix": {prefix}}.Encode()
+	resp, err := c.do(ctx, http.MethodGet, u.String(), prefix, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	return readListing(resp.Body, func(line []byte) error {
+		var entry struct {
+			Key string `json:"key"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		return fn(entry.Key)
+	})
+}
+
+// readListing calls fn for every entry of the JSON lines listing r up to its
+// trailer, failing if the listing has none or the server reports an error
+func readListing(r io.Reader, fn func(line []byte) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var trailer listTrailer
+		if err := json.Unmarshal(scanner.Bytes(), &trailer); err != nil {
+			return err
+		}
+		if trailer.Error != "" {
+			return fmt.Errorf("listing failed: %s", trailer.Error)
+		}
+		if trailer.Done {
+			return nil
+		}
+		if err := fn(scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return ErrTruncated
+}
+
+// Versions returns the versions the server keeps of key, newest first
+func (c *Client) Versions(key string) ([]api.VersionInfo, error) {
+	return c.VersionsContext(context.Background(), key)
+}
+
+// VersionsContext is Versions with a context
+func (c *Client) VersionsContext(ctx context.Context, key string) ([]api.VersionInfo, error) {
+	target := c.url(key) + "?" + url.Values{"versions": {""}}.Encode()
+	resp, err := c.do(ctx, http.MethodGet, target, key, nil, nil)
+	if err != nil {
+		return nil, unsupported(err, api.ErrNoVersions)
+	}
+	defer resp.Body.Close()
+
+	var versions []api.VersionInfo
+	dec := json.NewDecoder(resp.Body)
+	for dec.More() {
+		var v api.VersionInfo
+		if err = dec.Decode(&v); err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+// GetVersion returns a reader streaming version id of the object under key.
+// The caller must close it.
+func (c *Client) GetVersion(key string, id string) (io.ReadCloser, error) {
+	return c.GetVersionContext(context.Background(), key, id)
+}
+
+// GetVersionContext is GetVersion with a context
+func (c *Client) GetVersionContext(ctx context.Context, key string, id string) (io.ReadCloser, error) {
+	target := c.url(key) + "?" + url.Values{"versionId": {id}}.Encode()
+	resp, err := c.do(ctx, http.MethodGet, target, key, nil, nil)
+	if err != nil {
+		return nil, unsupported(err, api.ErrNoVersions)
+	}
+	return resp.Body, nil
+}
+
+// Restore makes version id of the object under key its latest version
+func (c *Client) Restore(key string, id string) error {
+	return c.RestoreContext(context.Background(), key, id)
+}
+
+// RestoreContext is Restore with a context
+func (c *Client) RestoreContext(ctx context.Context, key string, id string) error {
+	target := c.url(key) + "?" + url.Values{"restore": {id}}.Encode()
+	resp, err := c.do(ctx, http.MethodPut, target, key, nil, nil)
+	if err != nil {
+		return unsupported(err, api.ErrNoVersions)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ListTrash calls fn for every trashed object on the server whose key
+// begins with prefix
+func (c *Client) ListTrash(prefix string, fn func(api.TrashEntry) error) error {
+	return c.ListTrashContext(context.Background(), prefix, fn)
+}
+
+// ListTrashContext is ListTrash with a context
+func (c *Client) ListTrashContext(ctx context.Context, prefix string, fn func(api.TrashEntry) error) error {
+	u := *c.base
+	u.Path = c.base.Path + "/"
+	u.RawQuery = url.Values{"trash": {""}, "prefix": {prefix}}.Encode()
+	resp, err := c.do(ctx, http.MethodGet, u.String(), prefix, nil, nil)
+	if err != nil {
+		return unsupported(err, api.ErrNoTrash)
+	}
+	defer resp.Body.Close()
+
+	return readListing(resp.Body, func(line []byte) error {
+		var entry api.TrashEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		return fn(entry)
+	})
+}
+
+// Undelete moves the trashed object id back under key. An empty id picks
+// the latest object deleted under key.
+func (c *Client) Undelete(key string, id string) error {
+	return c.UndeleteContext(context.Background(), key, id)
+}
+
+// UndeleteContext is Undelete with a context
+func (c *Client) UndeleteContext(ctx context.Context, key string, id string) error {
+	target := c.url(key) + "?" + url.Values{"undelete": {id}}.Encode()
+	resp, err := c.do(ctx, http.MethodPut, target, key, nil, nil)
+	if herr, ok := err.(*Error); ok && herr.StatusCode == http.StatusConflict {
+		return api.ErrExists
+	}
+	if err != nil {
+		return unsupported(err, api.ErrNoTrash)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// unsupported turns a server unable to carry out a request into the ops
+// error saying so
+func unsupported(err error, opsErr error) error {
+	if herr, ok := err.(*Error); ok && herr.Unsupported() {
+		return opsErr
+	}
+	return err
+}
+
+// WriteVersion implements api.Versioner by copying version id of the object
+// under key to w
+func (c *Client) WriteVersion(key string, id string, w io.Writer) error {
+	body, err := c.GetVersion(key, id)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// WriteTo implements api.Engine by copying the object under key to w
+func (c *Client) WriteTo(key string, w io.Writer) error {
+	body, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
+}
+
+// ReadFrom implements api.Engine by storing r under key
+func (c *Client) ReadFrom(key string, r io.Reader) error {
+	err := c.Put(key, r)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"error": err, "key": key}).Error("failed to upload")
+	}
+	return err
+}
+
+// ReadFromExpiring implements api.ExpiringEngine by storing r under key
+// until expires
+func (c *Client) ReadFromExpiring(key string, r io.Reader, expires time.Time) error {
+	return c.PutExpiring(key, r, expires)
+}
+
+// Stat implements api.Stater
+func (c *Client) Stat(key string) (*api.ObjectInfo, error) {
+	return c.Head(key)
+}
+
+// do sends a request, retrying connection failures and server errors with
+// backoff. A body which cannot be rewound is only sent once. Retries stop
+// as soon as a response arrives, so a streamed body is never repeated.
+func (c *Client) do(ctx context.Context, method string, target string, key string, body io.Reader, header http.Header) (*http.Response, error) {
+	seeker, rewind := body.(io.Seeker)
+	var start int64
+	if rewind {
+		var err error
+		if start, err = seeker.Seek(0, io.SeekCurrent); err != nil {
+			rewind = false
+		}
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, target, key, body, header)
+		if err == nil {
+			return resp, nil
+		}
+		retry := attempt < c.Retries && (body == nil || rewind) && ctx.Err() == nil
+		if herr, ok := err.(*Error); ok && !herr.Temporary() {
+			retry = false
+		}
+		if err == ErrNotFound {
+			retry = false
+		}
+		if !retry {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{"error": err, "key": key, "attempt": attempt + 1}).Warn("retrying objstore request")
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if rewind {
+			if _, err = seeker.Seek(start, io.SeekStart); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// send makes a single request, turning error statuses into errors
+func (c *Client) send(ctx context.Context, method string, target string, key string, body io.Reader, header http.Header) (*http.Response, error) {
+	if body != nil {
+		// hide the body's concrete type so the transport streams it and
+		// never closes it
+		body = ioutil.NopCloser(body)
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if n, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil {
+		req.ContentLength = n
+	}
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrNotFound
+	}
+	return nil, &Error{
+		Method:     method,
+		Key:        key,
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(msg)),
+	}
+}
+
+func (c *Client) url(key string) string {
+	u := *c.base
+	u.Path = c.base.Path + "/" + strings.TrimPrefix(key, "/")
+	u.RawPath = ""
+	return u.String()
+}
+
+// writer streams the bytes written to it into an upload
+type writer struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+func (w *writer) Close() error {
+	w.pw.Close()
+	return <-w.done
+}
@@ -0,0 +1,315 @@
+package client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mshindle/objstore/api"
+)
+
+// fakeServer answers the objstore protocol from objects kept in memory
+type fakeServer struct {
+	m       sync.Mutex
+	objects map[string]string
+	expires map[string]string
+	// failures is the number of requests answered 503 before serving again
+	failures int
+	requests int
+}
+
+func newFakeServer(t *testing.T) (*fakeServer, *Client) {
+	f := &fakeServer{objects: map[string]string{}, expires: map[string]string{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Backoff = time.Millisecond
+	return f, c
+}
+
+// object returns the body held under key
+func (f *fakeServer) object(key string) string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.objects[key]
+}
+
+// fail answers the next n requests with 503 and resets the request count
+func (f *fakeServer) fail(n int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.failures, f.requests = n, 0
+}
+
+// sent returns the number of requests answered since fail was last called
+func (f *fakeServer) sent() int {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.requests
+}
+
+func (f *fakeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	f.requests++
+	if f.failures > 0 {
+		f.failures--
+		http.Error(w, "try again", http.StatusServiceUnavailable)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	query := r.URL.Query()
+	if key == "" {
+		f.list(w, r)
+		return
+	}
+	if _, ok := query["versions"]; ok {
+		http.Error(w, "engine keeps no versions", http.StatusNotImplemented)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		body, ok := f.objects[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, body)
+	case http.MethodHead:
+		body, ok := f.objects[key]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set(metaHeaderPrefix+"Owner", "ops")
+		w.Header().Set(tierHeaderName, "hot")
+	case http.MethodPut:
+		if _, ok := query["undelete"]; ok {
+			http.Error(w, "object exists", http.StatusConflict)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if want := r.Header.Get(checksumHeaderName); want != "" {
+			sum := sha256.Sum256(body)
+			if hex.EncodeToString(sum[:]) != want || r.ContentLength != int64(len(body)) {
+				http.Error(w, "upload does not match", http.StatusBadRequest)
+				return
+			}
+		}
+		f.objects[key] = string(body)
+		f.expires[key] = r.Header.Get(expiresHeaderName)
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodDelete:
+		if _, ok := f.objects[key]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list answers a listing. The prefixes "truncated" and "failing" end it
+// without a trailer and with an error.
+func (f *fakeServer) list(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["list"]; !ok {
+		http.Error(w, "cannot use / as a key", http.StatusBadRequest)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	enc := json.NewEncoder(w)
+	for _, key := range keys {
+		enc.Encode(map[string]string{"key": key})
+	}
+	switch prefix {
+	case "truncated":
+	case "failing":
+		enc.Encode(listTrailer{Error: "disk failed"})
+	default:
+		enc.Encode(listTrailer{Done: true})
+	}
+}
+
+func TestClient(t *testing.T) {
+	f, c := newFakeServer(t)
+	key := "a dir/with%escapes"
+
+	if _, err := c.Get(key); err != ErrNotFound {
+		t.Fatalf("getting a missing key: got %v, want ErrNotFound", err)
+	}
+	if err := c.Put(key, strings.NewReader("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if f.object(key) != "hello" {
+		t.Fatalf("server holds %q under %q", f.object(key), key)
+	}
+	var b strings.Builder
+	if err := c.WriteTo(key, &b); err != nil || b.String() != "hello" {
+		t.Fatalf("reading back: %q, %v", b.String(), err)
+	}
+
+	w := c.NewWriter(context.Background(), "a dir/streamed")
+	io.WriteString(w, "streamed ")
+	io.WriteString(w, "body")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if f.object("a dir/streamed") != "streamed body" {
+		t.Fatalf("streamed %q", f.object("a dir/streamed"))
+	}
+
+	info, err := c.Head(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &api.ObjectInfo{
+		Key:         key,
+		Size:        5,
+		Modified:    time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"owner": "ops"},
+		Tier:        "hot",
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Fatalf("head %+v, want %+v", info, want)
+	}
+
+	var keys []string
+	if err := c.List("a dir/", func(k string) error { keys = append(keys, k); return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a dir/streamed", key}) {
+		t.Fatalf("listed %q", keys)
+	}
+
+	if err := c.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(key); err != ErrNotFound {
+		t.Fatalf("deleting a deleted key: got %v, want ErrNotFound", err)
+	}
+	if _, err := c.Head(key); err != ErrNotFound {
+		t.Fatalf("head of a deleted key: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestClientChecksum(t *testing.T) {
+	f, c := newFakeServer(t)
+	// a seekable upload carries its length and sha256
+	if err := c.Put("key", strings.NewReader("checked")); err != nil {
+		t.Fatal(err)
+	}
+	r := strings.NewReader("changed while read")
+	header, err := checksumHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header.Set(checksumHeaderName, strings.Repeat("0", 64))
+	_, err = c.do(context.Background(), http.MethodPut, c.url("key"), "key", r, header)
+	if herr, ok := err.(*Error); !ok || !herr.BadRequest() {
+		t.Fatalf("upload not matching its checksum: got %v, want a bad request", err)
+	}
+	if f.object("key") != "checked" {
+		t.Fatalf("server holds %q", f.object("key"))
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	f, c := newFakeServer(t)
+	f.fail(2)
+	if err := c.Put("key", strings.NewReader("retried")); err != nil {
+		t.Fatalf("retrying a seekable upload: %v", err)
+	}
+	if f.sent() != 3 {
+		t.Fatalf("sent %d requests, want 3", f.sent())
+	}
+
+	// a body which cannot be rewound is sent once
+	f.fail(1)
+	err := c.Put("key", ioutil.NopCloser(strings.NewReader("streamed")))
+	if herr, ok := err.(*Error); !ok || !herr.Temporary() {
+		t.Fatalf("streamed upload to a failing server: got %v", err)
+	}
+	if f.sent() != 1 {
+		t.Fatalf("sent %d requests, want 1", f.sent())
+	}
+
+	// missing keys are not retried
+	f.fail(0)
+	if _, err := c.Get("missing"); err != ErrNotFound || f.sent() != 1 {
+		t.Fatalf("getting a missing key: %v after %d requests", err, f.sent())
+	}
+
+	f.fail(c.Retries + 1)
+	if _, err := c.Get("key"); err == nil {
+		t.Fatal("getting from a failing server: got no error")
+	}
+	if f.sent() != c.Retries+1 {
+		t.Fatalf("sent %d requests, want %d", f.sent(), c.Retries+1)
+	}
+}
+
+func TestClientListing(t *testing.T) {
+	_, c := newFakeServer(t)
+	for _, key := range []string{"truncated/a", "failing/a"} {
+		if err := c.Put(key, strings.NewReader("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.List("truncated", func(string) error { return nil }); err != ErrTruncated {
+		t.Fatalf("listing without a trailer: got %v, want ErrTruncated", err)
+	}
+	err := c.List("failing", func(string) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "disk failed") {
+		t.Fatalf("listing ended by an error: got %v", err)
+	}
+	err = c.Put("", strings.NewReader("x"))
+	if herr, ok := err.(*Error); !ok || !herr.BadRequest() {
+		t.Fatalf("putting to /: got %v, want a bad request", err)
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	f, c := newFakeServer(t)
+	if _, err := c.Versions("key"); err != api.ErrNoVersions {
+		t.Fatalf("versions from a server keeping none: got %v, want ErrNoVersions", err)
+	}
+	if err := c.Undelete("key", ""); err != api.ErrExists {
+		t.Fatalf("undeleting over an object: got %v, want ErrExists", err)
+	}
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := c.PutExpiring("key", strings.NewReader("x"), expires); err != nil {
+		t.Fatal(err)
+	}
+	f.m.Lock()
+	sent := f.expires["key"]
+	f.m.Unlock()
+	if sent != "2030-01-02T03:04:05Z" {
+		t.Fatalf("sent expiry %q", sent)
+	}
+}
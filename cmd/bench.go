@@ -0,0 +1,201 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var benchOpts struct {
+	concurrency int
+	duration    time.Duration
+	mix         string
+	sizes       string
+	preload     int
+	prefix      string
+	keep        bool
+	json        bool
+	growth      float64
+}
+
+// benchCmd represents the bench command
+var benchCmd = &cobra.Command{
+	Use:   "bench",
+	Short: "measure the throughput and latency of an engine",
+	Long: `Drives the configured engine, or a running server with --server, with a
+mix of gets, puts and deletes and reports the throughput and latency
+percentiles of each operation.
+
+The mix weighs each operation, e.g. "get=8,put=2" for a read heavy load.
+Object sizes are a list of sizes or size ranges with optional weights, e.g.
+"4KiB:70,1MiB-4MiB:25,64MiB:5". Objects are written below --prefix and
+removed at the end unless --keep is given.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		mix, err := parseMix(benchOpts.mix)
+		if err != nil {
+			return err
+		}
+		sizes, err := parseSizes(benchOpts.sizes)
+		if err != nil {
+			return err
+		}
+		e, err := openEngine()
+		if err != nil {
+			return err
+		}
+
+		b := ops.NewBenchmark(e)
+		b.Concurrency = benchOpts.concurrency
+		b.Duration = benchOpts.duration
+		b.Mix = mix
+		b.Sizes = sizes
+		b.Preload = benchOpts.preload
+		b.Prefix = benchOpts.prefix
+		b.Keep = benchOpts.keep
+		b.BufferGrowth = benchOpts.growth
+		report, err := b.Run()
+		if err != nil {
+			return err
+		}
+
+		if benchOpts.json {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(report)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "op\tcount\terrors\tops/s\tthroughput\tp50\tp90\tp99\tmax")
+		for _, r := range report.Results {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%.1f\t%s/s\t%s\t%s\t%s\t%s\n", r.Op, r.Count, r.Errors, r.OpsPerSec,
+				humanSize(int64(r.BytesPerSec)), round(r.P50), round(r.P90), round(r.P99), round(r.Max))
+		}
+		w.Flush()
+		fmt.Printf("%d workers for %s\n", benchOpts.concurrency, round(report.Elapsed))
+		return nil
+	},
+}
+
+// parseMix reads operation weights such as "get=8,put=2"
+func parseMix(spec string) (map[string]int, error) {
+	mix := map[string]int{}
+	for _, part := range strings.Split(spec, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		op := kv[0]
+		if op != ops.BenchGet && op != ops.BenchPut && op != ops.BenchDelete {
+			return nil, errors.Errorf("unknown operation %q in mix", op)
+		}
+		weight := 1
+		if len(kv) == 2 {
+			var err error
+			if weight, err = strconv.Atoi(kv[1]); err != nil || weight < 0 {
+				return nil, errors.Errorf("invalid weight %q for %s", kv[1], op)
+			}
+		}
+		mix[op] = weight
+	}
+	return mix, nil
+}
+
+// parseSizes reads size classes such as "4KiB:70,1MiB-4MiB:25"
+func parseSizes(spec string) ([]ops.SizeClass, error) {
+	var sizes []ops.SizeClass
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		c := ops.SizeClass{Weight: 1}
+		if i := strings.LastIndex(part, ":"); i >= 0 {
+			w, err := strconv.Atoi(part[i+1:])
+			if err != nil || w < 0 {
+				return nil, errors.Errorf("invalid weight in size %q", part)
+			}
+			c.Weight, part = w, part[:i]
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		var err error
+		if c.Min, err = parseSize(bounds[0]); err != nil {
+			return nil, err
+		}
+		c.Max = c.Min
+		if len(bounds) == 2 {
+			if c.Max, err = parseSize(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		sizes = append(sizes, c)
+	}
+	return sizes, nil
+}
+
+// parseSize reads a byte count with an optional unit such as KiB or MB
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1},
+	}
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// round trims a duration to a readable precision
+func round(d time.Duration) time.Duration {
+	switch {
+	case d > time.Second:
+		return d.Round(time.Millisecond)
+	case d > time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	default:
+		return d.Round(time.Microsecond)
+	}
+}
+
+func init() {
+	RootCmd.AddCommand(benchCmd)
+
+	addStoreFlags(benchCmd)
+	benchCmd.Flags().IntVar(&benchOpts.concurrency, "concurrency", 4, "number of concurrent workers")
+	benchCmd.Flags().DurationVarP(&benchOpts.duration, "duration", "d", 30*time.Second, "how long to run the workload")
+	benchCmd.Flags().StringVar(&benchOpts.mix, "mix", "get=1,put=1,delete=1", "weights of the operations")
+	benchCmd.Flags().StringVar(&benchOpts.sizes, "sizes", "1MiB", "object sizes and their weights")
+	benchCmd.Flags().IntVar(&benchOpts.preload, "preload", 16, "objects written before timing starts")
+	benchCmd.Flags().StringVar(&benchOpts.prefix, "prefix", "objstore-bench/", "prefix of the keys written")
+	benchCmd.Flags().BoolVar(&benchOpts.keep, "keep", false, "leave the objects written in place")
+	benchCmd.Flags().BoolVar(&benchOpts.json, "json", false, "report as JSON")
+	benchCmd.Flags().Float64Var(&benchOpts.growth, "buffer-growth", 0, "growth rate of the buffers gets are read into (default 1.4)")
+}
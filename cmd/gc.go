@@ -0,0 +1,72 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var gcOpts struct {
+	engine string
+	grace  time.Duration
+	dryRun bool
+}
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc",
+	Short: "reclaim unreferenced deduplicated objects",
+	Long: `Removes the stored content of a dedup engine which is no longer
+referenced by any key. Unreferenced content is marked by one run and only
+removed by a later run once the grace period has passed, so gc is safe to
+run alongside a server storing objects.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		e, err := server.BuildEngine(settings, gcOpts.engine)
+		if err != nil {
+			return err
+		}
+		dedup, ok := e.(*ops.DedupEngine)
+		if !ok {
+			return errors.New("gc requires a dedup engine")
+		}
+		if gcOpts.grace > 0 {
+			dedup.Grace = gcOpts.grace
+		}
+		stats, err := dedup.Collect(gcOpts.dryRun)
+		if err != nil {
+			return err
+		}
+		verb := "deleted"
+		if gcOpts.dryRun {
+			verb = "to delete"
+		}
+		fmt.Printf("gc complete: %d blobs scanned, %d newly unreferenced, %d %s\n", stats.Scanned, stats.Marked, stats.Deleted, verb)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(gcCmd)
+
+	gcCmd.Flags().StringVarP(&gcOpts.engine, "engine", "e", "", "named dedup engine to collect (default is the configured engine)")
+	gcCmd.Flags().DurationVar(&gcOpts.grace, "grace", 0, "how long a blob stays unreferenced before it is removed (default 1h)")
+	gcCmd.Flags().BoolVarP(&gcOpts.dryRun, "dry-run", "n", false, "only report unreferenced blobs")
+}
@@ -0,0 +1,127 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var getVersion string
+
+// getCmd represents the get command
+var getCmd = &cobra.Command{
+	Use:   "get <key> [file]",
+	Short: "download objects to files",
+	Long: `Downloads the object under key to file, which defaults to the last
+element of the key. A file of "-" writes the object to stdout. With
+--recursive, or a key holding glob characters such as "logs/*.gz", every
+matching object is downloaded below the directory given as file. An earlier
+version of a single object is downloaded with --version.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		pattern := args[0]
+		dest := ""
+		if len(args) > 1 {
+			dest = args[1]
+		}
+
+		single := !storeOpts.recursive && !strings.ContainsAny(pattern, `*?[\`)
+		if getVersion != "" && !single {
+			return errors.New("--version needs a single key")
+		}
+		if single {
+			key := strings.TrimPrefix(pattern, "/")
+			if dest == "" {
+				dest = path.Base(key)
+			} else if info, err := os.Stat(dest); err == nil && info.IsDir() {
+				dest = filepath.Join(dest, path.Base(key))
+			}
+			return getObject(s, key, dest)
+		}
+
+		if dest == "" {
+			dest = "."
+		}
+		base := keyBase(pattern)
+		count := 0
+		err = matchKeys(s, pattern, storeOpts.recursive, func(key string) error {
+			count++
+			return getObject(s, key, filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(key, base))))
+		})
+		if err != nil {
+			return err
+		}
+		if count == 0 {
+			return errors.Errorf("no objects match %s", pattern)
+		}
+		return nil
+	},
+}
+
+// getObject downloads key to the file dest, or stdout for "-"
+func getObject(s *ops.Storage, key string, dest string) error {
+	p := newProgress(key)
+	retrieve := s.Retrieve
+	if getVersion != "" {
+		retrieve = func(key string, w io.Writer) error {
+			return s.RetrieveVersion(key, getVersion, w)
+		}
+	}
+	if dest == "-" {
+		p.quiet = true
+		return retrieve(key, os.Stdout)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	// download next to dest so a failure never leaves a partial file
+	f, err := os.Create(dest + ".part")
+	if err != nil {
+		return err
+	}
+	err = retrieve(key, p.writer(f))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), dest)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return errors.Wrapf(err, "could not get %s", key)
+	}
+	p.done()
+	return nil
+}
+
+func init() {
+	RootCmd.AddCommand(getCmd)
+
+	addStoreFlags(getCmd)
+	getCmd.Flags().BoolVarP(&storeOpts.recursive, "recursive", "r", false, "download every object below key")
+	getCmd.Flags().StringVar(&getVersion, "version", "", "version of the object to download")
+}
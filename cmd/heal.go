@@ -0,0 +1,62 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var healEngine string
+
+// healCmd represents the heal command
+var healCmd = &cobra.Command{
+	Use:   "heal [prefix]",
+	Short: "rebuild missing or corrupt erasure coded shards",
+	Long: `Reads every object of an erasure coded engine, optionally limited
+to keys beginning with prefix, and rewrites any shards which are missing or
+fail their checksum.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		e, err := server.BuildEngine(settings, healEngine)
+		if err != nil {
+			return err
+		}
+		erasure, ok := e.(*ops.ErasureFile)
+		if !ok {
+			return errors.New("heal requires an erasure engine")
+		}
+		prefix := ""
+		if len(args) > 0 {
+			prefix = args[0]
+		}
+		stats, err := erasure.HealAll(prefix)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("heal complete: %d objects scanned, %d healed, %d lost\n", stats.Scanned, stats.Healed, stats.Lost)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(healCmd)
+
+	healCmd.Flags().StringVarP(&healEngine, "engine", "e", "", "named erasure engine to heal (default is the configured engine)")
+}
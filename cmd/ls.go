@@ -0,0 +1,97 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var lsOpts struct {
+	long bool
+}
+
+// lsCmd represents the ls command
+var lsCmd = &cobra.Command{
+	Use:   "ls [prefix]",
+	Short: "list objects",
+	Long: `Lists the keys beginning with prefix, or every key without one. A
+prefix holding glob characters such as "logs/2017-*" lists the keys matching
+it. With --long the size and modification time of each object is shown,
+and the tier holding it on engines moving objects between tiers.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		pattern := ""
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		count := 0
+		fn := func(key string) error {
+			count++
+			if !lsOpts.long {
+				fmt.Println(key)
+				return nil
+			}
+			info, err := s.Stat(key)
+			if err != nil {
+				return errors.Wrapf(err, "could not stat %s", key)
+			}
+			modified := "-"
+			if !info.Modified.IsZero() {
+				modified = info.Modified.Local().Format(time.RFC3339)
+			}
+			if info.Tier != "" {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", info.Size, modified, key, info.Tier)
+				return nil
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", info.Size, modified, key)
+			return nil
+		}
+		if strings.ContainsAny(pattern, `*?[\`) {
+			err = matchKeys(s, pattern, false, fn)
+		} else {
+			err = s.List(strings.TrimPrefix(pattern, "/"), fn)
+		}
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			return err
+		}
+		if count == 0 && !storeOpts.quiet {
+			fmt.Fprintf(os.Stderr, "no objects match %s\n", pattern)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(lsCmd)
+
+	addStoreFlags(lsCmd)
+	lsCmd.Flags().BoolVar(&lsOpts.long, "long", false, "show the size and modification time of each object")
+}
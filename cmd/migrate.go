@@ -0,0 +1,148 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var migrateOpts struct {
+	from      string
+	to        string
+	rate      float64
+	bandwidth int64
+	noVerify  bool
+	state     string
+	diffOnly  bool
+	quiet     bool
+}
+
+// migrateCmd represents the migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate --from <engine> --to <engine>",
+	Short: "copy every object from one engine to another",
+	Long: `Copies every object of the --from engine to the --to engine, reading
+each copy back to verify its sha256. Each engine is the name of a configured
+engine, the path of a config file whose top level engine is used, or any
+location accepted by sync.
+
+Progress is saved to the state file so an interrupted migration resumes
+where it stopped, and objects which failed are retried by the next run.
+Once the copy is done the keys and sizes of both engines are compared and
+any differences are reported.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if migrateOpts.from == "" || migrateOpts.to == "" {
+			return errors.New("migrate requires --from and --to")
+		}
+		quietLogging()
+		src, err := openEngineConfig(migrateOpts.from)
+		if err != nil {
+			return errors.Wrap(err, "migration source")
+		}
+		dst, err := openEngineConfig(migrateOpts.to)
+		if err != nil {
+			return errors.Wrap(err, "migration destination")
+		}
+
+		m := ops.NewMigrator(src, dst)
+		m.Rate = migrateOpts.rate
+		m.Bandwidth = migrateOpts.bandwidth
+		m.Verify = !migrateOpts.noVerify
+		m.State = migrateOpts.state
+		m.Report = func(key string, err error) {
+			if err != nil {
+				fmt.Printf("failed %s: %v\n", key, err)
+				return
+			}
+			if !migrateOpts.quiet {
+				fmt.Printf("copied %s\n", key)
+			}
+		}
+
+		if !migrateOpts.diffOnly {
+			p, err := m.Run()
+			if p != nil {
+				fmt.Printf("migration %s: %d objects scanned, %d copied (%s), %d verified, %d failed\n",
+					status(err), p.Scanned, p.Copied, humanSize(p.Bytes), p.Verified, len(p.Failed))
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		stats, err := m.Diff(func(kind string, key string) error {
+			fmt.Printf("%-8s %s\n", kind, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("diff: %d keys compared, %d missing, %d extra, %d size mismatches\n",
+			stats.Scanned, stats.Missing, stats.Extra, stats.Size)
+		if stats.Missing+stats.Size > 0 {
+			return errors.New("destination differs from source")
+		}
+		return nil
+	},
+}
+
+// openEngineConfig returns the engine named by spec, which is a config file,
+// a configured engine or a location accepted by sync
+func openEngineConfig(spec string) (ops.Engine, error) {
+	if info, err := os.Stat(spec); err == nil && !info.IsDir() {
+		v := viper.New()
+		v.SetConfigFile(spec)
+		if err = v.ReadInConfig(); err != nil {
+			return nil, err
+		}
+		s := &server.Settings{}
+		if err = v.Unmarshal(s); err != nil {
+			return nil, err
+		}
+		return server.BuildEngine(s, "")
+	}
+	if strings.Contains(spec, ":") || strings.Contains(spec, "/") {
+		return openEndpoint(spec)
+	}
+	return server.BuildEngine(settings, spec)
+}
+
+func status(err error) string {
+	if err != nil {
+		return "stopped"
+	}
+	return "complete"
+}
+
+func init() {
+	RootCmd.AddCommand(migrateCmd)
+
+	migrateCmd.Flags().StringVar(&migrateOpts.from, "from", "", "engine to copy objects from")
+	migrateCmd.Flags().StringVar(&migrateOpts.to, "to", "", "engine to copy objects to")
+	migrateCmd.Flags().Float64Var(&migrateOpts.rate, "rate", 0, "max objects copied per second (0 is unlimited)")
+	migrateCmd.Flags().Int64Var(&migrateOpts.bandwidth, "bandwidth", 0, "max bytes copied per second (0 is unlimited)")
+	migrateCmd.Flags().BoolVar(&migrateOpts.noVerify, "no-verify", false, "do not read copies back to verify them")
+	migrateCmd.Flags().StringVar(&migrateOpts.state, "state", ".objstore-migrate.json", "file recording migration progress")
+	migrateCmd.Flags().BoolVar(&migrateOpts.diffOnly, "diff-only", false, "only compare the engines")
+	migrateCmd.Flags().BoolVarP(&migrateOpts.quiet, "quiet", "q", false, "only report failures and summaries")
+}
@@ -0,0 +1,198 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mshindle/objstore/client"
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// storeOpts are the flags shared by the object commands
+var storeOpts struct {
+	server    string
+	engine    string
+	recursive bool
+	quiet     bool
+}
+
+// addStoreFlags registers the flags choosing where the object commands
+// operate
+func addStoreFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&storeOpts.server, "server", "s", "", "objstore server URL (default is to use the configured engine directly)")
+	cmd.Flags().StringVarP(&storeOpts.engine, "engine", "e", "", "named engine to use (default is the configured engine)")
+	cmd.Flags().BoolVarP(&storeOpts.quiet, "quiet", "q", false, "do not report progress")
+}
+
+// openStorage returns the storage the object commands operate on, either a
+// running server or the configured engine
+func openStorage() (*ops.Storage, error) {
+	e, err := openEngine()
+	if err != nil {
+		return nil, err
+	}
+	cfg := &ops.Config{Engine: e}
+	// a server records checksums, keeps a trash and expires objects itself
+	if storeOpts.server == "" {
+		cfg.Checksums = settings.Checksums
+		cfg.Trash = settings.Trash.Retention
+		cfg.Expiration = settings.Expiration.Enabled
+		cfg.Lifecycle = settings.Lifecycle()
+	}
+	return ops.NewStorage(cfg), nil
+}
+
+// openEngine returns the engine the object commands operate on
+func openEngine() (ops.Engine, error) {
+	quietLogging()
+	if storeOpts.server != "" {
+		return client.New(storeOpts.server)
+	}
+	return server.BuildEngine(settings, storeOpts.engine)
+}
+
+// quietLogging keeps engine logging out of the way of command output
+func quietLogging() {
+	logrus.SetOutput(os.Stderr)
+	logrus.SetLevel(logrus.WarnLevel)
+}
+
+// matchKeys calls fn for every key selected by pattern. A pattern holding
+// glob characters matches keys as path.Match does, otherwise it names a
+// single key, or every key below it when recursive.
+func matchKeys(s *ops.Storage, pattern string, recursive bool, fn func(key string) error) error {
+	pattern = strings.TrimPrefix(pattern, "/")
+	i := strings.IndexAny(pattern, `*?[\`)
+	if i < 0 && !recursive {
+		return fn(pattern)
+	}
+	if i < 0 {
+		return s.List(dirPrefix(pattern), fn)
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	return s.List(pattern[:i], func(key string) error {
+		if globMatch(pattern, key, recursive) {
+			return fn(key)
+		}
+		return nil
+	})
+}
+
+// globMatch reports whether key matches pattern. When recursive, keys
+// below a matching directory match too.
+func globMatch(pattern string, key string, recursive bool) bool {
+	if ok, _ := path.Match(pattern, key); ok {
+		return true
+	}
+	if !recursive {
+		return false
+	}
+	for dir := path.Dir(key); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if ok, _ := path.Match(pattern, dir); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// keyBase returns the part of pattern that selected keys are named
+// relative to
+func keyBase(pattern string) string {
+	pattern = strings.TrimPrefix(pattern, "/")
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:strings.LastIndex(pattern[:i], "/")+1]
+	}
+	return dirPrefix(pattern)
+}
+
+// dirPrefix turns a key into the prefix of the keys below it
+func dirPrefix(key string) string {
+	if key == "" || strings.HasSuffix(key, "/") {
+		return key
+	}
+	return key + "/"
+}
+
+// progress counts the bytes of a transfer, reporting them to stderr
+type progress struct {
+	name  string
+	n     int64
+	start time.Time
+	last  time.Time
+	quiet bool
+}
+
+func newProgress(name string) *progress {
+	now := time.Now()
+	return &progress{name: name, start: now, last: now, quiet: storeOpts.quiet}
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.n += int64(len(b))
+	if !p.quiet && time.Since(p.last) > 500*time.Millisecond {
+		p.last = time.Now()
+		fmt.Fprintf(os.Stderr, "\r%s  %s  %s/s", p.name, humanSize(p.n), humanSize(p.rate()))
+	}
+	return len(b), nil
+}
+
+// done reports the finished transfer
+func (p *progress) done() {
+	if !p.quiet {
+		fmt.Fprintf(os.Stderr, "\r%s  %s  %s/s\n", p.name, humanSize(p.n), humanSize(p.rate()))
+	}
+}
+
+func (p *progress) rate() int64 {
+	secs := time.Since(p.start).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return int64(float64(p.n) / secs)
+}
+
+// reader counts what is read through r
+func (p *progress) reader(r io.Reader) io.Reader {
+	return io.TeeReader(r, p)
+}
+
+// writer counts what is written to w
+func (p *progress) writer(w io.Writer) io.Writer {
+	return io.MultiWriter(w, p)
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,149 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var putTTL time.Duration
+
+// putCmd represents the put command
+var putCmd = &cobra.Command{
+	Use:   "put <file> <key>",
+	Short: "upload files as objects",
+	Long: `Uploads file as the object under key. A file of "-" reads the object
+from stdin, and a key ending in "/" is completed with the file name. With
+--recursive the files below a directory are uploaded below key, and a file
+holding glob characters such as "logs/*.gz" uploads every matching file
+below key. Objects put with --expires are deleted once that time has passed.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		src, key := args[0], strings.TrimPrefix(args[1], "/")
+
+		if src == "-" {
+			p := newProgress(key)
+			if err = storeObject(s, key, p.reader(os.Stdin)); err != nil {
+				return errors.Wrapf(err, "could not put %s", key)
+			}
+			p.done()
+			return nil
+		}
+
+		if !strings.ContainsAny(src, `*?[\`) {
+			info, err := os.Stat(src)
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return putDir(s, src, key)
+			}
+			if key == "" || strings.HasSuffix(key, "/") {
+				key += filepath.Base(src)
+			}
+			return putFile(s, src, key)
+		}
+
+		files, err := filepath.Glob(src)
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return errors.Errorf("no files match %s", src)
+		}
+		for _, file := range files {
+			info, err := os.Stat(file)
+			if err != nil {
+				return err
+			}
+			k := path.Join(key, filepath.Base(file))
+			if info.IsDir() && !storeOpts.recursive {
+				fmt.Fprintf(os.Stderr, "skipping directory %s\n", file)
+				continue
+			}
+			if info.IsDir() {
+				err = putDir(s, file, k)
+			} else {
+				err = putFile(s, file, k)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+// putDir uploads the files below dir as the keys below prefix
+func putDir(s *ops.Storage, dir string, prefix string) error {
+	if !storeOpts.recursive {
+		return errors.Errorf("%s is a directory (use --recursive)", dir)
+	}
+	return filepath.Walk(dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		return putFile(s, name, path.Join(prefix, filepath.ToSlash(rel)))
+	})
+}
+
+// putFile uploads the file name as key
+func putFile(s *ops.Storage, name string, key string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	p := newProgress(key)
+	if err = storeObject(s, key, p.reader(f)); err != nil {
+		return errors.Wrapf(err, "could not put %s", key)
+	}
+	p.done()
+	return nil
+}
+
+// storeObject stores r under key, expiring it if asked to
+func storeObject(s *ops.Storage, key string, r io.Reader) error {
+	if putTTL <= 0 {
+		return s.Store(key, r)
+	}
+	return s.StoreExpiring(key, r, nil, time.Now().Add(putTTL))
+}
+
+func init() {
+	RootCmd.AddCommand(putCmd)
+
+	addStoreFlags(putCmd)
+	putCmd.Flags().BoolVarP(&storeOpts.recursive, "recursive", "r", false, "upload the files below a directory")
+	putCmd.Flags().DurationVar(&putTTL, "expires", 0, "delete the objects after this long")
+}
@@ -0,0 +1,53 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// reapCmd represents the reap command
+var reapCmd = &cobra.Command{
+	Use:   "reap",
+	Short: "delete expired objects",
+	Long: `Deletes the objects which have expired, either at the time they were
+given when put or by the expiration rules, as the server does periodically.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if storeOpts.server != "" {
+			return errors.New("reap cannot be used with --server")
+		}
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		n, err := s.Reap()
+		if err != nil {
+			return err
+		}
+		if !storeOpts.quiet {
+			fmt.Printf("reaped %d objects\n", n)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(reapCmd)
+
+	addStoreFlags(reapCmd)
+}
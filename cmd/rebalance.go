@@ -0,0 +1,82 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var rebalanceOpts struct {
+	engine string
+	drain  []string
+	rate   float64
+	state  string
+}
+
+// rebalanceCmd represents the rebalance command
+var rebalanceCmd = &cobra.Command{
+	Use:   "rebalance",
+	Short: "move objects onto the shards owning them",
+	Long: `Scans every shard of a sharded engine and moves objects which
+belong to another shard after shards have been added or removed. Shards
+being removed are listed with --drain so their objects are moved off.
+Progress is saved to the state file and an interrupted rebalance resumes
+from it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		e, err := server.BuildEngine(settings, rebalanceOpts.engine)
+		if err != nil {
+			return err
+		}
+		sharded, ok := e.(*ops.ShardedEngine)
+		if !ok {
+			return errors.New("rebalance requires a sharded engine")
+		}
+
+		drained := map[string]ops.Engine{}
+		for _, name := range rebalanceOpts.drain {
+			d, err := server.BuildEngine(settings, name)
+			if err != nil {
+				return errors.Wrapf(err, "could not build drained shard %s", name)
+			}
+			drained[name] = d
+		}
+
+		r := ops.NewRebalancer(sharded, drained)
+		r.Rate = rebalanceOpts.rate
+		r.State = rebalanceOpts.state
+		p, err := r.Run()
+		if err != nil {
+			logrus.WithError(err).Error("rebalance stopped")
+			return err
+		}
+		fmt.Printf("rebalance complete: %d objects scanned, %d moved\n", p.Scanned, p.Moved)
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rebalanceCmd)
+
+	rebalanceCmd.Flags().StringVarP(&rebalanceOpts.engine, "engine", "e", "", "named sharded engine to rebalance (default is the configured engine)")
+	rebalanceCmd.Flags().StringSliceVar(&rebalanceOpts.drain, "drain", nil, "named engines being removed from the ring")
+	rebalanceCmd.Flags().Float64Var(&rebalanceOpts.rate, "rate", 0, "max objects moved per second (0 is unlimited)")
+	rebalanceCmd.Flags().StringVar(&rebalanceOpts.state, "state", ".objstore-rebalance.json", "file recording rebalance progress")
+}
@@ -0,0 +1,53 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore <key> <version>",
+	Short: "make an earlier version of an object the latest",
+	Long: `Stores the given version of the object under key as its latest
+version. The version it replaces is kept, so a restore can itself be undone.
+Restoring the version before a delete marker undeletes an object.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		key := strings.TrimPrefix(args[0], "/")
+		if err = s.Restore(key, args[1]); err != nil {
+			return errors.Wrapf(err, "could not restore %s of %s", args[1], key)
+		}
+		if !storeOpts.quiet {
+			fmt.Printf("restored %s of %s\n", args[1], key)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(restoreCmd)
+
+	addStoreFlags(restoreCmd)
+}
@@ -0,0 +1,70 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// rmCmd represents the rm command
+var rmCmd = &cobra.Command{
+	Use:   "rm <key>...",
+	Short: "remove objects",
+	Long: `Removes the objects under each key. With --recursive every object
+below a key is removed, and a key holding glob characters such as
+"tmp/*.json" removes every matching object.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		for _, pattern := range args {
+			single := !storeOpts.recursive && !strings.ContainsAny(pattern, `*?[\`)
+			// collect the keys first so the listing is not changed under us
+			var keys []string
+			err = matchKeys(s, pattern, storeOpts.recursive, func(key string) error {
+				keys = append(keys, key)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(keys) == 0 && !single {
+				return errors.Errorf("no objects match %s", pattern)
+			}
+			for _, key := range keys {
+				if err = s.Delete(key); err != nil {
+					return errors.Wrapf(err, "could not remove %s", key)
+				}
+				if !storeOpts.quiet {
+					fmt.Printf("removed %s\n", key)
+				}
+			}
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(rmCmd)
+
+	addStoreFlags(rmCmd)
+	rmCmd.Flags().BoolVarP(&storeOpts.recursive, "recursive", "r", false, "remove every object below key")
+}
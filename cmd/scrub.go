@@ -0,0 +1,85 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var scrubOpts struct {
+	engine  string
+	replica string
+	record  bool
+	quiet   bool
+}
+
+// scrubCmd represents the scrub command
+var scrubCmd = &cobra.Command{
+	Use:   "scrub [prefix]",
+	Short: "verify objects against their recorded checksums",
+	Long: `Re-reads every object of an engine, optionally limited to keys
+beginning with prefix, and checks it against the sha256 recorded when it was
+stored with checksums enabled. Corrupt and missing objects are reported, and
+repaired from the named --replica engine when its copy matches the recorded
+checksum. Objects stored without a checksum are reported as unverified, or
+have one recorded with --record.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		quietLogging()
+		e, err := server.BuildEngine(settings, scrubOpts.engine)
+		if err != nil {
+			return err
+		}
+		s := ops.NewScrubber(e)
+		if len(args) > 0 {
+			s.Prefix = args[0]
+		}
+		if scrubOpts.replica != "" {
+			if s.Replica, err = server.BuildEngine(settings, scrubOpts.replica); err != nil {
+				return errors.Wrapf(err, "could not build replica %s", scrubOpts.replica)
+			}
+		}
+		s.Record = scrubOpts.record
+		s.Report = func(result string, key string, err error) {
+			if err != nil {
+				fmt.Printf("%-10s  %s  (%v)\n", result, key, err)
+			} else if !scrubOpts.quiet || (result != ops.ScrubUnverified && result != ops.ScrubRecorded) {
+				fmt.Printf("%-10s  %s\n", result, key)
+			}
+		}
+
+		stats, err := s.Run()
+		if stats != nil {
+			fmt.Fprintf(os.Stderr, "scrub finished: %d objects scanned, %d verified, %d corrupt, %d missing, %d repaired, %d unverified, %d recorded\n",
+				stats.Scanned, stats.Verified, stats.Corrupt, stats.Missing, stats.Repaired, stats.Unverified, stats.Recorded)
+		}
+		return err
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(scrubCmd)
+
+	scrubCmd.Flags().StringVarP(&scrubOpts.engine, "engine", "e", "", "named engine to scrub (default is the configured engine)")
+	scrubCmd.Flags().StringVar(&scrubOpts.replica, "replica", "", "named engine to repair damaged objects from")
+	scrubCmd.Flags().BoolVar(&scrubOpts.record, "record", false, "record checksums for objects which have none")
+	scrubCmd.Flags().BoolVarP(&scrubOpts.quiet, "quiet", "q", false, "only report damaged objects")
+}
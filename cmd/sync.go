@@ -0,0 +1,136 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/mshindle/objstore/client"
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var syncOpts struct {
+	checksum bool
+	delete   bool
+	dryRun   bool
+	parallel int
+	quiet    bool
+}
+
+// syncCmd represents the sync command
+var syncCmd = &cobra.Command{
+	Use:   "sync <src> <dst>",
+	Short: "copy the objects which differ between two locations",
+	Long: `Makes dst hold the same objects as src, copying only the objects
+which are missing or differ. Each side is one of
+
+  engine:<name>[/prefix]   a named engine, or the configured engine
+                           when the name is empty
+  http://host:port/prefix  a prefix on a running objstore
+  <directory>              a local directory
+
+Objects are compared by size and modification time, or by content with
+--checksum. With --delete, objects in dst missing from src are removed.`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		quietLogging()
+		src, err := openEndpoint(args[0])
+		if err != nil {
+			return errors.Wrap(err, "sync source")
+		}
+		dst, err := openEndpoint(args[1])
+		if err != nil {
+			return errors.Wrap(err, "sync destination")
+		}
+
+		s := ops.NewSyncer(src, dst)
+		s.Checksum = syncOpts.checksum
+		s.Delete = syncOpts.delete
+		s.DryRun = syncOpts.dryRun
+		s.Parallel = syncOpts.parallel
+		s.Report = func(action string, key string, err error) {
+			if err != nil {
+				fmt.Printf("failed %s %s: %v\n", action, key, err)
+				return
+			}
+			if !syncOpts.quiet {
+				fmt.Printf("%s %s\n", action, key)
+			}
+		}
+		stats, err := s.Run()
+		if stats != nil {
+			verb := ""
+			if syncOpts.dryRun {
+				verb = " (dry run)"
+			}
+			fmt.Printf("sync complete%s: %d scanned, %d copied (%s), %d unchanged, %d deleted, %d failed\n",
+				verb, stats.Scanned, stats.Copied, humanSize(stats.Bytes), stats.Skipped, stats.Deleted, stats.Failed)
+		}
+		return err
+	},
+}
+
+// openEndpoint returns the engine named by spec, which is a configured
+// engine, a prefix on a running objstore or a local directory
+func openEndpoint(spec string) (ops.Engine, error) {
+	if strings.HasPrefix(spec, "engine:") {
+		name := strings.TrimPrefix(spec, "engine:")
+		prefix := ""
+		if i := strings.Index(name, "/"); i >= 0 {
+			name, prefix = name[:i], dirPrefix(name[i+1:])
+		}
+		e, err := server.BuildEngine(settings, name)
+		if err != nil {
+			return nil, err
+		}
+		return withPrefix(e, prefix), nil
+	}
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		prefix := dirPrefix(strings.TrimPrefix(u.Path, "/"))
+		u.Path, u.RawPath, u.RawQuery = "", "", ""
+		c, err := client.New(u.String())
+		if err != nil {
+			return nil, err
+		}
+		return withPrefix(c, prefix), nil
+	}
+	return ops.NewLocalFile(spec), nil
+}
+
+func withPrefix(e ops.Engine, prefix string) ops.Engine {
+	if prefix == "" {
+		return e
+	}
+	return ops.NewPrefixEngine(e, prefix)
+}
+
+func init() {
+	RootCmd.AddCommand(syncCmd)
+
+	syncCmd.Flags().BoolVar(&syncOpts.checksum, "checksum", false, "compare the content of objects instead of their modification times")
+	syncCmd.Flags().BoolVar(&syncOpts.delete, "delete", false, "remove objects in dst which are not in src")
+	syncCmd.Flags().BoolVarP(&syncOpts.dryRun, "dry-run", "n", false, "only report what would be copied and deleted")
+	syncCmd.Flags().IntVarP(&syncOpts.parallel, "parallel", "p", ops.DefaultParallel, "number of objects copied at once")
+	syncCmd.Flags().BoolVarP(&syncOpts.quiet, "quiet", "q", false, "only report failures and the summary")
+}
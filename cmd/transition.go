@@ -0,0 +1,99 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/mshindle/objstore/server"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var transitionOpts struct {
+	engine    string
+	rate      float64
+	bandwidth int64
+	state     string
+	dryRun    bool
+	quiet     bool
+}
+
+// transitionCmd represents the transition command
+var transitionCmd = &cobra.Command{
+	Use:   "transition",
+	Short: "move aged objects to the tiers their rules call for",
+	Long: `Scans every tier of a transition engine and moves the objects which
+have aged past a rule down to their next tier, as the server does
+periodically. Each copy is verified before the original is removed, and
+copies left behind by an interrupted move are cleaned up. Progress is saved
+to the state file and an interrupted transition resumes from it. The state
+file is locked by a server transitioning the same engine, in which case
+the command refuses to run.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		quietLogging()
+		e, err := server.BuildEngine(settings, transitionOpts.engine)
+		if err != nil {
+			return err
+		}
+		te, ok := e.(*ops.TransitionEngine)
+		if !ok {
+			return errors.New("transition requires a transition engine")
+		}
+
+		t := ops.NewTransitioner(te)
+		t.Rate = transitionOpts.rate
+		t.Bandwidth = transitionOpts.bandwidth
+		if transitionOpts.state != "" {
+			t.State = transitionOpts.state
+		} else if s, ok := settings.Engines[transitionOpts.engine]; ok && s.Transition.State != "" {
+			t.State = s.Transition.State
+		} else if settings.Transition.State != "" {
+			t.State = settings.Transition.State
+		}
+		t.DryRun = transitionOpts.dryRun
+		t.Report = func(key string, from string, to string, err error) {
+			if err != nil {
+				fmt.Printf("failed %s: %v\n", key, err)
+				return
+			}
+			if !transitionOpts.quiet {
+				fmt.Printf("%s: %s -> %s\n", key, from, to)
+			}
+		}
+		p, err := t.Run()
+		if p != nil {
+			verb := "moved"
+			if transitionOpts.dryRun {
+				verb = "to move"
+			}
+			fmt.Printf("transition %s: %d objects scanned, %d %s (%s), %d stale copies removed, %d failed\n",
+				status(err), p.Scanned, p.Moved, verb, humanSize(p.Bytes), p.Removed, p.Failed)
+		}
+		return err
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(transitionCmd)
+
+	transitionCmd.Flags().StringVarP(&transitionOpts.engine, "engine", "e", "", "named transition engine to run (default is the configured engine)")
+	transitionCmd.Flags().Float64Var(&transitionOpts.rate, "rate", 0, "max objects moved per second (0 is unlimited)")
+	transitionCmd.Flags().Int64Var(&transitionOpts.bandwidth, "bandwidth", 0, "max bytes moved per second (0 is unlimited)")
+	transitionCmd.Flags().StringVar(&transitionOpts.state, "state", "", "file recording transition progress (default is the configured state)")
+	transitionCmd.Flags().BoolVarP(&transitionOpts.dryRun, "dry-run", "n", false, "only report the objects which would be moved")
+	transitionCmd.Flags().BoolVarP(&transitionOpts.quiet, "quiet", "q", false, "only report failures and summaries")
+}
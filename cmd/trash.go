@@ -0,0 +1,82 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+var trashOpts struct {
+	purge bool
+}
+
+// trashCmd represents the trash command
+var trashCmd = &cobra.Command{
+	Use:   "trash [prefix]",
+	Short: "list deleted objects held in the trash",
+	Long: `Lists the deleted objects held in the trash whose keys begin with
+prefix, with their id, size and when they expire. A deleted object is put
+back with undelete. With --purge the objects past the retention period are
+removed instead, as the server does periodically.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		if trashOpts.purge {
+			if storeOpts.server != "" {
+				return errors.New("--purge cannot be used with --server")
+			}
+			n, err := s.Purge()
+			if err != nil {
+				return err
+			}
+			if !storeOpts.quiet {
+				fmt.Printf("purged %d objects\n", n)
+			}
+			return nil
+		}
+		prefix := ""
+		if len(args) > 0 {
+			prefix = strings.TrimPrefix(args[0], "/")
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		err = s.ListTrash(prefix, func(e ops.TrashEntry) error {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", e.Key, e.ID, e.Size, e.Expires.Local().Format(time.RFC3339))
+			return nil
+		})
+		if ferr := w.Flush(); err == nil {
+			err = ferr
+		}
+		return err
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(trashCmd)
+
+	addStoreFlags(trashCmd)
+	trashCmd.Flags().BoolVar(&trashOpts.purge, "purge", false, "remove the objects past the retention period")
+}
@@ -0,0 +1,62 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// undeleteCmd represents the undelete command
+var undeleteCmd = &cobra.Command{
+	Use:   "undelete <key> [id]",
+	Short: "put a deleted object back from the trash",
+	Long: `Moves a deleted object from the trash back under its key. Without an
+id the object deleted last under key is put back. An object stored under key
+since it was deleted is never replaced.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		key := strings.TrimPrefix(args[0], "/")
+		id := ""
+		if len(args) > 1 {
+			id = args[1]
+		}
+		err = s.Undelete(key, id)
+		if err == ops.ErrNotFound {
+			return errors.Errorf("%s is not in the trash", key)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "could not undelete %s", key)
+		}
+		if !storeOpts.quiet {
+			fmt.Printf("undeleted %s\n", key)
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(undeleteCmd)
+
+	addStoreFlags(undeleteCmd)
+}
@@ -0,0 +1,76 @@
+// Copyright © 2017 Michael Shindle <mshindle@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mshindle/objstore/ops"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+// versionsCmd represents the versions command
+var versionsCmd = &cobra.Command{
+	Use:   "versions <key>",
+	Short: "list the versions of an object",
+	Long: `Lists the versions kept of the object under key, newest first, with
+their size and when they were stored. The latest version is marked with an
+asterisk. Any version can be fetched with "get --version" or made the latest
+again with restore.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		s, err := openStorage()
+		if err != nil {
+			return err
+		}
+		key := strings.TrimPrefix(args[0], "/")
+		versions, err := s.Versions(key)
+		if err == ops.ErrNotFound {
+			return errors.Errorf("no versions of %s", key)
+		}
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		for _, v := range versions {
+			latest := " "
+			if v.Latest {
+				latest = "*"
+			}
+			modified := "-"
+			if !v.Modified.IsZero() {
+				modified = v.Modified.Local().Format(time.RFC3339)
+			}
+			size := fmt.Sprint(v.Size)
+			if v.DeleteMarker {
+				size = "deleted"
+			}
+			fmt.Fprintf(w, "%s %s\t%s\t%s\n", latest, v.ID, size, modified)
+		}
+		return w.Flush()
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(versionsCmd)
+
+	addStoreFlags(versionsCmd)
+}
@@ -0,0 +1,203 @@
+package ops
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultBlockSize is the size of the blocks staged for an Azure upload
+const DefaultBlockSize = 1024 * 1024 * 8
+
+// AzureEngine defines an Azure Blob Storage backed object storage engine.
+// Objects are uploaded as block blobs staged one block at a time.
+type AzureEngine struct {
+	container *container.Client
+
+	// BlockSize is the size of each staged block
+	BlockSize int
+}
+
+// NewAzureEngine creates an Azure Blob Storage engine for container. With a
+// connection string, such as the development string of the Azurite
+// emulator, the account and key are ignored. Otherwise endpoint defaults to
+// the public blob service of account.
+func NewAzureEngine(connection string, account string, key string, endpoint string, containerName string) (*AzureEngine, error) {
+	checkEnvDefault(&connection, "AZURE_STORAGE_CONNECTION_STRING")
+	checkEnvDefault(&account, "AZURE_STORAGE_ACCOUNT")
+	checkEnvDefault(&key, "AZURE_STORAGE_KEY")
+	checkEnvDefault(&containerName, "AZURE_STORAGE_CONTAINER")
+
+	var (
+		c   *container.Client
+		err error
+	)
+	if connection != "" {
+		c, err = container.NewClientFromConnectionString(connection, containerName, nil)
+	} else {
+		if endpoint == "" {
+			endpoint = fmt.Sprintf("https://%s.blob.core.windows.net/", account)
+		}
+		var cred *container.SharedKeyCredential
+		cred, err = container.NewSharedKeyCredential(account, key)
+		if err == nil {
+			c, err = container.NewClientWithSharedKeyCredential(strings.TrimSuffix(endpoint, "/")+"/"+containerName, cred, nil)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &AzureEngine{container: c, BlockSize: DefaultBlockSize}, nil
+}
+
+// WriteTo streams key from Azure and writes the bytes to w
+func (e *AzureEngine) WriteTo(key string, w io.Writer) error {
+	resp, err := e.container.NewBlobClient(key).DownloadStream(context.Background(), nil)
+	if err != nil {
+		return azureError(err)
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// ReadFrom reads data from r, staging it block by block, and commits the
+// blocks as the blob key
+func (e *AzureEngine) ReadFrom(key string, r io.Reader) error {
+	size := e.BlockSize
+	if size <= 0 {
+		size = DefaultBlockSize
+	}
+	ctx := context.Background()
+	bb := e.container.NewBlockBlobClient(key)
+
+	var (
+		ids         []string
+		contentType = "application/octet-stream"
+		// concurrent uploads of key stage blocks of their own
+		upload = randomSuffix()
+	)
+	buf := make([]byte, size)
+	for {
+		n, err := io.ReadFull(r, buf)
+		// an empty object commits an empty block list
+		if n > 0 {
+			if len(ids) == 0 {
+				contentType = http.DetectContentType(buf[:n])
+			}
+			// block ids must all be the same length
+			id := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s-%08d", upload, len(ids))))
+			body := streaming.NopCloser(bytes.NewReader(buf[:n]))
+			if _, serr := bb.StageBlock(ctx, id, body, nil); serr != nil {
+				logrus.WithFields(logrus.Fields{"azerr": serr, "key": key}).Error("failed to stage block")
+				return serr
+			}
+			ids = append(ids, id)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := bb.CommitBlockList(ctx, ids, &blockblob.CommitBlockListOptions{
+		HTTPHeaders: &blob.HTTPHeaders{BlobContentType: &contentType},
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"azerr": err, "key": key}).Error("failed to commit blocks")
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"key": key, "blocks": len(ids)}).Info("uploaded key")
+	return nil
+}
+
+// Delete removes the blob key
+func (e *AzureEngine) Delete(key string) error {
+	_, err := e.container.NewBlobClient(key).Delete(context.Background(), nil)
+	return azureError(err)
+}
+
+// List calls fn for every blob beginning with prefix
+func (e *AzureEngine) List(prefix string, fn func(key string) error) error {
+	pager := e.container.NewListBlobsFlatPager(&container.ListBlobsFlatOptions{Prefix: &prefix})
+	for pager.More() {
+		page, err := pager.NextPage(context.Background())
+		if err != nil {
+			return err
+		}
+		for _, item := range page.Segment.BlobItems {
+			if err = fn(*item.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Stat describes the blob key from its properties
+func (e *AzureEngine) Stat(key string) (*ObjectInfo, error) {
+	props, err := e.container.NewBlobClient(key).GetProperties(context.Background(), nil)
+	if err != nil {
+		return nil, azureError(err)
+	}
+	info := &ObjectInfo{Key: key, Metadata: map[string]string{}}
+	if props.ContentLength != nil {
+		info.Size = *props.ContentLength
+	}
+	if props.ContentType != nil {
+		info.ContentType = *props.ContentType
+	}
+	if props.LastModified != nil {
+		info.Modified = *props.LastModified
+	}
+	for k, v := range props.Metadata {
+		if v != nil {
+			info.Metadata[k] = *v
+		}
+	}
+	return info, nil
+}
+
+// SetMetadata replaces the user metadata of the blob key
+func (e *AzureEngine) SetMetadata(key string, meta map[string]string) error {
+	m := make(map[string]*string, len(meta))
+	for k, v := range meta {
+		v := v
+		m[k] = &v
+	}
+	_, err := e.container.NewBlobClient(key).SetMetadata(context.Background(), m, nil)
+	return azureError(err)
+}
+
+// Describe sets the content type and user metadata of the blob key. An
+// empty contentType keeps the one detected on upload.
+func (e *AzureEngine) Describe(key string, contentType string, meta map[string]string) error {
+	if contentType != "" {
+		b := e.container.NewBlobClient(key)
+		_, err := b.SetHTTPHeaders(context.Background(), blob.HTTPHeaders{BlobContentType: &contentType}, nil)
+		if err != nil {
+			return azureError(err)
+		}
+	}
+	return e.SetMetadata(key, meta)
+}
+
+func azureError(err error) error {
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,47 @@
+package ops
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// TestAzureEngine runs against the storage account in the connection string
+// OBJSTORE_TEST_AZURE, such as that of the Azurite emulator:
+//
+//	docker run -p 10000:10000 mcr.microsoft.com/azure-storage/azurite azurite-blob --blobHost 0.0.0.0
+//	OBJSTORE_TEST_AZURE="DefaultEndpointsProtocol=http;AccountName=devstoreaccount1;AccountKey=Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw==;BlobEndpoint=http://127.0.0.1:10000/devstoreaccount1;" go test ./ops
+func TestAzureEngine(t *testing.T) {
+	connection := os.Getenv("OBJSTORE_TEST_AZURE")
+	if connection == "" {
+		t.Skip("OBJSTORE_TEST_AZURE is not set")
+	}
+	e, err := NewAzureEngine(connection, "", "", "", "objstore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = e.container.Create(context.Background(), nil)
+	if err != nil && !bloberror.HasCode(err, bloberror.ContainerAlreadyExists) {
+		t.Fatal(err)
+	}
+	e.BlockSize = 1024 * 1024
+	testEngine(t, e)
+
+	if err = e.ReadFrom("described", strings.NewReader("{}")); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Describe("described", "application/json", map[string]string{"team": "ops"}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := e.Stat("described")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "application/json" || info.Metadata["team"] != "ops" {
+		t.Errorf("described as %q %v", info.ContentType, info.Metadata)
+	}
+	e.Delete("described")
+}
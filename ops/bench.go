@@ -0,0 +1,322 @@
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Benchmark operations
+const (
+	BenchGet    = "get"
+	BenchPut    = "put"
+	BenchDelete = "delete"
+)
+
+// SizeClass is a range of object sizes chosen with a relative weight
+type SizeClass struct {
+	Min    int64
+	Max    int64
+	Weight int
+}
+
+// Benchmark drives an engine with a mix of gets, puts and deletes from
+// several workers and measures the latency of every operation.
+type Benchmark struct {
+	engine Engine
+
+	// Concurrency is the number of workers
+	Concurrency int
+	// Duration is how long operations are timed for
+	Duration time.Duration
+	// Mix weighs how often each operation is chosen
+	Mix map[string]int
+	// Sizes are the sizes of the objects put
+	Sizes []SizeClass
+	// Preload is the number of objects put before timing starts
+	Preload int
+	// Prefix starts every key the benchmark writes
+	Prefix string
+	// Keep leaves the objects written in place when the benchmark ends
+	Keep bool
+	// BufferGrowth is the growth rate of the buffers gets are read into.
+	// The WriteBuffer default is used if zero.
+	BufferGrowth float64
+}
+
+// BenchResult summarises the operations of one kind
+type BenchResult struct {
+	Op          string        `json:"op"`
+	Count       int           `json:"count"`
+	Errors      int           `json:"errors"`
+	Bytes       int64         `json:"bytes"`
+	OpsPerSec   float64       `json:"ops_per_sec"`
+	BytesPerSec float64       `json:"bytes_per_sec"`
+	P50         time.Duration `json:"p50"`
+	P90         time.Duration `json:"p90"`
+	P99         time.Duration `json:"p99"`
+	Max         time.Duration `json:"max"`
+}
+
+// BenchReport is the outcome of a benchmark
+type BenchReport struct {
+	Elapsed time.Duration  `json:"elapsed"`
+	Results []*BenchResult `json:"results"`
+}
+
+// NewBenchmark creates a benchmark of e with an even mix of operations on
+// 1MiB objects
+func NewBenchmark(e Engine) *Benchmark {
+	return &Benchmark{
+		engine:      e,
+		Concurrency: 4,
+		Duration:    30 * time.Second,
+		Mix:         map[string]int{BenchGet: 1, BenchPut: 1, BenchDelete: 1},
+		Sizes:       []SizeClass{{Min: 1 << 20, Max: 1 << 20, Weight: 1}},
+		Preload:     16,
+		Prefix:      "objstore-bench/",
+	}
+}
+
+// benchRun holds the state shared by the workers of a benchmark
+type benchRun struct {
+	b    *Benchmark
+	data []byte
+
+	m       sync.Mutex
+	keys    []string
+	next    int
+	samples map[string][]time.Duration
+	errors  map[string]int
+	bytes   map[string]int64
+}
+
+// Run preloads objects, runs the workload for Duration and reports the
+// results. Unless Keep is set the objects written are removed afterwards.
+func (b *Benchmark) Run() (*BenchReport, error) {
+	var max int64
+	total := 0
+	for _, c := range b.Sizes {
+		if c.Min < 0 || c.Max < c.Min {
+			return nil, fmt.Errorf("invalid object size range %d-%d", c.Min, c.Max)
+		}
+		if c.Max > max {
+			max = c.Max
+		}
+		total += c.Weight
+	}
+	if total <= 0 {
+		return nil, fmt.Errorf("no object sizes to benchmark")
+	}
+	mix := 0
+	for _, w := range b.Mix {
+		mix += w
+	}
+	if mix <= 0 {
+		return nil, fmt.Errorf("no operations to benchmark")
+	}
+
+	// twice the largest object so puts can start at a random offset and
+	// deduplicating engines see distinct content
+	data := make([]byte, 2*max+1)
+	rand.Read(data)
+	r := &benchRun{
+		b:       b,
+		data:    data,
+		samples: map[string][]time.Duration{},
+		errors:  map[string]int{},
+		bytes:   map[string]int64{},
+	}
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for i := 0; i < b.Preload; i++ {
+		if _, err := r.put(rnd); err != nil {
+			r.cleanup()
+			return nil, fmt.Errorf("preload failed: %v", err)
+		}
+	}
+
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	start := time.Now()
+	deadline := start.Add(b.Duration)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for time.Now().Before(deadline) {
+				r.step(rnd)
+			}
+		}(time.Now().UnixNano() + int64(i))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	if !b.Keep {
+		r.cleanup()
+	}
+	return r.report(elapsed), nil
+}
+
+// step runs one randomly chosen operation
+func (r *benchRun) step(rnd *rand.Rand) {
+	op := r.pickOp(rnd)
+	var (
+		n   int64
+		err error
+	)
+	begin := time.Now()
+	switch op {
+	case BenchPut:
+		n, err = r.put(rnd)
+	case BenchGet:
+		key, ok := r.pickKey(rnd, false)
+		if !ok {
+			return
+		}
+		wb := NewWriteBuffer(make([]byte, 0, bytes.MinRead))
+		if r.b.BufferGrowth > 0 {
+			wb.GrowthCoeff = r.b.BufferGrowth
+		}
+		err = r.b.engine.WriteTo(key, wb)
+		n = int64(wb.Size())
+	case BenchDelete:
+		key, ok := r.pickKey(rnd, true)
+		if !ok {
+			return
+		}
+		err = r.b.engine.Delete(key)
+	}
+	r.record(op, time.Since(begin), n, err)
+}
+
+// put writes an object of a random size under a new key
+func (r *benchRun) put(rnd *rand.Rand) (int64, error) {
+	size := r.pickSize(rnd)
+	off := rnd.Int63n(int64(len(r.data)) - size)
+	r.m.Lock()
+	key := fmt.Sprintf("%s%08d", r.b.Prefix, r.next)
+	r.next++
+	r.m.Unlock()
+
+	err := r.b.engine.ReadFrom(key, bytes.NewReader(r.data[off:off+size]))
+	if err != nil {
+		return 0, err
+	}
+	r.m.Lock()
+	r.keys = append(r.keys, key)
+	r.m.Unlock()
+	return size, nil
+}
+
+func (r *benchRun) pickOp(rnd *rand.Rand) string {
+	total := 0
+	for _, w := range r.b.Mix {
+		total += w
+	}
+	n := rnd.Intn(total)
+	// walk the operations in a fixed order so the mix is reproducible
+	for _, op := range []string{BenchGet, BenchPut, BenchDelete} {
+		if n < r.b.Mix[op] {
+			return op
+		}
+		n -= r.b.Mix[op]
+	}
+	return BenchPut
+}
+
+func (r *benchRun) pickSize(rnd *rand.Rand) int64 {
+	total := 0
+	for _, c := range r.b.Sizes {
+		total += c.Weight
+	}
+	n := rnd.Intn(total)
+	for _, c := range r.b.Sizes {
+		if n < c.Weight {
+			return c.Min + rnd.Int63n(c.Max-c.Min+1)
+		}
+		n -= c.Weight
+	}
+	return r.b.Sizes[0].Min
+}
+
+// pickKey chooses a written key, taking it out of the pool if remove
+func (r *benchRun) pickKey(rnd *rand.Rand, remove bool) (string, bool) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if len(r.keys) == 0 {
+		return "", false
+	}
+	i := rnd.Intn(len(r.keys))
+	key := r.keys[i]
+	if remove {
+		r.keys[i] = r.keys[len(r.keys)-1]
+		r.keys = r.keys[:len(r.keys)-1]
+	}
+	return key, true
+}
+
+func (r *benchRun) record(op string, d time.Duration, n int64, err error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	if err != nil {
+		r.errors[op]++
+		return
+	}
+	r.samples[op] = append(r.samples[op], d)
+	r.bytes[op] += n
+}
+
+func (r *benchRun) cleanup() {
+	for _, key := range r.keys {
+		r.b.engine.Delete(key)
+	}
+	r.keys = nil
+}
+
+func (r *benchRun) report(elapsed time.Duration) *BenchReport {
+	report := &BenchReport{Elapsed: elapsed}
+	for _, op := range []string{BenchGet, BenchPut, BenchDelete} {
+		samples := r.samples[op]
+		if len(samples) == 0 && r.errors[op] == 0 {
+			continue
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+		res := &BenchResult{
+			Op:          op,
+			Count:       len(samples),
+			Errors:      r.errors[op],
+			Bytes:       r.bytes[op],
+			OpsPerSec:   float64(len(samples)) / elapsed.Seconds(),
+			BytesPerSec: float64(r.bytes[op]) / elapsed.Seconds(),
+		}
+		if len(samples) > 0 {
+			res.P50 = percentile(samples, 0.50)
+			res.P90 = percentile(samples, 0.90)
+			res.P99 = percentile(samples, 0.99)
+			res.Max = samples[len(samples)-1]
+		}
+		report.Results = append(report.Results, res)
+	}
+	return report
+}
+
+// percentile returns the sample below which the fraction p of the sorted
+// samples fall
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(p*float64(len(sorted)+1)) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
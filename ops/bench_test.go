@@ -0,0 +1,39 @@
+package ops
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBenchmark(t *testing.T) {
+	e := NewLocalFile(tempDir(t))
+	b := NewBenchmark(e)
+	b.Duration = 100 * time.Millisecond
+	b.Sizes = []SizeClass{{Min: 1, Max: 1024, Weight: 1}}
+	report, err := b.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Results) == 0 {
+		t.Fatal("no results reported")
+	}
+	for _, r := range report.Results {
+		if r.Errors > 0 {
+			t.Errorf("%d %s errors", r.Errors, r.Op)
+		}
+	}
+	// the objects written are removed
+	var keys []string
+	e.List("", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 0 {
+		t.Fatalf("left %q behind", keys)
+	}
+
+	b.Sizes = []SizeClass{{Min: 2, Max: 1, Weight: 1}}
+	if _, err := b.Run(); err == nil {
+		t.Fatal("benchmarking an invalid size range: got no error")
+	}
+}
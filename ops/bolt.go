@@ -0,0 +1,221 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DefaultChunkSize is the largest value written to the database in one piece
+const DefaultChunkSize = 1024 * 1024
+
+// errBoltChanged is returned when an object is replaced while being read
+var errBoltChanged = errors.New("object changed while being read")
+
+var (
+	boltObjects = []byte("objects")
+	boltChunks  = []byte("chunks")
+)
+
+// BoltEngine implements Storage in a single bbolt database file. Object
+// bodies are split into chunks so large objects do not need one huge value.
+type BoltEngine struct {
+	db *bolt.DB
+
+	// ChunkSize is the size of the chunks objects are stored in
+	ChunkSize int
+	// TempDir holds uploads until they are committed. The OS default is used if empty.
+	TempDir string
+}
+
+// boltObject describes a stored object
+type boltObject struct {
+	Size     int64     `json:"size"`
+	Chunks   uint32    `json:"chunks"`
+	Modified time.Time `json:"modified"`
+}
+
+// NewBoltEngine opens or creates the bbolt database at path.
+func NewBoltEngine(path string) (*BoltEngine, error) {
+	db, err := bolt.Open(path, modeFile, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(boltObjects); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(boltChunks)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltEngine{db: db, ChunkSize: DefaultChunkSize}, nil
+}
+
+// WriteTo reads the chunks of key and writes the bytes to w. Every chunk is
+// copied out of its own read transaction, so a slow writer does not hold the
+// database open.
+func (e *BoltEngine) WriteTo(key string, w io.Writer) error {
+	var obj *boltObject
+	err := e.db.View(func(tx *bolt.Tx) (err error) {
+		obj, err = boltGet(tx, key)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for i := uint32(0); i < obj.Chunks; i++ {
+		var chunk []byte
+		err = e.db.View(func(tx *bolt.Tx) error {
+			cur, err := boltGet(tx, key)
+			if err == ErrNotFound || (err == nil && !cur.Modified.Equal(obj.Modified)) {
+				return errBoltChanged
+			}
+			if err != nil {
+				return err
+			}
+			chunk = append([]byte(nil), tx.Bucket(boltChunks).Get(chunkKey(key, i))...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadFrom reads data from r and stores it under key. The data is spooled to
+// a temporary file first and committed in a single transaction.
+func (e *BoltEngine) ReadFrom(key string, r io.Reader) error {
+	size := e.ChunkSize
+	if size <= 0 {
+		size = DefaultChunkSize
+	}
+	f, err := ioutil.TempFile(e.TempDir, "objstore-bolt-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = io.Copy(f, r); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	return e.db.Update(func(tx *bolt.Tx) error {
+		if err := boltDelete(tx, key); err != nil && err != ErrNotFound {
+			return err
+		}
+		chunks := tx.Bucket(boltChunks)
+		obj := boltObject{Modified: time.Now().UTC()}
+		for {
+			// bbolt keeps a reference to values until the transaction ends
+			buf := make([]byte, size)
+			n, err := io.ReadFull(f, buf)
+			if n > 0 {
+				if perr := chunks.Put(chunkKey(key, obj.Chunks), buf[:n]); perr != nil {
+					return perr
+				}
+				obj.Chunks++
+				obj.Size += int64(n)
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+		}
+		meta, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(boltObjects).Put([]byte(key), meta)
+	})
+}
+
+// Delete removes key and its chunks
+func (e *BoltEngine) Delete(key string) error {
+	return e.db.Update(func(tx *bolt.Tx) error {
+		return boltDelete(tx, key)
+	})
+}
+
+// List calls fn for every key beginning with prefix
+func (e *BoltEngine) List(prefix string, fn func(key string) error) error {
+	// collect the keys first so fn may use the engine
+	var keys []string
+	err := e.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltObjects).Cursor()
+		p := []byte(prefix)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database
+func (e *BoltEngine) Close() error {
+	return e.db.Close()
+}
+
+func boltGet(tx *bolt.Tx, key string) (*boltObject, error) {
+	meta := tx.Bucket(boltObjects).Get([]byte(key))
+	if meta == nil {
+		return nil, ErrNotFound
+	}
+	obj := &boltObject{}
+	if err := json.Unmarshal(meta, obj); err != nil {
+		return nil, err
+	}
+	return obj, nil
+}
+
+func boltDelete(tx *bolt.Tx, key string) error {
+	obj, err := boltGet(tx, key)
+	if err != nil {
+		return err
+	}
+	chunks := tx.Bucket(boltChunks)
+	for i := uint32(0); i < obj.Chunks; i++ {
+		if err = chunks.Delete(chunkKey(key, i)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(boltObjects).Delete([]byte(key))
+}
+
+// chunkKey builds the key of chunk i of key. The key is length prefixed so
+// the chunks of one key can never collide with those of another.
+func chunkKey(key string, i uint32) []byte {
+	buf := make([]byte, 4+len(key)+4)
+	binary.BigEndian.PutUint32(buf, uint32(len(key)))
+	copy(buf[4:], key)
+	binary.BigEndian.PutUint32(buf[4+len(key):], i)
+	return buf
+}
@@ -0,0 +1,15 @@
+package ops
+
+import "io"
+
+// Copy streams key from src to dst without buffering the whole object
+func Copy(dst Engine, src Engine, key string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.WriteTo(key, pw))
+	}()
+	err := dst.ReadFrom(key, pr)
+	// unblock the reader side should dst stop early
+	pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
@@ -0,0 +1,317 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	dedupRefs   = "refs/"
+	dedupBlobs  = "blobs/"
+	dedupCounts = "counts/"
+	dedupMarks  = "marks/"
+)
+
+// DefaultDedupGrace is how long a blob stays unreferenced before it is
+// collected
+const DefaultDedupGrace = time.Hour
+
+// DedupEngine stores each distinct object body once on an underlying engine,
+// addressed by its SHA-256. Keys are small reference records pointing at a
+// content hash and every blob keeps a count of the references to it. Blobs
+// which are no longer referenced are removed by Collect.
+type DedupEngine struct {
+	engine Engine
+	m      sync.Mutex
+
+	// TempDir holds uploads while they are hashed. The OS default is used if empty.
+	TempDir string
+	// Grace is how long a blob must stay unreferenced before Collect
+	// removes it
+	Grace time.Duration
+}
+
+// DedupStats reports the outcome of a garbage collection
+type DedupStats struct {
+	Scanned int
+	// Marked is the number of blobs found unreferenced for the first time
+	Marked int
+	// Deleted is the number of blobs removed, or which would be on a dry run
+	Deleted int
+}
+
+// NewDedupEngine creates a DedupEngine on top of e.
+func NewDedupEngine(e Engine) *DedupEngine {
+	return &DedupEngine{engine: e, Grace: DefaultDedupGrace}
+}
+
+// WriteTo reads the blob referenced by key and writes the bytes to w
+func (e *DedupEngine) WriteTo(key string, w io.Writer) error {
+	sum, err := e.get(dedupRefs + key)
+	if err != nil {
+		return err
+	}
+	return e.engine.WriteTo(blobKey(sum), w)
+}
+
+// ReadFrom reads data from r and points key at its content, storing the
+// content only if it is not stored already.
+func (e *DedupEngine) ReadFrom(key string, r io.Reader) error {
+	f, err := ioutil.TempFile(e.TempDir, "objstore-dedup-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	// the blob is stored under its hash before any key refers to it, and
+	// stored again should a collection remove it before the reference is
+	// taken
+	blob := blobKey(sum)
+	for {
+		_, err = StatEngine(e.engine, blob)
+		if err == ErrNotFound {
+			if _, err = f.Seek(0, io.SeekStart); err == nil {
+				err = e.engine.ReadFrom(blob, f)
+			}
+			if err != nil {
+				e.discard(sum)
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		stored, err := e.reference(key, sum)
+		if err != nil || stored {
+			return err
+		}
+	}
+}
+
+// reference points key at the blob sum, reporting false if the blob is no
+// longer stored. The reference taken is released again if key cannot be
+// written.
+func (e *DedupEngine) reference(key string, sum string) (bool, error) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if _, err := StatEngine(e.engine, blobKey(sum)); err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	// a collection marked the blob unreferenced; it is referenced now
+	if err := e.engine.Delete(dedupMarks + sum); err != nil && err != ErrNotFound {
+		return false, err
+	}
+	old, err := e.get(dedupRefs + key)
+	if err != nil && err != ErrNotFound {
+		return false, err
+	}
+	if _, err = e.adjustLocked(sum, 1); err != nil {
+		return false, err
+	}
+	if err = e.put(dedupRefs+key, sum); err != nil {
+		e.adjustLocked(sum, -1)
+		return false, err
+	}
+	if old != "" {
+		_, err = e.adjustLocked(old, -1)
+	}
+	return true, err
+}
+
+// discard removes what a failed upload left of the blob sum, unless a key
+// refers to it
+func (e *DedupEngine) discard(sum string) {
+	e.m.Lock()
+	defer e.m.Unlock()
+	if count, err := e.count(sum); err == nil && count == 0 {
+		e.engine.Delete(blobKey(sum))
+	}
+}
+
+// Delete removes key and releases its reference to the blob
+func (e *DedupEngine) Delete(key string) error {
+	e.m.Lock()
+	defer e.m.Unlock()
+	sum, err := e.get(dedupRefs + key)
+	if err != nil {
+		return err
+	}
+	if err = e.engine.Delete(dedupRefs + key); err != nil {
+		return err
+	}
+	_, err = e.adjustLocked(sum, -1)
+	return err
+}
+
+// List calls fn for every key beginning with prefix
+func (e *DedupEngine) List(prefix string, fn func(key string) error) error {
+	lister, ok := e.engine.(Lister)
+	if !ok {
+		return ErrNoList
+	}
+	return lister.List(dedupRefs+prefix, func(key string) error {
+		return fn(strings.TrimPrefix(key, dedupRefs))
+	})
+}
+
+// Collect marks the blobs no longer referenced by any key and removes those
+// marked by an earlier collection at least Grace ago. Collect may run in
+// another process than the one storing objects: a blob referenced again
+// loses its mark, so a blob is only removed once nothing has referred to it
+// for the whole grace period. With dryRun set nothing is marked or removed.
+func (e *DedupEngine) Collect(dryRun bool) (DedupStats, error) {
+	var stats DedupStats
+	lister, ok := e.engine.(Lister)
+	if !ok {
+		return stats, ErrNoList
+	}
+
+	now := time.Now()
+	var unused, stale []string
+	err := lister.List(dedupCounts, func(key string) error {
+		stats.Scanned++
+		sum := strings.TrimPrefix(key, dedupCounts)
+		count, err := e.count(sum)
+		if err != nil {
+			return err
+		}
+		marked, err := e.marked(sum)
+		if err != nil {
+			return err
+		}
+		switch {
+		case count > 0 && !marked.IsZero():
+			stale = append(stale, sum)
+		case count > 0:
+		case marked.IsZero():
+			stats.Marked++
+			if !dryRun {
+				err = e.put(dedupMarks+sum, now.UTC().Format(time.RFC3339Nano))
+			}
+		case now.Sub(marked) >= e.Grace:
+			unused = append(unused, sum)
+		}
+		return err
+	})
+	if err != nil || dryRun {
+		stats.Deleted = len(unused)
+		return stats, err
+	}
+
+	// marks left by a collection which raced a new reference
+	for _, sum := range stale {
+		if err = e.engine.Delete(dedupMarks + sum); err != nil && err != ErrNotFound {
+			return stats, err
+		}
+	}
+	for _, sum := range unused {
+		e.m.Lock()
+		released, err := e.release(sum, now)
+		e.m.Unlock()
+		if err != nil {
+			return stats, err
+		}
+		if released {
+			stats.Deleted++
+		}
+	}
+	return stats, nil
+}
+
+// release deletes an unreferenced blob along with its count and mark,
+// reporting whether it did. The count and mark are read again just before,
+// as the blob may have been referenced since it was scanned. The blob goes
+// first so a failure never leaves it without a count. Expects e.m held.
+func (e *DedupEngine) release(sum string, now time.Time) (bool, error) {
+	count, err := e.count(sum)
+	if err != nil || count > 0 {
+		return false, err
+	}
+	marked, err := e.marked(sum)
+	if err != nil || marked.IsZero() || now.Sub(marked) < e.Grace {
+		return false, err
+	}
+	for _, key := range []string{blobKey(sum), dedupCounts + sum, dedupMarks + sum} {
+		if err = e.engine.Delete(key); err != nil && err != ErrNotFound {
+			return false, err
+		}
+	}
+	logrus.WithField("sha256", sum).Debug("collected blob")
+	return true, nil
+}
+
+// marked returns when a collection first found sum unreferenced, or the
+// zero time if it is not marked
+func (e *DedupEngine) marked(sum string) (time.Time, error) {
+	v, err := e.get(dedupMarks + sum)
+	if err == ErrNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, v)
+}
+
+// adjustLocked changes the reference count of sum by delta and returns the
+// new count. Expects e.m held.
+func (e *DedupEngine) adjustLocked(sum string, delta int) (int, error) {
+	count, err := e.count(sum)
+	if err != nil {
+		return 0, err
+	}
+	count += delta
+	if count < 0 {
+		count = 0
+	}
+	return count, e.put(dedupCounts+sum, strconv.Itoa(count))
+}
+
+// count returns the number of references to sum
+func (e *DedupEngine) count(sum string) (int, error) {
+	v, err := e.get(dedupCounts + sum)
+	if err == ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+func (e *DedupEngine) get(key string) (string, error) {
+	var b bytes.Buffer
+	if err := e.engine.WriteTo(key, &b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func (e *DedupEngine) put(key string, value string) error {
+	return e.engine.ReadFrom(key, strings.NewReader(value))
+}
+
+// blobKey fans blobs out over directories by the first byte of their hash
+func blobKey(sum string) string {
+	return path.Join(dedupBlobs, sum[:2], sum)
+}
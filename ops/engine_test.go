@@ -0,0 +1,298 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEngine runs the behaviour every engine must share against e. Keys are
+// written below a prefix unique to the run, so engines backed by a shared
+// emulator can be tested repeatedly.
+func testEngine(t *testing.T, e Engine) {
+	t.Helper()
+	prefix := fmt.Sprintf("objstore-test-%d/", time.Now().UnixNano())
+	key := prefix + "dir/object"
+
+	if err := e.WriteTo(key, ioutil.Discard); err != ErrNotFound {
+		t.Fatalf("reading a missing key: got %v, want ErrNotFound", err)
+	}
+
+	large := make([]byte, 3*1024*1024+17)
+	if _, err := rand.Read(large); err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range [][]byte{[]byte("hello, world"), {}, large, []byte("short")} {
+		if err := e.ReadFrom(key, bytes.NewReader(body)); err != nil {
+			t.Fatalf("storing %d bytes: %v", len(body), err)
+		}
+		var b bytes.Buffer
+		if err := e.WriteTo(key, &b); err != nil {
+			t.Fatalf("reading %d bytes: %v", len(body), err)
+		}
+		if !bytes.Equal(b.Bytes(), body) {
+			t.Fatalf("read back %d bytes, stored %d", b.Len(), len(body))
+		}
+		if st, ok := e.(Stater); ok {
+			info, err := st.Stat(key)
+			if err != nil {
+				t.Fatalf("stat: %v", err)
+			}
+			if info.Size != int64(len(body)) {
+				t.Fatalf("stat size %d, stored %d", info.Size, len(body))
+			}
+		}
+	}
+
+	if l, ok := e.(Lister); ok {
+		want := []string{prefix + "list/a", prefix + "list/b", prefix + "list/c/d"}
+		for _, k := range append(want, prefix+"listed") {
+			if err := e.ReadFrom(k, strings.NewReader(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var got []string
+		err := l.List(prefix+"list/", func(k string) error {
+			got = append(got, k)
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("listed %q, want %q", got, want)
+		}
+		for _, k := range append(want, prefix+"listed") {
+			if err := e.Delete(k); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	if err := e.Delete(key); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := e.WriteTo(key, ioutil.Discard); err != ErrNotFound {
+		t.Fatalf("reading a deleted key: got %v, want ErrNotFound", err)
+	}
+	if st, ok := e.(Stater); ok {
+		if _, err := st.Stat(key); err != ErrNotFound {
+			t.Fatalf("stat of a deleted key: got %v, want ErrNotFound", err)
+		}
+	}
+	if err := e.Delete(key); err != ErrNotFound {
+		t.Fatalf("deleting a deleted key: got %v, want ErrNotFound", err)
+	}
+}
+
+// tempDir returns a directory removed when the test ends
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "objstore-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestLocalFile(t *testing.T) {
+	testEngine(t, NewLocalFile(tempDir(t)))
+}
+
+func TestBoltEngine(t *testing.T) {
+	e, err := NewBoltEngine(filepath.Join(tempDir(t), "objstore.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	e.ChunkSize = 1000
+	testEngine(t, e)
+}
+
+func TestSQLiteEngine(t *testing.T) {
+	e, err := NewSQLiteEngine(filepath.Join(tempDir(t), "objstore.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	testEngine(t, e)
+}
+
+func TestSQLiteQuery(t *testing.T) {
+	e, err := NewSQLiteEngine(filepath.Join(tempDir(t), "objstore.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	for key, body := range map[string]string{"img/a": "aaaa", "img/b": "bb", "doc/c": "c"} {
+		if err = e.ReadFrom(key, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = e.Describe("img/a", "image/png", map[string]string{"color": "red"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = e.Describe("img/b", "image/jpeg", map[string]string{"color": "blue"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		filter SQLiteFilter
+		want   string
+	}{
+		{SQLiteFilter{}, "doc/c img/a img/b"},
+		{SQLiteFilter{Key: "doc/c"}, "doc/c"},
+		{SQLiteFilter{Prefix: "img/"}, "img/a img/b"},
+		{SQLiteFilter{ContentType: "image/"}, "img/a img/b"},
+		{SQLiteFilter{Metadata: map[string]string{"color": "red"}}, "img/a"},
+		{SQLiteFilter{MinSize: 2, MaxSize: 3}, "img/b"},
+		{SQLiteFilter{ModifiedAfter: time.Now().Add(time.Hour)}, ""},
+		{SQLiteFilter{Prefix: "img/", Limit: 1}, "img/a"},
+	}
+	for _, tt := range tests {
+		var keys []string
+		err = e.Query(tt.filter, func(info *ObjectInfo) error {
+			keys = append(keys, info.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(keys, " "); got != tt.want {
+			t.Errorf("query %+v: got %q, want %q", tt.filter, got, tt.want)
+		}
+	}
+
+	// replacing an object drops what was said about the old one
+	if err = e.ReadFrom("img/a", strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+	info, err := e.Stat("img/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "" || len(info.Metadata) != 0 {
+		t.Errorf("replaced object kept content type %q and metadata %v", info.ContentType, info.Metadata)
+	}
+}
+
+func TestPackFile(t *testing.T) {
+	dir := tempDir(t)
+	p, err := OpenPackFile(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.MaxSize = 64 * 1024
+	testEngine(t, p)
+
+	// a second process would write at offsets of its own
+	if _, err := OpenPackFile(dir); err == nil {
+		t.Fatal("opened a pack directory which is in use")
+	}
+
+	if err = p.ReadFrom("kept", strings.NewReader("kept")); err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the index is rebuilt from the packs on reopening
+	if p, err = OpenPackFile(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	var b bytes.Buffer
+	if err = p.WriteTo("kept", &b); err != nil || b.String() != "kept" {
+		t.Fatalf("after reopening: %q, %v", b.String(), err)
+	}
+}
+
+func TestDedupEngine(t *testing.T) {
+	e := NewDedupEngine(NewLocalFile(tempDir(t)))
+	testEngine(t, e)
+
+	for _, key := range []string{"a", "b"} {
+		if err := e.ReadFrom(key, strings.NewReader("same")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	e.Grace = 0
+	for i := 0; i < 2; i++ {
+		if _, err := e.Collect(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	if err := e.WriteTo("b", &b); err != nil || b.String() != "same" {
+		t.Fatalf("shared blob collected while referenced: %q, %v", b.String(), err)
+	}
+	if err := e.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first collection only marks the blob
+	stats, err := e.Collect(false)
+	if err != nil || stats.Marked != 1 || stats.Deleted != 0 {
+		t.Fatalf("first collection marked %d and deleted %d, want 1 and 0: %v", stats.Marked, stats.Deleted, err)
+	}
+	// a reference taken meanwhile keeps it
+	if err = e.ReadFrom("c", strings.NewReader("same")); err != nil {
+		t.Fatal(err)
+	}
+	if stats, err = e.Collect(false); err != nil || stats.Deleted != 0 {
+		t.Fatalf("collected %d blobs referenced since marked: %v", stats.Deleted, err)
+	}
+	if err = e.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	e.Grace = time.Hour
+	for i := 0; i < 2; i++ {
+		if stats, err = e.Collect(false); err != nil || stats.Deleted != 0 {
+			t.Fatalf("collected %d blobs within the grace period: %v", stats.Deleted, err)
+		}
+	}
+	e.Grace = 0
+	if stats, err = e.Collect(false); err != nil || stats.Deleted != 1 {
+		t.Fatalf("collected %d unreferenced blobs, want 1: %v", stats.Deleted, err)
+	}
+}
+
+func TestErasureFile(t *testing.T) {
+	dir := tempDir(t)
+	var roots []string
+	for i := 0; i < 5; i++ {
+		roots = append(roots, filepath.Join(dir, fmt.Sprint(i)))
+	}
+	e, err := NewErasureFile(roots, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEngine(t, e)
+
+	if err = e.ReadFrom("k", strings.NewReader("erasure coded")); err != nil {
+		t.Fatal(err)
+	}
+	// losing parity shards leaves the object readable and healable
+	for _, root := range roots[:2] {
+		if err = os.RemoveAll(root); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	if err = e.WriteTo("k", &b); err != nil || b.String() != "erasure coded" {
+		t.Fatalf("with two shards lost: %q, %v", b.String(), err)
+	}
+	if healed, err := e.Heal("k"); err != nil || !healed {
+		t.Fatalf("heal: %v, %v", healed, err)
+	}
+}
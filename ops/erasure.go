@@ -0,0 +1,293 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	"github.com/sirupsen/logrus"
+)
+
+// shardMagic starts every erasure coded shard file
+const shardMagic = "OSEC"
+
+// shardHeaderLen is the magic, object size, write stamp and payload checksum
+const shardHeaderLen = 4 + 8 + 8 + sha256.Size
+
+// ErrShardsLost is returned when too many shards of an object are missing or
+// corrupt to reconstruct it
+var ErrShardsLost = errors.New("too many shards lost to reconstruct object")
+
+// ErasureFile implements Storage on a set of local directories, typically
+// on separate disks. Each object is split into data shards plus parity
+// shards using Reed-Solomon coding, with one shard stored under each root,
+// and can be read back while up to parity shards are missing or corrupt.
+type ErasureFile struct {
+	disks  []*LocalFile
+	data   int
+	parity int
+	enc    reedsolomon.Encoder
+}
+
+// HealStats reports the outcome of healing a set of objects
+type HealStats struct {
+	Scanned int
+	Healed  int
+	Lost    int
+}
+
+// shard is a shard read back from disk
+type shard struct {
+	size    int64
+	stamp   int64
+	payload []byte
+}
+
+// NewErasureFile creates an ErasureFile storing data plus parity shards over
+// roots. One root is needed for every shard.
+func NewErasureFile(roots []string, data int, parity int) (*ErasureFile, error) {
+	if len(roots) != data+parity {
+		return nil, fmt.Errorf("erasure coding %d+%d shards needs %d roots, got %d", data, parity, data+parity, len(roots))
+	}
+	enc, err := reedsolomon.New(data, parity)
+	if err != nil {
+		return nil, err
+	}
+	e := &ErasureFile{data: data, parity: parity, enc: enc}
+	for _, root := range roots {
+		e.disks = append(e.disks, NewLocalFile(root))
+	}
+	return e, nil
+}
+
+// WriteTo reads the shards of key, reconstructing any which are missing, and
+// writes the object to w
+func (e *ErasureFile) WriteTo(key string, w io.Writer) error {
+	shards, size, _, err := e.read(key)
+	if err != nil {
+		return err
+	}
+	if err = e.enc.ReconstructData(shards); err != nil {
+		return err
+	}
+	return e.enc.Join(w, shards, int(size))
+}
+
+// ReadFrom reads data from r, encodes it and writes a shard to every root.
+// The write succeeds as long as no more than parity shards failed and none
+// of the failed roots still holds an older shard.
+func (e *ErasureFile) ReadFrom(key string, r io.Reader) error {
+	wb := NewWriteBuffer(make([]byte, 0, bytes.MinRead))
+	if _, err := io.Copy(wb, r); err != nil {
+		return err
+	}
+	data := wb.Bytes()
+	if len(data) == 0 {
+		// the encoder cannot split an empty object, the recorded size
+		// keeps the padding out of reads
+		data = []byte{0}
+	}
+	shards, err := e.enc.Split(data)
+	if err != nil {
+		return err
+	}
+	if err = e.enc.Encode(shards); err != nil {
+		return err
+	}
+	return e.write(key, int64(wb.Size()), time.Now().UnixNano(), shards, nil)
+}
+
+// Delete removes every shard of key
+func (e *ErasureFile) Delete(key string) error {
+	found := false
+	var lastErr error
+	for _, d := range e.disks {
+		err := d.Delete(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		found = true
+	}
+	if lastErr != nil {
+		return lastErr
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List calls fn for every key with a shard on any root
+func (e *ErasureFile) List(prefix string, fn func(key string) error) error {
+	listers := make([]Lister, len(e.disks))
+	for i, d := range e.disks {
+		listers[i] = d
+	}
+	return mergeList(prefix, fn, listers...)
+}
+
+// Heal rebuilds any missing or corrupt shards of key. It reports whether
+// any shards had to be rewritten.
+func (e *ErasureFile) Heal(key string) (bool, error) {
+	shards, size, stamp, err := e.read(key)
+	if err != nil {
+		return false, err
+	}
+	var missing []bool
+	healed := false
+	for _, s := range shards {
+		missing = append(missing, s == nil)
+		healed = healed || s == nil
+	}
+	if !healed {
+		return false, nil
+	}
+	if err = e.enc.Reconstruct(shards); err != nil {
+		return false, err
+	}
+	return true, e.write(key, size, stamp, shards, missing)
+}
+
+// HealAll heals every object beginning with prefix
+func (e *ErasureFile) HealAll(prefix string) (HealStats, error) {
+	var stats HealStats
+	err := e.List(prefix, func(key string) error {
+		stats.Scanned++
+		healed, err := e.Heal(key)
+		switch {
+		case err == ErrShardsLost:
+			stats.Lost++
+			logrus.WithField("key", key).Error("object cannot be reconstructed")
+		case err != nil:
+			return err
+		case healed:
+			stats.Healed++
+			logrus.WithField("key", key).Info("healed object")
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// read loads the shards of key along with the object size and write stamp.
+// Shards which are missing, corrupt or left over from an older write of the
+// key are returned as nil.
+func (e *ErasureFile) read(key string) ([][]byte, int64, int64, error) {
+	found := make([]*shard, len(e.disks))
+	stamps := map[int64]int{}
+	missing := 0
+	for i, d := range e.disks {
+		var b bytes.Buffer
+		err := d.WriteTo(key, &b)
+		if err == ErrNotFound {
+			missing++
+			continue
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"key": key, "shard": i, "error": err}).Warn("could not read shard")
+			continue
+		}
+		s, err := decodeShard(b.Bytes())
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"key": key, "shard": i, "error": err}).Warn("corrupt shard")
+			continue
+		}
+		found[i] = s
+		stamps[s.stamp]++
+	}
+	if missing == len(e.disks) {
+		return nil, 0, 0, ErrNotFound
+	}
+
+	// the latest write with enough shards to rebuild it wins over stale
+	// shards, falling back to the most common write
+	var stamp int64
+	for st, n := range stamps {
+		best := stamps[stamp]
+		switch {
+		case n >= e.data && (best < e.data || st > stamp):
+			stamp = st
+		case best < e.data && (n > best || (n == best && st > stamp)):
+			stamp = st
+		}
+	}
+
+	shards := make([][]byte, len(e.disks))
+	var size int64
+	ok := 0
+	for i, s := range found {
+		if s == nil || s.stamp != stamp {
+			continue
+		}
+		shards[i] = s.payload
+		size = s.size
+		ok++
+	}
+	if ok < e.data {
+		return nil, 0, 0, ErrShardsLost
+	}
+	return shards, size, stamp, nil
+}
+
+// write stores the shards of key. If only is set, only the shards it flags
+// are written. A shard which cannot be written has its old copy removed, so
+// that it reads as missing and is rebuilt by Heal rather than outvoting the
+// new write; the write fails if that is not possible either.
+func (e *ErasureFile) write(key string, size int64, stamp int64, shards [][]byte, only []bool) error {
+	failed := 0
+	var lastErr error
+	for i, payload := range shards {
+		if only != nil && !only[i] {
+			continue
+		}
+		err := e.disks[i].ReadFrom(key, bytes.NewReader(encodeShard(size, stamp, payload)))
+		if err == nil {
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"key": key, "shard": i, "error": err}).Warn("could not write shard")
+		failed++
+		lastErr = err
+		if derr := e.disks[i].Delete(key); derr != nil && derr != ErrNotFound {
+			return fmt.Errorf("shard %d holds a stale copy: %v", i, err)
+		}
+	}
+	if failed > e.parity {
+		return fmt.Errorf("%d of %d shards failed: %v", failed, len(shards), lastErr)
+	}
+	return nil
+}
+
+func encodeShard(size int64, stamp int64, payload []byte) []byte {
+	buf := make([]byte, shardHeaderLen, shardHeaderLen+len(payload))
+	copy(buf, shardMagic)
+	binary.BigEndian.PutUint64(buf[4:], uint64(size))
+	binary.BigEndian.PutUint64(buf[12:], uint64(stamp))
+	sum := sha256.Sum256(payload)
+	copy(buf[20:], sum[:])
+	return append(buf, payload...)
+}
+
+func decodeShard(buf []byte) (*shard, error) {
+	if len(buf) < shardHeaderLen || string(buf[:4]) != shardMagic {
+		return nil, errors.New("invalid shard header")
+	}
+	s := &shard{
+		size:    int64(binary.BigEndian.Uint64(buf[4:])),
+		stamp:   int64(binary.BigEndian.Uint64(buf[12:])),
+		payload: buf[shardHeaderLen:],
+	}
+	sum := sha256.Sum256(s.payload)
+	if !bytes.Equal(sum[:], buf[20:shardHeaderLen]) {
+		return nil, errors.New("shard checksum mismatch")
+	}
+	return s, nil
+}
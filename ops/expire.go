@@ -0,0 +1,236 @@
+package ops
+
+import (
+	"io"
+	"strings"
+	"time"
+
+	"github.com/mshindle/objstore/api"
+	"github.com/sirupsen/logrus"
+)
+
+// expiresPrefix holds the times objects expire at
+const expiresPrefix = SystemPrefix + "expires/"
+
+// ErrNoExpiry is returned when an object is given an expiry by storage
+// which does not expire objects
+var ErrNoExpiry = api.ErrNoExpiry
+
+// LifecycleRule expires the objects below Prefix once they are older than
+// After
+type LifecycleRule struct {
+	Prefix string
+	After  time.Duration
+}
+
+// ExpiringEngine is implemented by engines expiring objects themselves,
+// such as a remote objstore
+type ExpiringEngine = api.ExpiringEngine
+
+// StoreExpiring is StoreVerified for an object which expires at expires. A
+// zero expires leaves the object to the lifecycle rules.
+func (s *Storage) StoreExpiring(key string, data io.Reader, want *Integrity, expires time.Time) error {
+	if s.locking() {
+		// the key stays locked until its expiry is written, so it is not
+		// reaped by the expiry of the object replaced, nor deleted by a
+		// delete trashing the object replaced
+		defer s.locks.lock(key)()
+	}
+	if !s.expiring() {
+		if expires.IsZero() {
+			return s.store(key, data, want)
+		}
+		if ee, ok := s.engine.(ExpiringEngine); ok && want == nil {
+			return ee.ReadFromExpiring(key, data, expires)
+		}
+		return ErrNoExpiry
+	}
+	if err := s.store(key, data, want); err != nil {
+		return err
+	}
+	if expires.IsZero() {
+		if rule, ok := s.rule(key); ok {
+			expires = time.Now().Add(rule.After)
+		}
+	}
+	if expires.IsZero() {
+		// the object replaced may have expired
+		if err := s.engine.Delete(expiresPrefix + key); err != nil && err != ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	err := s.engine.ReadFrom(expiresPrefix+key, strings.NewReader(expires.UTC().Format(time.RFC3339Nano)))
+	if err != nil {
+		// the expiry of the object replaced must not apply to this one
+		s.engine.Delete(expiresPrefix + key)
+	}
+	return err
+}
+
+// Expiry returns when the object under key expires, or the zero time if it
+// does not
+func (s *Storage) Expiry(key string) (time.Time, error) {
+	if !s.expiring() {
+		return time.Time{}, nil
+	}
+	var b strings.Builder
+	err := s.engine.WriteTo(expiresPrefix+key, &b)
+	if err == ErrNotFound {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse(time.RFC3339Nano, b.String())
+}
+
+// expired reports whether the object under key has expired, either at the
+// time it was given or by the lifecycle rules. Objects without a time of
+// their own expire by their modification time where the engine records it.
+func (s *Storage) expired(key string) (bool, error) {
+	if !s.expiring() || strings.HasPrefix(key, SystemPrefix) {
+		return false, nil
+	}
+	now := time.Now()
+	t, err := s.Expiry(key)
+	if err != nil || !t.IsZero() {
+		return !t.IsZero() && t.Before(now), err
+	}
+	rule, ok := s.rule(key)
+	if !ok {
+		return false, nil
+	}
+	if _, ok = s.engine.(Stater); !ok {
+		return false, nil
+	}
+	info, err := StatEngine(s.engine, key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return !info.Modified.IsZero() && info.Modified.Add(rule.After).Before(now), nil
+}
+
+// expiring reports whether objects expire
+func (s *Storage) expiring() bool {
+	return s.expiration || len(s.lifecycle) > 0
+}
+
+// rule returns the lifecycle rule with the longest prefix of key
+func (s *Storage) rule(key string) (LifecycleRule, bool) {
+	var best LifecycleRule
+	found := false
+	for _, r := range s.lifecycle {
+		if strings.HasPrefix(key, r.Prefix) && (!found || len(r.Prefix) > len(best.Prefix)) {
+			best, found = r, true
+		}
+	}
+	return best, found
+}
+
+// Reap deletes the objects which have expired, either at the time they were
+// given or by the lifecycle rules, and returns how many were deleted.
+// Objects stored before a rule was added expire by their modification time
+// where the engine records it.
+func (s *Storage) Reap() (int, error) {
+	if !s.expiring() {
+		return 0, ErrNoExpiry
+	}
+	l, ok := s.engine.(Lister)
+	if !ok {
+		return 0, ErrNoList
+	}
+	now := time.Now()
+	// collect the expired keys first so the listing is not changed under us
+	var expired []string
+	err := l.List(expiresPrefix, func(name string) error {
+		key := strings.TrimPrefix(name, expiresPrefix)
+		t, err := s.Expiry(key)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"key": key, "error": err}).Warn("unreadable expiry")
+			return nil
+		}
+		if t.Before(now) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, r := range s.lifecycle {
+		err = l.List(r.Prefix, func(key string) error {
+			if strings.HasPrefix(key, SystemPrefix) {
+				return nil
+			}
+			if rule, _ := s.rule(key); rule.Prefix != r.Prefix {
+				// a longer prefix rules this key
+				return nil
+			}
+			if t, err := s.Expiry(key); err != nil || !t.IsZero() {
+				// expires at a time of its own
+				return nil
+			}
+			info, err := StatEngine(s.engine, key)
+			if err != nil || info.Modified.IsZero() {
+				return nil
+			}
+			if info.Modified.Add(r.After).Before(now) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	reaped := 0
+	for _, key := range expired {
+		ok, err := s.reap(key)
+		if err != nil {
+			return reaped, err
+		}
+		if ok {
+			reaped++
+		}
+	}
+	return reaped, nil
+}
+
+// reap deletes key along with its sidecars if it has still expired, which
+// it may not have should it be stored again since it was found
+func (s *Storage) reap(key string) (bool, error) {
+	defer s.locks.lock(key)()
+	expired, err := s.expired(key)
+	if err != nil || !expired {
+		return false, err
+	}
+	// expired objects skip the trash
+	if err = s.engine.Delete(key); err != nil && err != ErrNotFound {
+		return false, err
+	}
+	for _, sidecar := range []string{expiresPrefix + key, ChecksumKey(key)} {
+		if err = s.engine.Delete(sidecar); err != nil && err != ErrNotFound {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// ReapLoop calls Reap every interval. It never returns.
+func (s *Storage) ReapLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := s.Reap()
+		if err != nil {
+			logrus.WithError(err).Error("could not reap expired objects")
+			continue
+		}
+		if n > 0 {
+			logrus.WithField("reaped", n).Info("reaped expired objects")
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package ops
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiry(t *testing.T) {
+	engine := NewLocalFile(tempDir(t))
+	s := NewStorage(&Config{Engine: engine, Expiration: true, Checksums: true})
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	for key, expires := range map[string]time.Time{"expired": past, "live": future, "forever": {}} {
+		if err := s.StoreExpiring(key, strings.NewReader(key), nil, expires); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// expired objects are gone before they are reaped
+	if err := s.Retrieve("expired", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading an expired object: got %v, want ErrNotFound", err)
+	}
+	if _, err := s.Stat("expired"); err != ErrNotFound {
+		t.Fatalf("stat of an expired object: got %v, want ErrNotFound", err)
+	}
+	var keys []string
+	s.List("", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if strings.Join(keys, ",") != "forever,live" {
+		t.Fatalf("listed %q", keys)
+	}
+	checkBody(t, s, "live", "live")
+	if expires, err := s.Expiry("live"); err != nil || !expires.Equal(future) {
+		t.Fatalf("live expires at %v, %v, want %v", expires, err, future)
+	}
+	if expires, err := s.Expiry("forever"); err != nil || !expires.IsZero() {
+		t.Fatalf("forever expires at %v, %v", expires, err)
+	}
+
+	if n, err := s.Reap(); err != nil || n != 1 {
+		t.Fatalf("reaped %d, %v, want 1", n, err)
+	}
+	for _, key := range []string{"expired", expiresPrefix + "expired", ChecksumKey("expired")} {
+		if err := engine.WriteTo(key, &bytes.Buffer{}); err != ErrNotFound {
+			t.Fatalf("%s left after reaping: %v", key, err)
+		}
+	}
+
+	// storing again without an expiry keeps the object
+	if err := s.StoreExpiring("live", strings.NewReader("kept"), nil, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if expires, err := s.Expiry("live"); err != nil || !expires.IsZero() {
+		t.Fatalf("stored again without an expiry, live expires at %v, %v", expires, err)
+	}
+	// nor is an object stored again once it expired
+	if err := s.StoreExpiring("expired", strings.NewReader("again"), nil, past); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store("expired", strings.NewReader("again")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.Reap(); err != nil || n != 0 {
+		t.Fatalf("reaped %d, %v, want 0", n, err)
+	}
+	checkBody(t, s, "expired", "again")
+
+	if err := s.Delete("live"); err != nil {
+		t.Fatal(err)
+	}
+	if err := engine.WriteTo(expiresPrefix+"live", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("expiry left after delete: %v", err)
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	dir := tempDir(t)
+	engine := NewLocalFile(dir)
+	s := NewStorage(&Config{Engine: engine, Lifecycle: []LifecycleRule{
+		{Prefix: "logs/", After: time.Hour},
+		{Prefix: "logs/keep/", After: 48 * time.Hour},
+	}})
+	// objects stored before the rules expire by their modification time
+	for _, key := range []string{"logs/old", "logs/new", "logs/keep/old", "other"} {
+		if err := engine.ReadFrom(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	for _, key := range []string{"logs/old", "logs/keep/old", "other"} {
+		if err := os.Chtimes(filepath.Join(dir, key), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a time of its own outlasts the rules
+	if err := s.StoreExpiring("logs/given", strings.NewReader("given"), nil, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(filepath.Join(dir, "logs/given"), old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Retrieve("logs/old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading an object past its rule: got %v, want ErrNotFound", err)
+	}
+	if n, err := s.Reap(); err != nil || n != 1 {
+		t.Fatalf("reaped %d, %v, want 1", n, err)
+	}
+	if err := engine.WriteTo("logs/old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("logs/old left after reaping: %v", err)
+	}
+	for _, key := range []string{"logs/new", "logs/keep/old", "other", "logs/given"} {
+		if err := s.Retrieve(key, &bytes.Buffer{}); err != nil {
+			t.Fatalf("reading %s: %v", key, err)
+		}
+	}
+
+	// objects stored under a rule expire with it
+	if err := s.Store("logs/stored", strings.NewReader("stored")); err != nil {
+		t.Fatal(err)
+	}
+	expires, err := s.Expiry("logs/stored")
+	if err != nil || expires.Before(time.Now().Add(59*time.Minute)) || expires.After(time.Now().Add(time.Hour)) {
+		t.Fatalf("logs/stored expires at %v, %v", expires, err)
+	}
+}
+
+func TestNoExpiry(t *testing.T) {
+	s := NewStorage(&Config{Engine: NewLocalFile(tempDir(t))})
+	if err := s.StoreExpiring("key", strings.NewReader("body"), nil, time.Now().Add(time.Hour)); err != ErrNoExpiry {
+		t.Fatalf("expiring on storage which does not: got %v, want ErrNoExpiry", err)
+	}
+	if _, err := s.Reap(); err != ErrNoExpiry {
+		t.Fatalf("reaping storage which does not expire: got %v, want ErrNoExpiry", err)
+	}
+}
@@ -0,0 +1,136 @@
+package ops
+
+import (
+	"context"
+	"io"
+
+	"cloud.google.com/go/storage"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// DefaultGCSChunkSize is the size of each request of a resumable GCS upload
+const DefaultGCSChunkSize = 1024 * 1024 * 16
+
+// GCSEngine defines a Google Cloud Storage backed object storage engine.
+// Uploads use the resumable upload protocol.
+type GCSEngine struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+
+	// ChunkSize is the size of each resumable upload request
+	ChunkSize int
+}
+
+// NewGCSEngine creates a Google Cloud Storage engine for bucket using the
+// service account JSON key at credentials. Setting endpoint overrides the
+// GCS API endpoint, e.g. to point at fake-gcs-server, in which case requests
+// are sent unauthenticated when no credentials are given.
+func NewGCSEngine(credentials string, endpoint string, bucket string) (*GCSEngine, error) {
+	checkEnvDefault(&credentials, "GOOGLE_APPLICATION_CREDENTIALS")
+	checkEnvDefault(&bucket, "GCS_BUCKET")
+
+	var opts []option.ClientOption
+	if credentials != "" {
+		opts = append(opts, option.WithAuthCredentialsFile(option.ServiceAccount, credentials))
+	}
+	if endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+		if credentials == "" {
+			opts = append(opts, option.WithoutAuthentication())
+		}
+	}
+	client, err := storage.NewClient(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	e := &GCSEngine{
+		client:    client,
+		bucket:    client.Bucket(bucket),
+		ChunkSize: DefaultGCSChunkSize,
+	}
+	return e, nil
+}
+
+// WriteTo streams key from GCS and writes the bytes to w
+func (e *GCSEngine) WriteTo(key string, w io.Writer) error {
+	r, err := e.bucket.Object(key).NewReader(context.Background())
+	if err != nil {
+		return gcsError(err)
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// ReadFrom reads data from r and uploads it to key. A failed read aborts
+// the upload so no partial object is left behind.
+func (e *GCSEngine) ReadFrom(key string, r io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := e.bucket.Object(key).NewWriter(ctx)
+	w.ChunkSize = e.ChunkSize
+	if _, err := io.Copy(w, r); err != nil {
+		cancel()
+		w.Close()
+		logrus.WithFields(logrus.Fields{"gcserr": err, "key": key}).Error("failed to upload")
+		return err
+	}
+	if err := w.Close(); err != nil {
+		logrus.WithFields(logrus.Fields{"gcserr": err, "key": key}).Error("failed to upload")
+		return err
+	}
+	logrus.WithFields(logrus.Fields{"key": key, "bytes": w.Attrs().Size}).Info("uploaded key")
+	return nil
+}
+
+// Delete removes key from the bucket
+func (e *GCSEngine) Delete(key string) error {
+	return gcsError(e.bucket.Object(key).Delete(context.Background()))
+}
+
+// List calls fn for every object in the bucket beginning with prefix
+func (e *GCSEngine) List(prefix string, fn func(key string) error) error {
+	q := &storage.Query{Prefix: prefix}
+	if err := q.SetAttrSelection([]string{"Name"}); err != nil {
+		return err
+	}
+	it := e.bucket.Objects(context.Background(), q)
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(attrs.Name); err != nil {
+			return err
+		}
+	}
+}
+
+// Stat describes key from its object attributes
+func (e *GCSEngine) Stat(key string) (*ObjectInfo, error) {
+	attrs, err := e.bucket.Object(key).Attrs(context.Background())
+	if err != nil {
+		return nil, gcsError(err)
+	}
+	info := &ObjectInfo{
+		Key:         key,
+		Size:        attrs.Size,
+		ContentType: attrs.ContentType,
+		Metadata:    attrs.Metadata,
+		Modified:    attrs.Updated,
+	}
+	return info, nil
+}
+
+func gcsError(err error) error {
+	if err == storage.ErrObjectNotExist {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+package ops
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+// TestGCSEngine runs against the GCS API at OBJSTORE_TEST_GCS, such as a
+// fake-gcs-server:
+//
+//	docker run -p 4443:4443 fsouza/fake-gcs-server -scheme http
+//	OBJSTORE_TEST_GCS=http://127.0.0.1:4443/storage/v1/ go test ./ops
+func TestGCSEngine(t *testing.T) {
+	endpoint := os.Getenv("OBJSTORE_TEST_GCS")
+	if endpoint == "" {
+		t.Skip("OBJSTORE_TEST_GCS is not set")
+	}
+	e, err := NewGCSEngine("", endpoint, "objstore-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the bucket is left over from an earlier run if this fails
+	e.bucket.Create(context.Background(), "objstore-test", nil)
+	e.ChunkSize = 256 * 1024
+	testEngine(t, e)
+}
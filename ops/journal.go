@@ -0,0 +1,265 @@
+package ops
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// JournalPut marks a replica that is missing the latest copy of a key
+	JournalPut = "put"
+	// JournalDelete marks a replica that still holds a deleted key
+	JournalDelete = "delete"
+	// JournalDone marks a replica brought up to date by a later write,
+	// superseding the entries before it
+	JournalDone = "done"
+)
+
+// JournalEntry records a single replica operation that still needs to be applied
+type JournalEntry struct {
+	Op      string `json:"op"`
+	Replica int    `json:"replica"`
+	Key     string `json:"key"`
+	// Seq orders the entry against the other writes of its key
+	Seq int64 `json:"seq"`
+}
+
+// Journal is a durable, append only log of pending replica operations
+// kept on the local filesystem. Safe to use concurrently.
+type Journal struct {
+	path string
+	m    sync.Mutex
+
+	loaded bool
+	seq    int64
+	marks  map[string]map[int]journalMark
+}
+
+// journalMark is the latest entry known for a key on a replica
+type journalMark struct {
+	seq  int64
+	done bool
+}
+
+// NewJournal creates a Journal persisted at path.
+func NewJournal(path string) *Journal {
+	return &Journal{path: path}
+}
+
+// Next returns a sequence number ordered after every one returned before,
+// including those of earlier processes
+func (j *Journal) Next() int64 {
+	j.m.Lock()
+	defer j.m.Unlock()
+	j.load()
+	j.seq++
+	if now := time.Now().UnixNano(); now > j.seq {
+		j.seq = now
+	}
+	return j.seq
+}
+
+// Append adds e to the journal and syncs it to disk. An entry without a
+// sequence number is given the next one.
+func (j *Journal) Append(e JournalEntry) error {
+	if e.Seq == 0 {
+		e.Seq = j.Next()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.m.Lock()
+	defer j.m.Unlock()
+	j.load()
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, modeReadWrite)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	j.index(e)
+	return nil
+}
+
+// Pending reports whether any replica operation on key is still pending
+func (j *Journal) Pending(key string) bool {
+	j.m.Lock()
+	defer j.m.Unlock()
+	j.load()
+	for _, m := range j.marks[key] {
+		if !m.done {
+			return true
+		}
+	}
+	return false
+}
+
+// Latest returns the sequence number of the latest entry journaled for key
+// on replica, if there is one
+func (j *Journal) Latest(key string, replica int) (int64, bool) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	j.load()
+	m, ok := j.marks[key][replica]
+	return m.seq, ok
+}
+
+// Resolve records that replica took the write seq of key, superseding any
+// operation pending for it from before
+func (j *Journal) Resolve(key string, replica int, seq int64) error {
+	j.m.Lock()
+	j.load()
+	m, ok := j.marks[key][replica]
+	j.m.Unlock()
+	if !ok || m.done || m.seq > seq {
+		return nil
+	}
+	return j.Append(JournalEntry{Op: JournalDone, Replica: replica, Key: key, Seq: seq})
+}
+
+// Replay calls fn for the latest entry of every key and replica in the
+// journal. Entries for which fn returns an error are appended back to the
+// journal to be retried later.
+func (j *Journal) Replay(fn func(JournalEntry) error) error {
+	replay := j.path + ".replay"
+
+	// move the current journal aside so appends can continue while we
+	// work. A leftover replay file from a previous crash is picked up first.
+	j.m.Lock()
+	j.load()
+	_, err := os.Stat(replay)
+	if os.IsNotExist(err) {
+		err = os.Rename(j.path, replay)
+	}
+	j.m.Unlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	entries, err := readJournal(replay)
+	if err != nil {
+		return err
+	}
+	// only the latest entry of each key and replica still matters
+	type target struct {
+		key     string
+		replica int
+	}
+	latest := map[target]JournalEntry{}
+	var order []target
+	for _, e := range entries {
+		t := target{e.Key, e.Replica}
+		old, ok := latest[t]
+		if !ok {
+			order = append(order, t)
+		}
+		if !ok || e.Seq >= old.Seq {
+			latest[t] = e
+		}
+	}
+	for _, t := range order {
+		e := latest[t]
+		if e.Op == JournalDone {
+			continue
+		}
+		if fn(e) != nil {
+			if err = j.Append(e); err != nil {
+				return err
+			}
+			continue
+		}
+		j.m.Lock()
+		j.index(JournalEntry{Op: JournalDone, Replica: e.Replica, Key: e.Key, Seq: e.Seq})
+		j.m.Unlock()
+	}
+	if err = os.Remove(replay); err != nil {
+		return err
+	}
+
+	// the entries replayed are gone, and with them the need to remember
+	// they were done
+	j.m.Lock()
+	defer j.m.Unlock()
+	for t, e := range latest {
+		if m, ok := j.marks[t.key][t.replica]; ok && m.done && m.seq <= e.Seq {
+			delete(j.marks[t.key], t.replica)
+			if len(j.marks[t.key]) == 0 {
+				delete(j.marks, t.key)
+			}
+		}
+	}
+	return nil
+}
+
+// index records e as the latest entry of its key and replica unless a
+// later one is known. Expects the journal locked.
+func (j *Journal) index(e JournalEntry) {
+	if e.Seq > j.seq {
+		j.seq = e.Seq
+	}
+	if j.marks[e.Key] == nil {
+		j.marks[e.Key] = map[int]journalMark{}
+	}
+	if m, ok := j.marks[e.Key][e.Replica]; !ok || e.Seq >= m.seq {
+		j.marks[e.Key][e.Replica] = journalMark{seq: e.Seq, done: e.Op == JournalDone}
+	}
+}
+
+// load reads the pending operations left by earlier processes. Expects the
+// journal locked.
+func (j *Journal) load() {
+	if j.loaded {
+		return
+	}
+	j.loaded = true
+	j.marks = map[string]map[int]journalMark{}
+	for _, path := range []string{j.path + ".replay", j.path} {
+		entries, _ := readJournal(path)
+		for _, e := range entries {
+			j.index(e)
+		}
+	}
+}
+
+// readJournal reads the entries of the journal file at path
+func readJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var e JournalEntry
+		if err = json.Unmarshal(line, &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
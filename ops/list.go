@@ -0,0 +1,118 @@
+package ops
+
+import (
+	"errors"
+	"strings"
+)
+
+// errStopList ends a listing early once the merge no longer needs it
+var errStopList = errors.New("listing stopped")
+
+// CanList reports whether e is able to list its keys. Engines which wrap
+// others are asked for a listing, which is ended at its first key.
+func CanList(e Engine) bool {
+	l, ok := e.(Lister)
+	if !ok {
+		return false
+	}
+	return l.List("", func(string) error { return errStopList }) != ErrNoList
+}
+
+// mergeList lists every lister concurrently and calls fn once for each
+// distinct key across all of them, in lexical order.
+func mergeList(prefix string, fn func(key string) error, listers ...Lister) error {
+	done := make(chan struct{})
+	chans := make([]chan string, len(listers))
+	errs := make([]error, len(listers))
+	for i, l := range listers {
+		chans[i] = make(chan string, 64)
+		go func(i int, l Lister) {
+			defer close(chans[i])
+			errs[i] = l.List(prefix, func(key string) error {
+				select {
+				case chans[i] <- key:
+					return nil
+				case <-done:
+					return errStopList
+				}
+			})
+		}(i, l)
+	}
+
+	heads := make([]string, len(listers))
+	open := make([]bool, len(listers))
+	for i := range chans {
+		heads[i], open[i] = <-chans[i]
+	}
+
+	var err error
+	for {
+		min, found := "", false
+		for i, ok := range open {
+			if ok && (!found || heads[i] < min) {
+				min, found = heads[i], true
+			}
+		}
+		if !found {
+			break
+		}
+		if err = fn(min); err != nil {
+			break
+		}
+		for i, ok := range open {
+			if ok && heads[i] == min {
+				heads[i], open[i] = <-chans[i]
+			}
+		}
+	}
+
+	// drain the listers so every one of them has returned
+	close(done)
+	for i := range chans {
+		for range chans[i] {
+		}
+	}
+	if err != nil {
+		return err
+	}
+	for _, lerr := range errs {
+		if lerr != nil && lerr != errStopList {
+			return lerr
+		}
+	}
+	return nil
+}
+
+// listerFunc adapts a function to the Lister interface
+type listerFunc func(prefix string, fn func(key string) error) error
+
+func (f listerFunc) List(prefix string, fn func(key string) error) error {
+	return f(prefix, fn)
+}
+
+// listEngines merges the listings of engines, returning ErrNoList if any
+// of them cannot list keys. System keys are left out unless prefix asks
+// for them.
+func listEngines(prefix string, fn func(key string) error, engines ...Engine) error {
+	listers := make([]Lister, 0, len(engines))
+	for _, e := range engines {
+		l, ok := e.(Lister)
+		if !ok {
+			return ErrNoList
+		}
+		listers = append(listers, l)
+	}
+	return mergeList(prefix, func(key string) error {
+		if !listed(prefix, key) {
+			return nil
+		}
+		return fn(key)
+	}, listers...)
+}
+
+// listed reports whether key belongs in a listing of prefix. The keys
+// objstore keeps for itself belong to the objects they describe, so they
+// are only listed when prefix is a system prefix.
+func listed(prefix string, key string) bool {
+	return !strings.HasPrefix(key, SystemPrefix) || strings.HasPrefix(prefix, SystemPrefix)
+}
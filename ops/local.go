@@ -3,10 +3,19 @@ package ops
 import (
 	"os"
 	"io"
+	"io/ioutil"
+	"path"
 	"path/filepath"
+	"sort"
+	"strings"
 )
 
 const modeReadWrite os.FileMode = 0666
+const modeFile os.FileMode = 0644
+const modeDir os.FileMode = 0777
+
+// tempPrefix names in-flight uploads, which are hidden from listings
+const tempPrefix = ".objstore-tmp-"
 
 // LocalFile implements Storage on an OS-based file system
 type LocalFile struct {
@@ -24,6 +33,9 @@ func (fs *LocalFile) WriteTo(key string, w io.Writer) error {
 	filename := fs.join(key)
 	f, err := os.Open(filename)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrNotFound
+		}
 		return err
 	}
 	defer f.Close()
@@ -31,22 +43,113 @@ func (fs *LocalFile) WriteTo(key string, w io.Writer) error {
 	return err
 }
 
-// ReadFrom reads from io.Reader r and writes the data to the local file system
+// ReadFrom reads from io.Reader r and writes the data to the local file system.
+// Data is written to a temporary file first so readers never see a partial object.
 func (fs *LocalFile) ReadFrom(key string, r io.Reader) error {
 	filename := fs.join(key)
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, modeReadWrite)
+	dir := filepath.Dir(filename)
+	err := os.MkdirAll(dir, modeDir)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, tempPrefix)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
 	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), modeFile)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
 	return err
 }
 
-// Delete remove the
+// Delete removes key from the local filesystem
 func (fs *LocalFile) Delete(key string) error {
 	filename := fs.join(key)
-	return os.Remove(filename)
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// Stat describes key from its file
+func (fs *LocalFile) Stat(key string) (*ObjectInfo, error) {
+	info, err := os.Stat(fs.join(key))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, ErrNotFound
+	}
+	return &ObjectInfo{Key: key, Size: info.Size(), Modified: info.ModTime().UTC()}, nil
+}
+
+// List calls fn for every file under root whose key begins with prefix
+func (fs *LocalFile) List(prefix string, fn func(key string) error) error {
+	return fs.walk("", prefix, fn)
+}
+
+// walk visits the directory dir below root. Entries are visited in the
+// lexical order of their keys, which puts "a.txt" before the contents of "a/".
+func (fs *LocalFile) walk(dir string, prefix string, fn func(key string) error) error {
+	f, err := os.Open(fs.join(filepath.FromSlash(dir)))
+	if err != nil {
+		if os.IsNotExist(err) && dir == "" {
+			return nil
+		}
+		return err
+	}
+	infos, err := f.Readdir(-1)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			continue
+		}
+		key := path.Join(dir, info.Name())
+		if info.IsDir() {
+			key += "/"
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/") {
+			// only descend into directories which can hold matching keys
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+			if err = fs.walk(strings.TrimSuffix(key, "/"), prefix, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err = fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (fs *LocalFile) join(elem ...string) string {
@@ -0,0 +1,264 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Migration diff kinds passed to the Diff callback
+const (
+	DiffMissing = "missing"
+	DiffExtra   = "extra"
+	DiffSize    = "size"
+)
+
+// Migrator copies every object of a source engine to a destination engine,
+// verifying each copy by its sha256. Progress is saved to a state file so
+// an interrupted migration resumes where it left off, and objects which
+// failed are retried by the next run.
+type Migrator struct {
+	src Engine
+	dst Engine
+
+	// Rate limits the number of objects copied per second. Zero is unlimited.
+	Rate float64
+	// Bandwidth limits the bytes copied per second. Zero is unlimited.
+	Bandwidth int64
+	// Verify reads every copy back and compares its checksum with the source
+	Verify bool
+	// State is the path of the progress file. No progress is kept if empty.
+	// It is locked while a migration runs.
+	State string
+	// Report is called for every object copied, with the error if it failed
+	Report func(key string, err error)
+}
+
+// MigrateProgress records how far a migration has come
+type MigrateProgress struct {
+	Last     string   `json:"last"`
+	Failed   []string `json:"failed"`
+	Scanned  int      `json:"scanned"`
+	Copied   int      `json:"copied"`
+	Verified int      `json:"verified"`
+	Bytes    int64    `json:"bytes"`
+}
+
+// DiffStats counts the differences found between two engines
+type DiffStats struct {
+	Scanned int
+	Missing int
+	Extra   int
+	Size    int
+}
+
+// NewMigrator creates a Migrator copying from src to dst with verification
+func NewMigrator(src Engine, dst Engine) *Migrator {
+	return &Migrator{src: src, dst: dst, Verify: true}
+}
+
+// Run copies every source object after the last one recorded in the state
+// file, first retrying those which failed before. An error is returned if
+// any object failed; running again retries them.
+func (m *Migrator) Run() (*MigrateProgress, error) {
+	lister, ok := m.src.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("migration source: %v", ErrNoList)
+	}
+	unlock, err := lockState(m.State)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	p := &MigrateProgress{}
+	found, err := loadState(m.State, p)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		logrus.WithFields(logrus.Fields{"last": p.Last, "failed": len(p.Failed)}).Info("resuming migration")
+	}
+
+	var throttle <-chan time.Time
+	if m.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / m.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+	var failed []string
+	migrate := func(key string) {
+		if throttle != nil {
+			<-throttle
+		}
+		n, err := m.migrate(key)
+		if err != nil {
+			failed = append(failed, key)
+			logrus.WithFields(logrus.Fields{"key": key, "error": err}).Warn("failed to migrate key")
+		} else {
+			p.Copied++
+			p.Bytes += n
+			if m.Verify {
+				p.Verified++
+			}
+		}
+		if m.Report != nil {
+			m.Report(key, err)
+		}
+	}
+
+	retry := p.Failed
+	p.Failed = nil
+	for _, key := range retry {
+		migrate(key)
+	}
+
+	err = lister.List("", func(key string) error {
+		if key <= p.Last || !listed("", key) {
+			return nil
+		}
+		p.Scanned++
+		migrate(key)
+		p.Last = key
+		if p.Scanned%checkpointEvery == 0 {
+			p.Failed = failed
+			logrus.WithFields(logrus.Fields{"scanned": p.Scanned, "copied": p.Copied}).Info("migration progress")
+			return saveState(m.State, p)
+		}
+		return nil
+	})
+	p.Failed = failed
+	if err != nil {
+		saveState(m.State, p)
+		return p, err
+	}
+	if len(failed) > 0 {
+		if err = saveState(m.State, p); err != nil {
+			return p, err
+		}
+		return p, fmt.Errorf("%d objects failed to migrate", len(failed))
+	}
+	if m.State != "" {
+		os.Remove(m.State)
+	}
+	return p, nil
+}
+
+// migrate copies key, checking the destination holds what was read from
+// the source
+func (m *Migrator) migrate(key string) (int64, error) {
+	h := sha256.New()
+	cw := &countWriter{}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(m.src.WriteTo(key, io.MultiWriter(pw, h, cw)))
+	}()
+	var r io.Reader = pr
+	if m.Bandwidth > 0 {
+		r = &throttledReader{r: pr, limit: m.Bandwidth, start: time.Now()}
+	}
+	err := m.dst.ReadFrom(key, r)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return 0, err
+	}
+	if !m.Verify {
+		return cw.n, nil
+	}
+	sum, err := hashObject(m.dst, key)
+	if err != nil {
+		return 0, fmt.Errorf("could not verify %s: %v", key, err)
+	}
+	if !bytes.Equal(sum, h.Sum(nil)) {
+		return 0, fmt.Errorf("checksum mismatch for %s", key)
+	}
+	return cw.n, nil
+}
+
+// Diff compares the keys and sizes held by the source and destination,
+// calling fn with DiffMissing for keys only in the source, DiffExtra for
+// keys only in the destination and DiffSize for keys whose sizes differ.
+func (m *Migrator) Diff(fn func(kind string, key string) error) (*DiffStats, error) {
+	src, ok := m.src.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("migration source: %v", ErrNoList)
+	}
+	dst, ok := m.dst.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("migration destination: %v", ErrNoList)
+	}
+
+	stats := &DiffStats{}
+	inSrc := map[string]bool{}
+	err := src.List("", func(key string) error {
+		if listed("", key) {
+			inSrc[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = dst.List("", func(key string) error {
+		if !listed("", key) {
+			return nil
+		}
+		stats.Scanned++
+		if !inSrc[key] {
+			stats.Extra++
+			return fn(DiffExtra, key)
+		}
+		delete(inSrc, key)
+		si, err := StatEngine(m.src, key)
+		if err != nil {
+			return err
+		}
+		di, err := StatEngine(m.dst, key)
+		if err != nil {
+			return err
+		}
+		if si.Size != di.Size {
+			stats.Size++
+			return fn(DiffSize, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	// report the missing keys in order
+	return stats, src.List("", func(key string) error {
+		if !inSrc[key] {
+			return nil
+		}
+		stats.Scanned++
+		stats.Missing++
+		return fn(DiffMissing, key)
+	})
+}
+
+// throttledReader limits the average rate bytes are read at
+type throttledReader struct {
+	r     io.Reader
+	limit int64
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// keep each read to about a tenth of a second of bandwidth
+	if max := int(t.limit / 10); max > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	due := time.Duration(float64(t.n) / float64(t.limit) * float64(time.Second))
+	if wait := due - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+	return n, err
+}
@@ -0,0 +1,66 @@
+package ops
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingEngine is a local engine failing the writes of the keys in fail
+type failingEngine struct {
+	*LocalFile
+	fail map[string]bool
+}
+
+func (e *failingEngine) ReadFrom(key string, r io.Reader) error {
+	if e.fail[key] {
+		io.Copy(ioutil.Discard, r)
+		return errors.New("write failed")
+	}
+	return e.LocalFile.ReadFrom(key, r)
+}
+
+func TestMigrator(t *testing.T) {
+	dir := tempDir(t)
+	src := NewLocalFile(filepath.Join(dir, "src"))
+	for _, key := range []string{"a", "b", "c/d", SystemPrefix + "checksums/a"} {
+		if err := src.ReadFrom(key, strings.NewReader("data "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dst := &failingEngine{LocalFile: NewLocalFile(filepath.Join(dir, "dst")), fail: map[string]bool{"b": true}}
+	m := NewMigrator(src, dst)
+	m.State = filepath.Join(dir, "migrate.json")
+
+	p, err := m.Run()
+	if err == nil || len(p.Failed) != 1 || p.Copied != 2 {
+		t.Fatalf("first run copied %d and failed %v: %v", p.Copied, p.Failed, err)
+	}
+	// the next run retries the failed object
+	dst.fail = nil
+	if p, err = m.Run(); err != nil || p.Copied != 3 || len(p.Failed) != 0 {
+		t.Fatalf("second run copied %d and failed %v: %v", p.Copied, p.Failed, err)
+	}
+	stats, err := m.Diff(func(kind string, key string) error {
+		t.Errorf("%s %s", kind, key)
+		return nil
+	})
+	if err != nil || stats.Scanned != 3 {
+		t.Fatalf("diff scanned %d keys: %v", stats.Scanned, err)
+	}
+	if err = dst.WriteTo(SystemPrefix+"checksums/a", ioutil.Discard); err != ErrNotFound {
+		t.Fatalf("system key copied: %v", err)
+	}
+
+	unlock, err := lockState(m.State)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if _, err = m.Run(); err == nil {
+		t.Fatal("ran while another migration holds the state file")
+	}
+}
@@ -0,0 +1,530 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// DefaultPackSize is the size at which a pack file is sealed
+	DefaultPackSize = 1024 * 1024 * 1024
+	// DefaultPackGarbage is the share of dead bytes which makes a pack eligible for compaction
+	DefaultPackGarbage = 0.5
+
+	packMagic     uint32 = 0x4f535046
+	packHeaderLen        = 4 + 1 + 2 + 8 + 4
+	packTombstone byte   = 1
+	packIndex            = "index"
+	packLock             = "lock"
+	packPattern          = "pack-%08d"
+)
+
+// errTornRecord marks a record cut short by a crash
+var errTornRecord = errors.New("torn pack record")
+
+// PackFile implements Storage by appending objects to large pack files in a
+// directory, which avoids one file per object for huge numbers of small
+// objects. An index maps each key to its location in a pack. Deletes append
+// tombstones and the space held by dead records is reclaimed by compaction.
+// After a crash the records written since the index was last saved are
+// recovered by rescanning the packs. A pack directory is used by one
+// process at a time.
+type PackFile struct {
+	dir    string
+	unlock func()
+	m      sync.RWMutex
+	index  map[string]packEntry
+	packs  map[int]*os.File
+	sizes  map[int]int64
+
+	active int
+	writes int
+
+	// MaxSize is the size at which the active pack is sealed and a new one started
+	MaxSize int64
+	// Garbage is the share of dead bytes which makes a sealed pack eligible for compaction
+	Garbage float64
+	// Sync flushes every write to disk before returning
+	Sync bool
+}
+
+// packEntry locates a live record
+type packEntry struct {
+	Pack   int
+	Offset int64
+	Length int64
+}
+
+// packState is the index as saved to disk. Checkpoints holds the offset
+// of each pack up to which the index is current.
+type packState struct {
+	Entries     map[string]packEntry
+	Checkpoints map[int]int64
+}
+
+// packRecord is a record read back from a pack
+type packRecord struct {
+	flags  byte
+	key    string
+	offset int64
+	size   int64
+	data   []byte
+}
+
+// OpenPackFile opens the pack directory dir, recovering any records which
+// are missing from its index. The directory stays locked until the
+// PackFile is closed, and opening it fails while another process holds it.
+func OpenPackFile(dir string) (p *PackFile, err error) {
+	if err := os.MkdirAll(dir, modeDir); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(filepath.Join(dir, packLock))
+	if err == errLocked {
+		return nil, fmt.Errorf("pack directory %s is in use by another process", dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+	p = &PackFile{
+		dir:     dir,
+		unlock:  unlock,
+		index:   map[string]packEntry{},
+		packs:   map[int]*os.File{},
+		sizes:   map[int]int64{},
+		MaxSize: DefaultPackSize,
+		Garbage: DefaultPackGarbage,
+	}
+
+	state, err := p.loadIndex()
+	if err != nil {
+		return nil, err
+	}
+	ids, err := p.packIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		f, err := os.OpenFile(p.packPath(id), os.O_RDWR, modeFile)
+		if err != nil {
+			return nil, err
+		}
+		p.packs[id] = f
+	}
+	for key, e := range state.Entries {
+		if _, ok := p.packs[e.Pack]; ok {
+			p.index[key] = e
+		}
+	}
+
+	for i, id := range ids {
+		f := p.packs[id]
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		checkpoint := state.Checkpoints[id]
+		if checkpoint > info.Size() {
+			// the pack lost data the index has seen, so trust the pack
+			checkpoint = 0
+		}
+		end, err := p.scan(id, checkpoint, func(r *packRecord) error {
+			if r.flags&packTombstone != 0 {
+				delete(p.index, r.key)
+				return nil
+			}
+			p.index[r.key] = packEntry{Pack: id, Offset: r.offset, Length: r.size}
+			return nil
+		})
+		if err == errTornRecord {
+			if i == len(ids)-1 {
+				logrus.WithFields(logrus.Fields{"pack": id, "offset": end}).Warn("truncating torn pack record")
+				err = f.Truncate(end)
+			} else {
+				logrus.WithFields(logrus.Fields{"pack": id, "offset": end}).Error("corrupt record in sealed pack")
+				err = nil
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.sizes[id] = end
+		p.active = id
+	}
+	if len(ids) == 0 {
+		if err = p.rotate(); err != nil {
+			return nil, err
+		}
+	}
+	return p, p.saveIndex()
+}
+
+// WriteTo reads key from its pack and writes the bytes to w
+func (p *PackFile) WriteTo(key string, w io.Writer) error {
+	p.m.RLock()
+	e, ok := p.index[key]
+	if !ok {
+		p.m.RUnlock()
+		return ErrNotFound
+	}
+	r, err := p.read(e.Pack, e.Offset)
+	p.m.RUnlock()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(r.data)
+	return err
+}
+
+// ReadFrom reads data from r and appends it to the active pack under key
+func (p *PackFile) ReadFrom(key string, r io.Reader) error {
+	wb := NewWriteBuffer(make([]byte, 0, bytes.MinRead))
+	if _, err := io.Copy(wb, r); err != nil {
+		return err
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.append(0, key, wb.Bytes())
+}
+
+// Delete appends a tombstone for key
+func (p *PackFile) Delete(key string) error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if _, ok := p.index[key]; !ok {
+		return ErrNotFound
+	}
+	return p.append(packTombstone, key, nil)
+}
+
+// List calls fn for every key beginning with prefix
+func (p *PackFile) List(prefix string, fn func(key string) error) error {
+	p.m.RLock()
+	var keys []string
+	for key := range p.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	p.m.RUnlock()
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close saves the index and closes the packs
+func (p *PackFile) Close() error {
+	p.m.Lock()
+	defer p.m.Unlock()
+	err := p.saveIndex()
+	for _, f := range p.packs {
+		f.Close()
+	}
+	p.unlock()
+	return err
+}
+
+// Compact rewrites the live records of every sealed pack holding more than
+// the Garbage share of dead bytes into the active pack and removes it.
+func (p *PackFile) Compact() error {
+	p.m.RLock()
+	live := map[int]int64{}
+	for key, e := range p.index {
+		live[e.Pack] += recordSize(key, e.Length)
+	}
+	var candidates []int
+	for id, size := range p.sizes {
+		if id != p.active && size > 0 && float64(size-live[id])/float64(size) >= p.Garbage {
+			candidates = append(candidates, id)
+		}
+	}
+	p.m.RUnlock()
+	sort.Ints(candidates)
+
+	for _, id := range candidates {
+		if err := p.compact(id); err != nil {
+			return err
+		}
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.saveIndex()
+}
+
+// CompactLoop calls Compact every interval. It never returns.
+func (p *PackFile) CompactLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := p.Compact(); err != nil {
+			logrus.WithError(err).Error("could not compact packs")
+		}
+	}
+}
+
+// compact moves the live records of pack id to the active pack
+func (p *PackFile) compact(id int) error {
+	moved := 0
+	_, err := p.scan(id, 0, func(r *packRecord) error {
+		p.m.Lock()
+		defer p.m.Unlock()
+		if r.flags&packTombstone != 0 {
+			// a tombstone still hides older records of a deleted key
+			if _, live := p.index[r.key]; !live && p.hasOlder(id) {
+				return p.append(packTombstone, r.key, nil)
+			}
+			return nil
+		}
+		e, ok := p.index[r.key]
+		if !ok || e.Pack != id || e.Offset != r.offset {
+			return nil
+		}
+		moved++
+		return p.append(0, r.key, r.data)
+	})
+	if err != nil {
+		return err
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+	if err = p.saveIndex(); err != nil {
+		return err
+	}
+	p.packs[id].Close()
+	delete(p.packs, id)
+	delete(p.sizes, id)
+	logrus.WithFields(logrus.Fields{"pack": id, "moved": moved}).Info("compacted pack")
+	return os.Remove(p.packPath(id))
+}
+
+// hasOlder reports whether any pack older than id remains. Expects p.m held.
+func (p *PackFile) hasOlder(id int) bool {
+	for other := range p.packs {
+		if other < id {
+			return true
+		}
+	}
+	return false
+}
+
+// append writes a record to the active pack. Expects p.m held.
+func (p *PackFile) append(flags byte, key string, data []byte) error {
+	if len(key) > 0xffff {
+		return fmt.Errorf("key longer than %d bytes", 0xffff)
+	}
+	if p.sizes[p.active] >= p.MaxSize {
+		if err := p.rotate(); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, packHeaderLen, recordSize(key, int64(len(data))))
+	binary.BigEndian.PutUint32(buf[0:], packMagic)
+	buf[4] = flags
+	binary.BigEndian.PutUint16(buf[5:], uint16(len(key)))
+	binary.BigEndian.PutUint64(buf[7:], uint64(len(data)))
+	buf = append(append(buf, key...), data...)
+	binary.BigEndian.PutUint32(buf[15:], crc32.ChecksumIEEE(buf[packHeaderLen:]))
+
+	offset := p.sizes[p.active]
+	f := p.packs[p.active]
+	if _, err := f.WriteAt(buf, offset); err != nil {
+		return err
+	}
+	if p.Sync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	p.sizes[p.active] += int64(len(buf))
+
+	if flags&packTombstone != 0 {
+		delete(p.index, key)
+	} else {
+		p.index[key] = packEntry{Pack: p.active, Offset: offset, Length: int64(len(data))}
+	}
+
+	// save the index every so often to keep recovery scans short
+	p.writes++
+	if p.writes%1000 == 0 {
+		return p.saveIndex()
+	}
+	return nil
+}
+
+// rotate seals the active pack and starts a new one. Expects p.m held.
+func (p *PackFile) rotate() error {
+	id := p.active + 1
+	f, err := os.OpenFile(p.packPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, modeFile)
+	if err != nil {
+		return err
+	}
+	p.packs[id] = f
+	p.sizes[id] = 0
+	p.active = id
+	return nil
+}
+
+// read loads the record at offset in pack id. Expects p.m held.
+func (p *PackFile) read(id int, offset int64) (*packRecord, error) {
+	f, ok := p.packs[id]
+	if !ok {
+		return nil, fmt.Errorf("pack %d is missing", id)
+	}
+	header := make([]byte, packHeaderLen)
+	if _, err := f.ReadAt(header, offset); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(header) != packMagic {
+		return nil, errTornRecord
+	}
+	keyLen := int64(binary.BigEndian.Uint16(header[5:]))
+	dataLen := int64(binary.BigEndian.Uint64(header[7:]))
+	body := make([]byte, keyLen+dataLen)
+	if _, err := f.ReadAt(body, offset+packHeaderLen); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, errTornRecord
+		}
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[15:]) {
+		return nil, errTornRecord
+	}
+	r := &packRecord{
+		flags:  header[4],
+		key:    string(body[:keyLen]),
+		offset: offset,
+		size:   dataLen,
+		data:   body[keyLen:],
+	}
+	return r, nil
+}
+
+// scan calls fn for every record of pack id from offset onward and returns
+// the offset of the end of the last good record
+func (p *PackFile) scan(id int, offset int64, fn func(*packRecord) error) (int64, error) {
+	for {
+		p.m.RLock()
+		r, err := p.read(id, offset)
+		if err == errTornRecord && p.atEnd(id, offset) {
+			err = io.EOF
+		}
+		p.m.RUnlock()
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+		if err = fn(r); err != nil {
+			return offset, err
+		}
+		offset += recordSize(r.key, r.size)
+	}
+}
+
+// atEnd reports whether offset is the end of pack id. Expects p.m held.
+func (p *PackFile) atEnd(id int, offset int64) bool {
+	f, ok := p.packs[id]
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Size() == offset
+}
+
+// packIDs returns the ids of the packs in the directory, oldest first
+func (p *PackFile) packIDs() ([]int, error) {
+	names, err := filepath.Glob(filepath.Join(p.dir, "pack-*"))
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, name := range names {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(name), packPattern, &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
+func (p *PackFile) packPath(id int) string {
+	return filepath.Join(p.dir, fmt.Sprintf(packPattern, id))
+}
+
+func (p *PackFile) loadIndex() (*packState, error) {
+	state := &packState{Entries: map[string]packEntry{}, Checkpoints: map[int]int64{}}
+	f, err := os.Open(filepath.Join(p.dir, packIndex))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err = gob.NewDecoder(f).Decode(state); err != nil {
+		logrus.WithError(err).Warn("unreadable pack index, rebuilding from packs")
+		return &packState{Entries: map[string]packEntry{}, Checkpoints: map[int]int64{}}, nil
+	}
+	return state, nil
+}
+
+// saveIndex writes the index to disk. Expects p.m held.
+func (p *PackFile) saveIndex() error {
+	// the checkpoints must never run ahead of the data on disk
+	if f, ok := p.packs[p.active]; ok && !p.Sync {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	state := packState{Entries: p.index, Checkpoints: p.sizes}
+	f, err := ioutil.TempFile(p.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(&state)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(p.dir, packIndex))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func recordSize(key string, length int64) int64 {
+	return packHeaderLen + int64(len(key)) + length
+}
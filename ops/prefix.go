@@ -0,0 +1,62 @@
+package ops
+
+import (
+	"io"
+	"strings"
+)
+
+// PrefixEngine presents the keys below a prefix of another engine as an
+// engine of their own. Keys are given without the prefix.
+type PrefixEngine struct {
+	engine Engine
+	prefix string
+}
+
+// NewPrefixEngine creates a view of the keys of e beginning with prefix
+func NewPrefixEngine(e Engine, prefix string) *PrefixEngine {
+	return &PrefixEngine{engine: e, prefix: prefix}
+}
+
+// WriteTo reads prefix+key and writes the bytes to w
+func (e *PrefixEngine) WriteTo(key string, w io.Writer) error {
+	return e.engine.WriteTo(e.prefix+key, w)
+}
+
+// ReadFrom reads data from r and stores it under prefix+key
+func (e *PrefixEngine) ReadFrom(key string, r io.Reader) error {
+	return e.engine.ReadFrom(e.prefix+key, r)
+}
+
+// ReadFromVerified stores r under prefix+key, passing want on to the engine
+// below
+func (e *PrefixEngine) ReadFromVerified(key string, r io.Reader, want *Integrity) error {
+	return passVerified(e.engine, e.prefix+key, r, want)
+}
+
+// Delete removes prefix+key
+func (e *PrefixEngine) Delete(key string) error {
+	return e.engine.Delete(e.prefix + key)
+}
+
+// List calls fn for every key below the prefix beginning with prefix p,
+// with the engine prefix removed
+func (e *PrefixEngine) List(p string, fn func(key string) error) error {
+	l, ok := e.engine.(Lister)
+	if !ok {
+		return ErrNoList
+	}
+	return l.List(e.prefix+p, func(key string) error {
+		return fn(strings.TrimPrefix(key, e.prefix))
+	})
+}
+
+// Stat describes prefix+key
+func (e *PrefixEngine) Stat(key string) (*ObjectInfo, error) {
+	info, err := StatEngine(e.engine, e.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	copied := *info
+	copied.Key = key
+	return &copied, nil
+}
@@ -0,0 +1,236 @@
+package ops
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkpointEvery is how many scanned keys pass between progress saves
+const checkpointEvery = 100
+
+// Rebalancer moves every key held by a set of source engines onto the shard
+// of a ShardedEngine which owns it. Progress is saved to a state file so an
+// interrupted rebalance resumes where it left off.
+type Rebalancer struct {
+	engine  *ShardedEngine
+	sources map[string]Engine
+
+	// Rate limits the number of objects moved per second. Zero is unlimited.
+	Rate float64
+	// State is the path of the progress file. No progress is kept if empty.
+	// It is locked while a rebalance runs.
+	State string
+}
+
+// RebalanceProgress records how far a rebalance has come
+type RebalanceProgress struct {
+	Done    []string `json:"done"`
+	Shard   string   `json:"shard"`
+	Last    string   `json:"last"`
+	Scanned int      `json:"scanned"`
+	Moved   int      `json:"moved"`
+}
+
+// NewRebalancer creates a Rebalancer for e. Every shard of e is scanned as
+// well as any drained engines, which are shards being removed from the ring.
+func NewRebalancer(e *ShardedEngine, drained map[string]Engine) *Rebalancer {
+	sources := e.Shards()
+	for name, en := range drained {
+		sources[name] = en
+	}
+	return &Rebalancer{engine: e, sources: sources}
+}
+
+// Run scans the sources and moves misplaced keys to their owning shard. A
+// key the owning shard already holds was written there since the ring
+// changed, so only the misplaced copy is removed.
+func (r *Rebalancer) Run() (*RebalanceProgress, error) {
+	unlock, err := lockState(r.State)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	p, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var throttle <-chan time.Time
+	if r.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / r.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	names := make([]string, 0, len(r.sources))
+	for name := range r.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	shards := r.engine.Shards()
+	for _, name := range names {
+		if contains(p.Done, name) {
+			continue
+		}
+		src := r.sources[name]
+		lister, ok := src.(Lister)
+		if !ok {
+			return p, fmt.Errorf("shard %s: %v", name, ErrNoList)
+		}
+		if p.Shard != name {
+			p.Shard, p.Last = name, ""
+		}
+		logrus.WithField("shard", name).Info("rebalancing shard")
+
+		// system keys are placed by their hash like any other, so they are
+		// moved along with the objects
+		err = lister.List("", func(key string) error {
+			if key <= p.Last {
+				return nil
+			}
+			p.Scanned++
+			owner := r.engine.Owner(key)
+			if owner != name {
+				if throttle != nil {
+					<-throttle
+				}
+				_, err := StatEngine(shards[owner], key)
+				if err == ErrNotFound {
+					err = Copy(shards[owner], src, key)
+				}
+				if err != nil {
+					return fmt.Errorf("could not copy %s to %s: %v", key, owner, err)
+				}
+				if err := src.Delete(key); err != nil && err != ErrNotFound {
+					return fmt.Errorf("could not remove %s from %s: %v", key, name, err)
+				}
+				p.Moved++
+				logrus.WithFields(logrus.Fields{"key": key, "from": name, "to": owner}).Debug("moved key")
+			}
+			p.Last = key
+			if p.Scanned%checkpointEvery == 0 {
+				logrus.WithFields(logrus.Fields{"shard": name, "scanned": p.Scanned, "moved": p.Moved}).Info("rebalance progress")
+				return r.save(p)
+			}
+			return nil
+		})
+		if err != nil {
+			r.save(p)
+			return p, err
+		}
+		p.Done = append(p.Done, name)
+		p.Shard, p.Last = "", ""
+		if err = r.save(p); err != nil {
+			return p, err
+		}
+	}
+
+	if r.State != "" {
+		os.Remove(r.State)
+	}
+	return p, nil
+}
+
+func (r *Rebalancer) load() (*RebalanceProgress, error) {
+	p := &RebalanceProgress{}
+	found, err := loadState(r.State, p)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		logrus.WithFields(logrus.Fields{"shard": p.Shard, "last": p.Last}).Info("resuming rebalance")
+	}
+	return p, nil
+}
+
+func (r *Rebalancer) save(p *RebalanceProgress) error {
+	return saveState(r.State, p)
+}
+
+// loadState reads the JSON progress file at path into v, reporting whether
+// there was one. An empty path keeps no progress.
+func loadState(path string, v interface{}) (bool, error) {
+	if path == "" {
+		return false, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err = json.Unmarshal(data, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// lockState locks the progress file at path against other runs and
+// returns the function unlocking it. The lock is taken on a file beside it,
+// as the progress file is replaced whenever it is saved.
+func lockState(path string) (func(), error) {
+	if path == "" {
+		return func() {}, nil
+	}
+	unlock, err := lockFile(path + ".lock")
+	if err == errLocked {
+		return nil, fmt.Errorf("progress file %s is in use by another process", path)
+	}
+	return unlock, err
+}
+
+// errLocked is returned by lockFile when another holds the lock
+var errLocked = errors.New("locked by another process")
+
+// lockFile takes an exclusive lock on the file at path, creating it, and
+// returns the function releasing it. The lock holds across processes and
+// also between separate locks taken in one process.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, modeFile)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, errLocked
+		}
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// saveState atomically writes v as JSON to the progress file at path
+func saveState(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, modeFile); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package ops
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRebalance(t *testing.T) {
+	dir := tempDir(t)
+	shards := map[string]*LocalFile{}
+	for _, name := range []string{"a", "b", "c"} {
+		shards[name] = NewLocalFile(filepath.Join(dir, name))
+	}
+	e := NewShardedEngine(16)
+	e.Add("a", shards["a"])
+	e.Add("b", shards["b"])
+	var keys []string
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		keys = append(keys, key)
+		if err := e.ReadFrom(key, strings.NewReader("old "+key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	e.Add("c", shards["c"])
+	// keys written since the ring changed land on their new owner
+	var written string
+	for _, key := range keys {
+		if e.Owner(key) == "c" {
+			written = key
+			break
+		}
+	}
+	if written == "" {
+		t.Fatal("no key moves to the new shard")
+	}
+	if err := e.ReadFrom(written, strings.NewReader("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRebalancer(e, nil)
+	r.State = filepath.Join(dir, "rebalance.json")
+	p, err := r.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Moved == 0 {
+		t.Fatal("nothing moved")
+	}
+	for _, key := range keys {
+		for name, shard := range shards {
+			var b bytes.Buffer
+			err := shard.WriteTo(key, &b)
+			if name != e.Owner(key) {
+				if err != ErrNotFound {
+					t.Errorf("%s left on shard %s: %v", key, name, err)
+				}
+				continue
+			}
+			want := "old " + key
+			if key == written {
+				want = "new"
+			}
+			if err != nil || b.String() != want {
+				t.Errorf("%s on its owner %s: %q, %v, want %q", key, name, b.String(), err, want)
+			}
+		}
+	}
+}
+
+func TestRebalanceLocked(t *testing.T) {
+	e := NewShardedEngine(0)
+	e.Add("a", NewLocalFile(tempDir(t)))
+	r := NewRebalancer(e, nil)
+	r.State = filepath.Join(tempDir(t), "rebalance.json")
+	unlock, err := lockState(r.State)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+	if _, err = r.Run(); err == nil {
+		t.Fatal("ran while another rebalance holds the state file")
+	}
+}
@@ -0,0 +1,281 @@
+package ops
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisMaxSize is the largest object a Redis engine accepts
+const DefaultRedisMaxSize = 1024 * 1024 * 8
+
+// DefaultRedisChunkSize is the largest value written to Redis in one piece
+const DefaultRedisChunkSize = 1024 * 512
+
+// ErrTooLarge is returned when an object is bigger than an engine allows
+var ErrTooLarge = errors.New("object is too large")
+
+// RedisEngine implements Storage in Redis for small, frequently read
+// objects. Each object is a hash holding its size and, when it fits in one
+// chunk, its body. Larger bodies are split over chunk keys named after a
+// random generation so a reader never mixes the chunks of two writes.
+type RedisEngine struct {
+	client redis.UniversalClient
+	prefix string
+
+	// MaxSize is the largest object accepted
+	MaxSize int64
+	// ChunkSize is the largest body stored inline, and the size of the
+	// chunks larger bodies are split into
+	ChunkSize int
+	// TTL expires objects after they are written. Zero keeps objects forever.
+	TTL time.Duration
+}
+
+// NewRedisEngine creates a Redis engine storing its keys under prefix
+func NewRedisEngine(client redis.UniversalClient, prefix string) *RedisEngine {
+	return &RedisEngine{
+		client:    client,
+		prefix:    prefix,
+		MaxSize:   DefaultRedisMaxSize,
+		ChunkSize: DefaultRedisChunkSize,
+	}
+}
+
+// WriteTo reads key from Redis and writes the bytes to w
+func (e *RedisEngine) WriteTo(key string, w io.Writer) error {
+	ctx := context.Background()
+	var values []interface{}
+	// the chunks read are gone if the object was overwritten meanwhile, so
+	// the read is retried with the chunks of the object replacing it
+	for gen := ""; ; {
+		meta, err := e.client.HGetAll(ctx, e.objectKey(key)).Result()
+		if err != nil {
+			return err
+		}
+		if len(meta) == 0 {
+			return ErrNotFound
+		}
+		chunks, _ := strconv.Atoi(meta["chunks"])
+		if chunks == 0 {
+			_, err = io.WriteString(w, meta["data"])
+			return err
+		}
+		if meta["gen"] == gen {
+			// the chunks of the current object are missing
+			return ErrNotFound
+		}
+		gen = meta["gen"]
+		keys := make([]string, chunks)
+		for i := range keys {
+			keys[i] = e.chunkKey(gen, i)
+		}
+		// fetch every chunk before writing so an overwrite cannot leave w
+		// holding part of the object
+		if values, err = e.client.MGet(ctx, keys...).Result(); err != nil {
+			return err
+		}
+		if chunksComplete(values) {
+			break
+		}
+	}
+	for _, v := range values {
+		if _, err := io.WriteString(w, v.(string)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunksComplete reports whether every chunk fetched exists
+func chunksComplete(values []interface{}) bool {
+	for _, v := range values {
+		if _, ok := v.(string); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// ReadFrom reads data from r and stores it under key using the engine TTL
+func (e *RedisEngine) ReadFrom(key string, r io.Reader) error {
+	return e.ReadFromTTL(key, r, e.TTL)
+}
+
+// ReadFromTTL reads data from r and stores it under key, expiring it after
+// ttl. A zero ttl keeps the object until it is deleted.
+func (e *RedisEngine) ReadFromTTL(key string, r io.Reader, ttl time.Duration) error {
+	buf := &bytes.Buffer{}
+	n, err := io.Copy(buf, io.LimitReader(r, e.MaxSize+1))
+	if err != nil {
+		return err
+	}
+	if n > e.MaxSize {
+		return ErrTooLarge
+	}
+	data := buf.Bytes()
+	size := e.ChunkSize
+	if size <= 0 {
+		size = DefaultRedisChunkSize
+	}
+
+	ctx := context.Background()
+	meta := map[string]interface{}{
+		"size":     n,
+		"modified": time.Now().UnixNano(),
+		"chunks":   0,
+		"data":     data,
+		"gen":      "",
+	}
+	if len(data) > size {
+		gen := randomSuffix()
+		pipe := e.client.Pipeline()
+		chunks := 0
+		for off := 0; off < len(data); off += size {
+			end := off + size
+			if end > len(data) {
+				end = len(data)
+			}
+			pipe.Set(ctx, e.chunkKey(gen, chunks), data[off:end], ttl)
+			chunks++
+		}
+		if _, err = pipe.Exec(ctx); err != nil {
+			return err
+		}
+		meta["chunks"] = chunks
+		meta["data"] = ""
+		meta["gen"] = gen
+	}
+
+	// swap the object in, watching it so the chunks replaced by a
+	// concurrent write are not lost track of
+	objectKey := e.objectKey(key)
+	var old map[string]string
+	for attempt := 0; attempt < 3; attempt++ {
+		err = e.client.Watch(ctx, func(tx *redis.Tx) error {
+			var err error
+			if old, err = tx.HGetAll(ctx, objectKey).Result(); err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Del(ctx, objectKey)
+				pipe.HSet(ctx, objectKey, meta)
+				if ttl > 0 {
+					pipe.Expire(ctx, objectKey, ttl)
+				}
+				return nil
+			})
+			return err
+		}, objectKey)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		e.deleteChunks(ctx, map[string]string{
+			"chunks": strconv.Itoa(meta["chunks"].(int)),
+			"gen":    meta["gen"].(string),
+		})
+		return err
+	}
+	return e.deleteChunks(ctx, old)
+}
+
+// Delete removes key and its chunks
+func (e *RedisEngine) Delete(key string) error {
+	ctx := context.Background()
+	meta, err := e.client.HGetAll(ctx, e.objectKey(key)).Result()
+	if err != nil {
+		return err
+	}
+	removed, err := e.client.Del(ctx, e.objectKey(key)).Result()
+	if err != nil {
+		return err
+	}
+	if removed == 0 {
+		return ErrNotFound
+	}
+	return e.deleteChunks(ctx, meta)
+}
+
+// List calls fn for every key beginning with prefix
+func (e *RedisEngine) List(prefix string, fn func(key string) error) error {
+	ctx := context.Background()
+	base := e.objectKey("")
+	// SCAN returns keys in no particular order, so collect and sort them
+	var keys []string
+	iter := e.client.Scan(ctx, 0, globEscape(base+prefix)+"*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, strings.TrimPrefix(iter.Val(), base))
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stat describes key without reading its body
+func (e *RedisEngine) Stat(key string) (*ObjectInfo, error) {
+	values, err := e.client.HMGet(context.Background(), e.objectKey(key), "size", "modified").Result()
+	if err != nil {
+		return nil, err
+	}
+	size, ok := values[0].(string)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	info := &ObjectInfo{Key: key}
+	info.Size, _ = strconv.ParseInt(size, 10, 64)
+	if modified, ok := values[1].(string); ok {
+		nanos, _ := strconv.ParseInt(modified, 10, 64)
+		info.Modified = time.Unix(0, nanos).UTC()
+	}
+	return info, nil
+}
+
+// deleteChunks removes the chunks of an object described by meta
+func (e *RedisEngine) deleteChunks(ctx context.Context, meta map[string]string) error {
+	chunks, _ := strconv.Atoi(meta["chunks"])
+	if chunks == 0 {
+		return nil
+	}
+	keys := make([]string, chunks)
+	for i := range keys {
+		keys[i] = e.chunkKey(meta["gen"], i)
+	}
+	return e.client.Del(ctx, keys...).Err()
+}
+
+func (e *RedisEngine) objectKey(key string) string {
+	return e.prefix + "o:" + key
+}
+
+func (e *RedisEngine) chunkKey(gen string, i int) string {
+	return e.prefix + "c:" + gen + ":" + strconv.Itoa(i)
+}
+
+// globEscape quotes the characters SCAN MATCH treats as patterns
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
@@ -0,0 +1,60 @@
+package ops
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestRedisEngine(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer client.Close()
+	e := NewRedisEngine(client, "objstore-test:")
+	e.ChunkSize = 64 * 1024
+	testEngine(t, e)
+
+	e.MaxSize = 16
+	if err := e.ReadFrom("too-large", bytes.NewReader(make([]byte, 17))); err != ErrTooLarge {
+		t.Fatalf("storing more than MaxSize: got %v, want ErrTooLarge", err)
+	}
+	if err := e.WriteTo("too-large", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading a refused object: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestRedisEngineOverwritten(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer client.Close()
+	e := NewRedisEngine(client, "objstore-test:")
+	e.ChunkSize = 4
+
+	bodies := []string{"the first object", "the second object"}
+	if err := e.ReadFrom("key", strings.NewReader(bodies[0])); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i := 1; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			e.ReadFrom("key", strings.NewReader(bodies[i%2]))
+		}
+	}()
+	// reads racing overwrites get one object or the other, never none
+	for i := 0; i < 1000; i++ {
+		var b bytes.Buffer
+		if err := e.WriteTo("key", &b); err != nil {
+			t.Fatalf("reading an object being overwritten: %v", err)
+		}
+		if b.String() != bodies[0] && b.String() != bodies[1] {
+			t.Fatalf("reading an object being overwritten: got %q", b.String())
+		}
+	}
+}
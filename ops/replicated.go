@@ -0,0 +1,277 @@
+package ops
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// replicaCooldown is how long a failing replica is passed over for reads
+const replicaCooldown = 30 * time.Second
+
+// ReplicatedEngine writes every object to a set of engines and serves reads
+// from the first healthy replica holding the key. Replica writes which fail
+// are recorded in a Journal and retried later.
+type ReplicatedEngine struct {
+	engines []Engine
+	quorum  int
+	journal *Journal
+	locks   keyLocks
+
+	m    sync.Mutex
+	down []time.Time
+}
+
+// NewReplicatedEngine creates a ReplicatedEngine over engines. A write
+// succeeds once quorum replicas have accepted it; a quorum of 0 requires
+// every replica.
+func NewReplicatedEngine(quorum int, journal *Journal, engines ...Engine) (*ReplicatedEngine, error) {
+	if len(engines) == 0 {
+		return nil, errors.New("replicated engine requires at least one replica")
+	}
+	if quorum <= 0 {
+		quorum = len(engines)
+	}
+	if quorum > len(engines) {
+		return nil, fmt.Errorf("write quorum %d exceeds %d replicas", quorum, len(engines))
+	}
+	e := &ReplicatedEngine{
+		engines: engines,
+		quorum:  quorum,
+		journal: journal,
+		down:    make([]time.Time, len(engines)),
+	}
+	return e, nil
+}
+
+// WriteTo reads key from the first healthy replica and writes the bytes to w.
+// Replicas found to be missing the key are repaired in the background.
+func (e *ReplicatedEngine) WriteTo(key string, w io.Writer) error {
+	var (
+		missing []int
+		lastErr error = ErrNotFound
+	)
+	for _, i := range e.readOrder() {
+		wb := NewWriteBuffer(make([]byte, 0, bytes.MinRead))
+		err := e.engines[i].WriteTo(key, wb)
+		if err == ErrNotFound {
+			missing = append(missing, i)
+			continue
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"replica": i, "key": key, "error": err}).Warn("replica read failed")
+			e.markDown(i)
+			lastErr = err
+			continue
+		}
+		if len(missing) > 0 {
+			go e.repair(key, wb.Bytes(), missing)
+		}
+		_, err = w.Write(wb.Bytes())
+		return err
+	}
+	if len(missing) == len(e.engines) {
+		return ErrNotFound
+	}
+	return lastErr
+}
+
+// ReadFrom reads data from r and stores it under key on every replica
+func (e *ReplicatedEngine) ReadFrom(key string, r io.Reader) error {
+	wb := NewWriteBuffer(make([]byte, 0, bytes.MinRead))
+	if _, err := io.Copy(wb, r); err != nil {
+		return err
+	}
+	data := wb.Bytes()
+	return e.apply(key, JournalPut, func(en Engine) error {
+		return en.ReadFrom(key, bytes.NewReader(data))
+	})
+}
+
+// Delete removes key from every replica. ErrNotFound is returned if no
+// replica held it.
+func (e *ReplicatedEngine) Delete(key string) error {
+	var missing int32
+	err := e.apply(key, JournalDelete, func(en Engine) error {
+		err := en.Delete(key)
+		if err == ErrNotFound {
+			atomic.AddInt32(&missing, 1)
+			return nil
+		}
+		return err
+	})
+	if err == nil && int(atomic.LoadInt32(&missing)) == len(e.engines) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// List calls fn for every key held by any replica beginning with prefix
+func (e *ReplicatedEngine) List(prefix string, fn func(key string) error) error {
+	return listEngines(prefix, fn, e.engines...)
+}
+
+// Retry replays the journal, applying any replica operations which
+// previously failed. Operations superseded by a later write of their key
+// are skipped.
+func (e *ReplicatedEngine) Retry() error {
+	if e.journal == nil {
+		return nil
+	}
+	return e.journal.Replay(func(j JournalEntry) error {
+		if j.Replica < 0 || j.Replica >= len(e.engines) {
+			return nil
+		}
+		defer e.locks.lock(j.Key)()
+		if seq, ok := e.journal.Latest(j.Key, j.Replica); ok && seq > j.Seq {
+			return nil
+		}
+		var err error
+		switch j.Op {
+		case JournalPut:
+			err = e.copyTo(j.Key, j.Replica)
+		case JournalDelete:
+			err = e.engines[j.Replica].Delete(j.Key)
+			if err == ErrNotFound {
+				err = nil
+			}
+		}
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"replica": j.Replica, "key": j.Key, "op": j.Op, "error": err}).Warn("journal retry failed")
+		}
+		return err
+	})
+}
+
+// RetryLoop calls Retry every interval. It never returns.
+func (e *ReplicatedEngine) RetryLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := e.Retry(); err != nil {
+			logrus.WithError(err).Error("could not replay replica journal")
+		}
+	}
+}
+
+// apply runs fn against every replica concurrently, journaling failures
+// and settling the operations left pending on the replicas it succeeded on
+func (e *ReplicatedEngine) apply(key string, op string, fn func(Engine) error) error {
+	defer e.locks.lock(key)()
+	var seq int64
+	if e.journal != nil {
+		seq = e.journal.Next()
+	}
+	errs := make([]error, len(e.engines))
+	var wg sync.WaitGroup
+	for i, en := range e.engines {
+		wg.Add(1)
+		go func(i int, en Engine) {
+			defer wg.Done()
+			errs[i] = fn(en)
+		}(i, en)
+	}
+	wg.Wait()
+
+	ok := 0
+	var lastErr error
+	for i, err := range errs {
+		if err == nil {
+			ok++
+			if e.journal != nil {
+				if err = e.journal.Resolve(key, i, seq); err != nil {
+					logrus.WithFields(logrus.Fields{"replica": i, "key": key, "error": err}).Error("could not journal replica operation")
+				}
+			}
+			continue
+		}
+		lastErr = err
+		logrus.WithFields(logrus.Fields{"replica": i, "key": key, "op": op, "error": err}).Warn("replica write failed")
+		e.markDown(i)
+		e.record(JournalEntry{Op: op, Replica: i, Key: key, Seq: seq})
+	}
+	if ok < e.quorum {
+		return fmt.Errorf("write quorum not met for %s (%d of %d): %v", key, ok, e.quorum, lastErr)
+	}
+	return nil
+}
+
+// repair writes data to the replicas which were missing key. Keys with
+// operations pending in the journal are left to Retry, as the replicas
+// missing them may be the ones a delete reached.
+func (e *ReplicatedEngine) repair(key string, data []byte, replicas []int) {
+	defer e.locks.lock(key)()
+	if e.journal != nil && e.journal.Pending(key) {
+		return
+	}
+	for _, i := range replicas {
+		// a write since the read has the replica hold key again
+		if _, err := StatEngine(e.engines[i], key); err != ErrNotFound {
+			continue
+		}
+		err := e.engines[i].ReadFrom(key, bytes.NewReader(data))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"replica": i, "key": key, "error": err}).Warn("read repair failed")
+			e.record(JournalEntry{Op: JournalPut, Replica: i, Key: key})
+			continue
+		}
+		logrus.WithFields(logrus.Fields{"replica": i, "key": key}).Info("read repaired replica")
+	}
+}
+
+// copyTo copies key from any other replica to the target replica. If no
+// replica holds the key anymore, there is nothing left to copy.
+func (e *ReplicatedEngine) copyTo(key string, target int) error {
+	var lastErr error
+	for i, en := range e.engines {
+		if i == target {
+			continue
+		}
+		wb := NewWriteBuffer(make([]byte, 0, bytes.MinRead))
+		err := en.WriteTo(key, wb)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return e.engines[target].ReadFrom(key, bytes.NewReader(wb.Bytes()))
+	}
+	return lastErr
+}
+
+func (e *ReplicatedEngine) record(j JournalEntry) {
+	if e.journal == nil {
+		return
+	}
+	if err := e.journal.Append(j); err != nil {
+		logrus.WithFields(logrus.Fields{"replica": j.Replica, "key": j.Key, "error": err}).Error("could not journal replica operation")
+	}
+}
+
+// readOrder returns the replica indexes with healthy replicas first
+func (e *ReplicatedEngine) readOrder() []int {
+	e.m.Lock()
+	defer e.m.Unlock()
+	order := make([]int, 0, len(e.engines))
+	var failing []int
+	for i, t := range e.down {
+		if time.Since(t) < replicaCooldown {
+			failing = append(failing, i)
+			continue
+		}
+		order = append(order, i)
+	}
+	return append(order, failing...)
+}
+
+func (e *ReplicatedEngine) markDown(i int) {
+	e.m.Lock()
+	e.down[i] = time.Now()
+	e.m.Unlock()
+}
@@ -0,0 +1,80 @@
+package ops
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReplicatedEngine(t *testing.T) {
+	dir := tempDir(t)
+	e, err := NewReplicatedEngine(0, NewJournal(filepath.Join(dir, "journal")),
+		NewLocalFile(filepath.Join(dir, "a")), NewLocalFile(filepath.Join(dir, "b")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEngine(t, e)
+}
+
+func TestReplicatedRetry(t *testing.T) {
+	dir := tempDir(t)
+	a := NewLocalFile(filepath.Join(dir, "a"))
+	b := &failingEngine{LocalFile: NewLocalFile(filepath.Join(dir, "b")), fail: map[string]bool{"key": true}}
+	if _, err := NewReplicatedEngine(3, nil, a, b); err == nil {
+		t.Fatal("a quorum above the replicas: got no error")
+	}
+	e, err := NewReplicatedEngine(1, NewJournal(filepath.Join(dir, "journal")), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a write reaching the quorum succeeds and the failed replica is
+	// journaled
+	if err := e.ReadFrom("key", strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.WriteTo("key", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("failing replica holds the key: %v", err)
+	}
+	if !e.journal.Pending("key") {
+		t.Fatal("failed replica write not journaled")
+	}
+	// a retry failing again stays journaled
+	if err := e.Retry(); err != nil {
+		t.Fatal(err)
+	}
+	if !e.journal.Pending("key") {
+		t.Fatal("failed retry dropped from the journal")
+	}
+	delete(b.fail, "key")
+	if err := e.Retry(); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := b.WriteTo("key", &got); err != nil || got.String() != "body" {
+		t.Fatalf("replica holds %q, %v after retry", got.String(), err)
+	}
+	if e.journal.Pending("key") {
+		t.Fatal("replica write still journaled after retry")
+	}
+
+	// a write failing on every replica but the quorum's is still readable
+	b.fail["other"] = true
+	if err := e.ReadFrom("other", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	got.Reset()
+	if err := e.WriteTo("other", &got); err != nil || got.String() != "other" {
+		t.Fatalf("reading a partly written key: %q, %v", got.String(), err)
+	}
+
+	// a quorum which cannot be reached fails the write
+	all, err := NewReplicatedEngine(0, NewJournal(filepath.Join(dir, "journal")), a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := all.ReadFrom("other", strings.NewReader("other")); err == nil {
+		t.Fatal("writing short of the quorum: got no error")
+	}
+}
@@ -0,0 +1,135 @@
+package ops
+
+import (
+	"errors"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ErrNoRoute is returned when no engine is routed for a key
+var ErrNoRoute = errors.New("no engine routed for key")
+
+// Router dispatches each key to an engine chosen by the longest matching
+// key prefix. Routes should be added before the router is used.
+type Router struct {
+	routes   []route
+	fallback Engine
+}
+
+type route struct {
+	prefix string
+	engine Engine
+}
+
+// NewRouter creates a Router which sends unmatched keys to fallback. A nil
+// fallback rejects unmatched keys with ErrNoRoute.
+func NewRouter(fallback Engine) *Router {
+	return &Router{fallback: fallback}
+}
+
+// Handle routes keys matching pattern to e. Patterns are key prefixes such
+// as "images/"; a leading slash and a trailing "*" are ignored, so
+// "/images/*" is the same route.
+func (r *Router) Handle(pattern string, e Engine) {
+	prefix := strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "*")
+	r.routes = append(r.routes, route{prefix: prefix, engine: e})
+	sort.SliceStable(r.routes, func(i, j int) bool {
+		return len(r.routes[i].prefix) > len(r.routes[j].prefix)
+	})
+}
+
+// WriteTo reads key from its routed engine and writes the bytes to w
+func (r *Router) WriteTo(key string, w io.Writer) error {
+	e, err := r.engine(key)
+	if err != nil {
+		return err
+	}
+	return e.WriteTo(key, w)
+}
+
+// ReadFrom reads data from r and stores it under key on its routed engine
+func (r *Router) ReadFrom(key string, rd io.Reader) error {
+	e, err := r.engine(key)
+	if err != nil {
+		return err
+	}
+	return e.ReadFrom(key, rd)
+}
+
+// ReadFromVerified stores rd under key on its routed engine, passing want
+// on to it
+func (r *Router) ReadFromVerified(key string, rd io.Reader, want *Integrity) error {
+	e, err := r.engine(key)
+	if err != nil {
+		return err
+	}
+	return passVerified(e, key, rd, want)
+}
+
+// Delete removes key from its routed engine
+func (r *Router) Delete(key string) error {
+	e, err := r.engine(key)
+	if err != nil {
+		return err
+	}
+	return e.Delete(key)
+}
+
+// Stat describes key using its routed engine
+func (r *Router) Stat(key string) (*ObjectInfo, error) {
+	e, err := r.engine(key)
+	if err != nil {
+		return nil, err
+	}
+	return StatEngine(e, key)
+}
+
+// List calls fn for every key beginning with prefix. Each engine only
+// contributes the keys routed to it.
+func (r *Router) List(prefix string, fn func(key string) error) error {
+	var engines []Engine
+	for _, rt := range r.routes {
+		engines = append(engines, rt.engine)
+	}
+	if r.fallback != nil {
+		engines = append(engines, r.fallback)
+	}
+
+	var listers []Lister
+	seen := map[Engine]bool{}
+	for _, en := range engines {
+		if seen[en] {
+			continue
+		}
+		seen[en] = true
+		en := en
+		l, ok := en.(Lister)
+		if !ok {
+			return ErrNoList
+		}
+		listers = append(listers, listerFunc(func(prefix string, fn func(key string) error) error {
+			return l.List(prefix, func(key string) error {
+				if routed, err := r.engine(key); err != nil || routed != en {
+					return nil
+				}
+				return fn(key)
+			})
+		}))
+	}
+	return mergeList(strings.TrimPrefix(prefix, "/"), fn, listers...)
+}
+
+// engine returns the engine routed for key
+func (r *Router) engine(key string) (Engine, error) {
+	key = strings.TrimPrefix(key, "/")
+	for _, rt := range r.routes {
+		if strings.HasPrefix(key, rt.prefix) {
+			return rt.engine, nil
+		}
+	}
+	if r.fallback == nil {
+		return nil, ErrNoRoute
+	}
+	return r.fallback, nil
+}
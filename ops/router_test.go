@@ -0,0 +1,67 @@
+package ops
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	dir := tempDir(t)
+	images, thumbs, rest := NewLocalFile(filepath.Join(dir, "images")), NewLocalFile(filepath.Join(dir, "thumbs")), NewLocalFile(filepath.Join(dir, "rest"))
+	r := NewRouter(rest)
+	r.Handle("/images/*", images)
+	r.Handle("images/thumbs/", thumbs)
+	testEngine(t, r)
+
+	for _, key := range []string{"images/a", "images/thumbs/a", "other"} {
+		if err := r.ReadFrom(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the longest prefix wins
+	for key, e := range map[string]Engine{"images/a": images, "images/thumbs/a": thumbs, "other": rest} {
+		var b bytes.Buffer
+		if err := e.WriteTo(key, &b); err != nil || b.String() != key {
+			t.Fatalf("%s routed elsewhere: %q, %v", key, b.String(), err)
+		}
+	}
+	// a key on an engine it is not routed to is not listed
+	if err := rest.ReadFrom("images/stray", strings.NewReader("stray")); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	r.List("", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if !reflect.DeepEqual(keys, []string{"images/a", "images/thumbs/a", "other"}) {
+		t.Fatalf("listed %q", keys)
+	}
+
+	strict := NewRouter(nil)
+	strict.Handle("images/", images)
+	if err := strict.ReadFrom("other", strings.NewReader("other")); err != ErrNoRoute {
+		t.Fatalf("writing an unrouted key: got %v, want ErrNoRoute", err)
+	}
+}
+
+func TestPrefixEngine(t *testing.T) {
+	base := NewLocalFile(tempDir(t))
+	e := NewPrefixEngine(base, "tenant/")
+	testEngine(t, e)
+
+	if err := e.ReadFrom("key", strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := base.WriteTo("tenant/key", &b); err != nil || b.String() != "body" {
+		t.Fatalf("stored %q, %v below the prefix", b.String(), err)
+	}
+	info, err := e.Stat("key")
+	if err != nil || info.Key != "key" {
+		t.Fatalf("stat: %+v, %v", info, err)
+	}
+}
@@ -2,12 +2,13 @@ package ops
 
 import (
 	"bytes"
+	"encoding/base64"
 	"io"
+	"sort"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 
-	"errors"
-
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -18,8 +19,16 @@ import (
 // S3Engine defines an AWS S3 backed object storage engine
 type S3Engine struct {
 	sess       *session.Session
+	client     *s3.S3
 	downloader *s3manager.Downloader
 	bucket     *string
+
+	// PartSize is the size of the parts of multipart transfers. Zero uses
+	// the s3manager default.
+	PartSize int64
+	// Concurrency is the number of parts transferred at once. Zero uses the
+	// s3manager default.
+	Concurrency int
 }
 
 // NewS3 creates an
@@ -27,6 +36,7 @@ func NewS3(region string, bucket string) *S3Engine {
 	config := aws.NewConfig().WithRegion(region).WithS3UseAccelerate(false)
 	e := &S3Engine{}
 	e.sess = session.New(config)
+	e.client = s3.New(e.sess)
 	e.downloader = s3manager.NewDownloader(e.sess)
 	e.bucket = aws.String(bucket)
 
@@ -36,12 +46,16 @@ func NewS3(region string, bucket string) *S3Engine {
 // WriteTo reads key from S3 and writes the bytes to w
 func (e *S3Engine) WriteTo(key string, w io.Writer) error {
 	logrus.Debug("excuting S3Engine WriteTo")
+	return e.writeTo(key, "", w)
+}
+
+func (e *S3Engine) writeTo(key string, versionID string, w io.Writer) error {
 	if writerAt, ok := w.(io.WriterAt); ok {
-		return e.download(key, writerAt)
+		return e.download(key, versionID, writerAt)
 	}
 	data := make([]byte, bytes.MinRead)
 	wab := aws.NewWriteAtBuffer(data)
-	err := e.download(key, wab)
+	err := e.download(key, versionID, wab)
 	if err != nil {
 		return err
 	}
@@ -49,17 +63,31 @@ func (e *S3Engine) WriteTo(key string, w io.Writer) error {
 	return err
 }
 
-func (e *S3Engine) download(key string, w io.WriterAt) error {
+func (e *S3Engine) download(key string, versionID string, w io.WriterAt) error {
 	obj := &s3.GetObjectInput{
 		Bucket: e.bucket,
 		Key:    aws.String(key),
 	}
-	numbytes, err := e.downloader.Download(w, obj)
+	if versionID != "" {
+		obj.VersionId = aws.String(versionID)
+	}
+	numbytes, err := e.downloader.Download(w, obj, func(d *s3manager.Downloader) {
+		if e.PartSize > 0 {
+			d.PartSize = e.PartSize
+		}
+		if e.Concurrency > 0 {
+			d.Concurrency = e.Concurrency
+		}
+	})
 	if err != nil {
 		if rf, ok := err.(awserr.RequestFailure); ok {
 			if rf.StatusCode() == 404 {
 				logrus.WithField("key", key).Info("key does not exist")
-				return errors.New(rf.Message())
+				return ErrNotFound
+			}
+			// asking for a delete marker is not allowed
+			if rf.StatusCode() == 405 && versionID != "" {
+				return ErrNotFound
 			}
 		}
 		logrus.WithField("key", key).Debug("failed to read data from key")
@@ -71,22 +99,74 @@ func (e *S3Engine) download(key string, w io.WriterAt) error {
 
 // ReadFrom reads data from r and stores it under key
 func (e *S3Engine) ReadFrom(key string, r io.Reader) error {
-	return s3upload(e, key, r)
+	return s3upload(e, key, r, &s3manager.UploadInput{})
 }
 
-// Delete remove the
+// ReadFromVerified stores r under key, passing its md5 and sha256 to S3 to
+// be checked. S3 only checks uploads small enough to be sent in a single
+// part.
+func (e *S3Engine) ReadFromVerified(key string, r io.Reader, want *Integrity) error {
+	input := &s3manager.UploadInput{}
+	if len(want.MD5) > 0 {
+		input.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(want.MD5))
+	}
+	if len(want.Sha256) > 0 {
+		input.ChecksumSHA256 = aws.String(base64.StdEncoding.EncodeToString(want.Sha256))
+	}
+	return s3upload(e, key, r, input)
+}
+
+// Delete removes key from the bucket
 func (e *S3Engine) Delete(key string) error {
-	return nil
+	_, err := e.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: e.bucket,
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"awserr": err, "key": key}).Error("failed to delete")
+	}
+	return err
 }
 
-func s3upload(e *S3Engine, key string, reader io.Reader) error {
-	logrus.WithField("bucket", e.bucket).Info("engine configuration")
-	uploader := s3manager.NewUploader(e.sess)
-	result, err := uploader.Upload(&s3manager.UploadInput{
-		Body:   reader,
+// Stat describes key from its HEAD, without downloading it
+func (e *S3Engine) Stat(key string) (*ObjectInfo, error) {
+	out, err := e.client.HeadObject(&s3.HeadObjectInput{
 		Bucket: e.bucket,
 		Key:    aws.String(key),
 	})
+	if err != nil {
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() == 404 {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	info := &ObjectInfo{
+		Key:         key,
+		Size:        aws.Int64Value(out.ContentLength),
+		ContentType: aws.StringValue(out.ContentType),
+		Modified:    aws.TimeValue(out.LastModified),
+		Metadata:    map[string]string{},
+	}
+	for k, v := range out.Metadata {
+		info.Metadata[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return info, nil
+}
+
+func s3upload(e *S3Engine, key string, reader io.Reader, input *s3manager.UploadInput) error {
+	logrus.WithField("bucket", e.bucket).Info("engine configuration")
+	uploader := s3manager.NewUploader(e.sess, func(u *s3manager.Uploader) {
+		if e.PartSize > 0 {
+			u.PartSize = e.PartSize
+		}
+		if e.Concurrency > 0 {
+			u.Concurrency = e.Concurrency
+		}
+	})
+	input.Body = reader
+	input.Bucket = e.bucket
+	input.Key = aws.String(key)
+	result, err := uploader.Upload(input)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{"awserr": err, "key": key}).Error("failed to upload")
 		return err
@@ -94,3 +174,80 @@ func s3upload(e *S3Engine, key string, reader io.Reader) error {
 	logrus.WithFields(logrus.Fields{"key": key, "location": result.Location}).Info("uploaded key")
 	return nil
 }
+
+// List calls fn for every key in the bucket beginning with prefix
+func (e *S3Engine) List(prefix string, fn func(key string) error) error {
+	input := &s3.ListObjectsV2Input{
+		Bucket: e.bucket,
+		Prefix: aws.String(prefix),
+	}
+	var ferr error
+	err := e.client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			if ferr = fn(aws.StringValue(obj.Key)); ferr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// Versioning reports whether versioning is enabled on the bucket
+func (e *S3Engine) Versioning() (bool, error) {
+	out, err := e.client.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: e.bucket})
+	if err != nil {
+		return false, err
+	}
+	return aws.StringValue(out.Status) == s3.BucketVersioningStatusEnabled, nil
+}
+
+// Versions returns the versions the bucket keeps of key, newest first
+func (e *S3Engine) Versions(key string) ([]VersionInfo, error) {
+	input := &s3.ListObjectVersionsInput{
+		Bucket: e.bucket,
+		Prefix: aws.String(key),
+	}
+	var versions []VersionInfo
+	err := e.client.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, last bool) bool {
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) == key {
+				versions = append(versions, VersionInfo{
+					ID:       aws.StringValue(v.VersionId),
+					Size:     aws.Int64Value(v.Size),
+					Modified: aws.TimeValue(v.LastModified),
+					Latest:   aws.BoolValue(v.IsLatest),
+				})
+			}
+		}
+		for _, m := range page.DeleteMarkers {
+			if aws.StringValue(m.Key) == key {
+				versions = append(versions, VersionInfo{
+					ID:           aws.StringValue(m.VersionId),
+					Modified:     aws.TimeValue(m.LastModified),
+					Latest:       aws.BoolValue(m.IsLatest),
+					DeleteMarker: true,
+				})
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	sort.SliceStable(versions, func(i, j int) bool {
+		return versions[i].Modified.After(versions[j].Modified)
+	})
+	return versions, nil
+}
+
+// WriteVersion reads version id of key from S3 and writes the bytes to w
+func (e *S3Engine) WriteVersion(key string, id string, w io.Writer) error {
+	return e.writeTo(key, id, w)
+}
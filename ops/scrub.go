@@ -0,0 +1,234 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SystemPrefix starts the keys objstore keeps for itself. They are hidden
+// from listings made through Storage.
+const SystemPrefix = ".objstore/"
+
+// checksumPrefix holds the checksum records of stored objects
+const checksumPrefix = SystemPrefix + "sha256/"
+
+// Scrub results passed to Scrubber.Report
+const (
+	ScrubCorrupt    = "corrupt"
+	ScrubMissing    = "missing"
+	ScrubUnverified = "unverified"
+	ScrubRepaired   = "repaired"
+	ScrubRecorded   = "recorded"
+)
+
+// Checksum is the record kept of an object when it is stored
+type Checksum struct {
+	Sha256   string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// ChecksumKey returns the key the checksum of key is recorded under
+func ChecksumKey(key string) string {
+	return checksumPrefix + key
+}
+
+// ReadChecksum returns the checksum recorded for key in e
+func ReadChecksum(e Engine, key string) (*Checksum, error) {
+	var b bytes.Buffer
+	if err := e.WriteTo(ChecksumKey(key), &b); err != nil {
+		return nil, err
+	}
+	c := &Checksum{}
+	if err := json.Unmarshal(b.Bytes(), c); err != nil {
+		return nil, fmt.Errorf("invalid checksum record for %s: %v", key, err)
+	}
+	return c, nil
+}
+
+// WriteChecksum records the checksum of key in e
+func WriteChecksum(e Engine, key string, c *Checksum) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return e.ReadFrom(ChecksumKey(key), bytes.NewReader(b))
+}
+
+// Scrubber re-reads the objects of an engine and checks them against the
+// checksums recorded when they were stored. Objects which are corrupt or
+// missing can be repaired from a replica holding a good copy.
+type Scrubber struct {
+	engine Engine
+
+	// Prefix limits the scrub to keys beginning with it
+	Prefix string
+	// Replica is read to repair corrupt and missing objects. Nothing is
+	// repaired if nil.
+	Replica Engine
+	// Record stores a checksum for objects which have none
+	Record bool
+	// Report is called for every object which is not intact, and for every
+	// repair or record made, with the error if it failed
+	Report func(result string, key string, err error)
+}
+
+// ScrubStats counts the outcome of a scrub
+type ScrubStats struct {
+	Scanned    int
+	Verified   int
+	Corrupt    int
+	Missing    int
+	Unverified int
+	Repaired   int
+	Recorded   int
+	Failed     int
+}
+
+// NewScrubber creates a Scrubber checking the objects of e
+func NewScrubber(e Engine) *Scrubber {
+	return &Scrubber{engine: e}
+}
+
+// Run checks every object with a recorded checksum, then looks for objects
+// without one. An error is returned if any object was left corrupt or
+// missing.
+func (s *Scrubber) Run() (*ScrubStats, error) {
+	lister, ok := s.engine.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("scrub: %v", ErrNoList)
+	}
+	stats := &ScrubStats{}
+	err := lister.List(checksumPrefix+s.Prefix, func(record string) error {
+		key := strings.TrimPrefix(record, checksumPrefix)
+		stats.Scanned++
+		s.check(key, stats)
+		if stats.Scanned%checkpointEvery == 0 {
+			logrus.WithFields(logrus.Fields{"scanned": stats.Scanned, "verified": stats.Verified}).Info("scrub progress")
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	err = lister.List(s.Prefix, func(key string) error {
+		if strings.HasPrefix(key, SystemPrefix) {
+			return nil
+		}
+		if _, err := ReadChecksum(s.engine, key); err != ErrNotFound {
+			// checked above, or an unreadable record which was reported
+			return nil
+		}
+		stats.Scanned++
+		if !s.Record {
+			stats.Unverified++
+			s.report(ScrubUnverified, key, nil)
+			return nil
+		}
+		c, err := checksumObject(s.engine, key)
+		if err == nil {
+			err = WriteChecksum(s.engine, key, c)
+		}
+		if err != nil {
+			stats.Failed++
+		} else {
+			stats.Recorded++
+		}
+		s.report(ScrubRecorded, key, err)
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	if left := stats.Corrupt + stats.Missing + stats.Failed - stats.Repaired; left > 0 {
+		return stats, fmt.Errorf("%d objects failed the scrub", left)
+	}
+	return stats, nil
+}
+
+// check verifies key against its recorded checksum, repairing it if it is
+// damaged and a replica is set
+func (s *Scrubber) check(key string, stats *ScrubStats) {
+	want, err := ReadChecksum(s.engine, key)
+	if err != nil {
+		stats.Failed++
+		s.report(ScrubCorrupt, key, err)
+		return
+	}
+	got, err := checksumObject(s.engine, key)
+	switch {
+	case err == ErrNotFound:
+		stats.Missing++
+		s.report(ScrubMissing, key, nil)
+	case err != nil:
+		stats.Failed++
+		s.report(ScrubCorrupt, key, err)
+		return
+	case got.Sha256 != want.Sha256 || got.Size != want.Size:
+		stats.Corrupt++
+		s.report(ScrubCorrupt, key, nil)
+	default:
+		stats.Verified++
+		return
+	}
+	if s.Replica == nil {
+		return
+	}
+	err = s.repair(key, want)
+	if err == nil {
+		stats.Repaired++
+	}
+	s.report(ScrubRepaired, key, err)
+}
+
+// repair copies key from the replica, provided the replica holds the
+// object which was recorded
+func (s *Scrubber) repair(key string, want *Checksum) error {
+	c, err := checksumObject(s.Replica, key)
+	if err != nil {
+		return fmt.Errorf("replica: %v", err)
+	}
+	if c.Sha256 != want.Sha256 {
+		return fmt.Errorf("replica copy of %s does not match its checksum", key)
+	}
+	if _, err = copyCounted(s.engine, s.Replica, key); err != nil {
+		return err
+	}
+	got, err := checksumObject(s.engine, key)
+	if err != nil {
+		return err
+	}
+	if got.Sha256 != want.Sha256 {
+		return fmt.Errorf("repaired copy of %s does not match its checksum", key)
+	}
+	return nil
+}
+
+func (s *Scrubber) report(result string, key string, err error) {
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"key": key, "result": result, "error": err}).Warn("scrub failed")
+	}
+	if s.Report != nil {
+		s.Report(result, key, err)
+	}
+}
+
+// checksumObject reads key from e and returns its checksum
+func checksumObject(e Engine, key string) (*Checksum, error) {
+	h := sha256.New()
+	cw := &countWriter{}
+	if err := e.WriteTo(key, io.MultiWriter(h, cw)); err != nil {
+		return nil, err
+	}
+	return &Checksum{Sha256: hex.EncodeToString(h.Sum(nil)), Size: cw.n, Recorded: time.Now().UTC()}, nil
+}
@@ -0,0 +1,322 @@
+package ops
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// posixRename is the OpenSSH extension replacing a file in one step
+const posixRename = "posix-rename@openssh.com"
+
+// DefaultSFTPConns is the number of idle SFTP connections kept open
+const DefaultSFTPConns = 4
+
+// SFTPEngine implements Storage on a remote filesystem reached over SFTP.
+// Keys map to paths below root and connections are pooled between calls.
+type SFTPEngine struct {
+	addr   string
+	root   string
+	config *ssh.ClientConfig
+	idle   chan *sftpConn
+}
+
+// sftpConn is an SFTP session along with the SSH connection carrying it
+type sftpConn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+// SFTPConfig holds the connection settings of an SFTP engine
+type SFTPConfig struct {
+	// Host is the address of the server, the port defaults to 22
+	Host string
+	// User is the login name
+	User string
+	// KeyFile is the path of the PEM encoded private key used to log in
+	KeyFile string
+	// Passphrase decrypts KeyFile if it is encrypted
+	Passphrase string
+	// KnownHosts is the path of a known_hosts file the host key is checked against
+	KnownHosts string
+	// Insecure skips host key checking when KnownHosts is empty
+	Insecure bool
+	// Root is the remote directory keys are stored below
+	Root string
+	// MaxConns is the number of idle connections kept open
+	MaxConns int
+}
+
+// NewSFTPEngine creates an SFTP engine from cfg. Connections are opened on
+// first use.
+func NewSFTPEngine(cfg SFTPConfig) (*SFTPEngine, error) {
+	pem, err := ioutil.ReadFile(cfg.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var signer ssh.Signer
+	if cfg.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(pem, []byte(cfg.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(pem)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var hostKey ssh.HostKeyCallback
+	switch {
+	case cfg.KnownHosts != "":
+		if hostKey, err = knownhosts.New(cfg.KnownHosts); err != nil {
+			return nil, err
+		}
+	case cfg.Insecure:
+		logrus.WithField("host", cfg.Host).Warn("sftp host key is not verified")
+		hostKey = ssh.InsecureIgnoreHostKey()
+	default:
+		return nil, errors.New("sftp requires known hosts or insecure")
+	}
+
+	addr := cfg.Host
+	if _, _, err = net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "22")
+	}
+	conns := cfg.MaxConns
+	if conns <= 0 {
+		conns = DefaultSFTPConns
+	}
+	e := &SFTPEngine{
+		addr: addr,
+		root: cfg.Root,
+		config: &ssh.ClientConfig{
+			User:            cfg.User,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: hostKey,
+			Timeout:         30 * time.Second,
+		},
+		idle: make(chan *sftpConn, conns),
+	}
+	return e, nil
+}
+
+// WriteTo reads key from the remote filesystem and writes the bytes to w
+func (e *SFTPEngine) WriteTo(key string, w io.Writer) (err error) {
+	c, err := e.take()
+	if err != nil {
+		return err
+	}
+	defer func() { e.put(c, err) }()
+
+	f, err := c.sftp.Open(e.join(key))
+	if err != nil {
+		return sftpError(err)
+	}
+	defer f.Close()
+	_, err = f.WriteTo(w)
+	return err
+}
+
+// ReadFrom reads from r and uploads the data to key. Data is written to a
+// temporary file first and renamed into place so readers never see a
+// partial object.
+func (e *SFTPEngine) ReadFrom(key string, r io.Reader) (err error) {
+	c, err := e.take()
+	if err != nil {
+		return err
+	}
+	defer func() { e.put(c, err) }()
+
+	filename := e.join(key)
+	dir := path.Dir(filename)
+	if err = c.sftp.MkdirAll(dir); err != nil {
+		return err
+	}
+	tmp := path.Join(dir, tempPrefix+randomSuffix())
+	f, err := c.sftp.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return err
+	}
+	_, err = f.ReadFrom(r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = c.sftp.Chmod(tmp, modeFile)
+	}
+	if err == nil {
+		err = e.rename(c, tmp, filename)
+	}
+	if err != nil {
+		c.sftp.Remove(tmp)
+		logrus.WithFields(logrus.Fields{"sftperr": err, "key": key}).Error("failed to upload")
+	}
+	return err
+}
+
+// Delete removes key from the remote filesystem
+func (e *SFTPEngine) Delete(key string) (err error) {
+	c, err := e.take()
+	if err != nil {
+		return err
+	}
+	defer func() { e.put(c, err) }()
+	return sftpError(c.sftp.Remove(e.join(key)))
+}
+
+// List calls fn for every file under root whose key begins with prefix
+func (e *SFTPEngine) List(prefix string, fn func(key string) error) error {
+	// collect the keys first so the connection is not held while fn runs
+	var keys []string
+	c, err := e.take()
+	if err != nil {
+		return err
+	}
+	err = e.walk(c.sftp, "", prefix, &keys)
+	e.put(c, err)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err = fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all idle connections
+func (e *SFTPEngine) Close() error {
+	for {
+		select {
+		case c := <-e.idle:
+			c.close()
+		default:
+			return nil
+		}
+	}
+}
+
+// walk collects the keys below dir in lexical order, in the same way as
+// LocalFile
+func (e *SFTPEngine) walk(client *sftp.Client, dir string, prefix string, keys *[]string) error {
+	infos, err := client.ReadDir(e.join(dir))
+	if err != nil {
+		if os.IsNotExist(err) && dir == "" {
+			return nil
+		}
+		return err
+	}
+
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), tempPrefix) {
+			continue
+		}
+		key := path.Join(dir, info.Name())
+		if info.IsDir() {
+			key += "/"
+		}
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	for _, key := range names {
+		if strings.HasSuffix(key, "/") {
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				continue
+			}
+			if err = e.walk(client, strings.TrimSuffix(key, "/"), prefix, keys); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(key, prefix) {
+			*keys = append(*keys, key)
+		}
+	}
+	return nil
+}
+
+// take returns an idle connection or dials a new one
+func (e *SFTPEngine) take() (*sftpConn, error) {
+	select {
+	case c := <-e.idle:
+		return c, nil
+	default:
+	}
+	client, err := ssh.Dial("tcp", e.addr, e.config)
+	if err != nil {
+		return nil, err
+	}
+	session, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &sftpConn{ssh: client, sftp: session}, nil
+}
+
+// put returns c to the pool unless err suggests the connection is broken
+// or the pool is full
+func (e *SFTPEngine) put(c *sftpConn, err error) {
+	if err != nil && !os.IsNotExist(err) && err != ErrNotFound && !os.IsPermission(err) {
+		if _, ok := err.(*sftp.StatusError); !ok {
+			c.close()
+			return
+		}
+	}
+	select {
+	case e.idle <- c:
+	default:
+		c.close()
+	}
+}
+
+func (c *sftpConn) close() {
+	c.sftp.Close()
+	c.ssh.Close()
+}
+
+func (e *SFTPEngine) join(key string) string {
+	// rooting the key first stops it climbing out of root
+	return path.Join(e.root, path.Clean("/"+key))
+}
+
+// rename moves the file at oldname over newname. Servers without the
+// OpenSSH posix-rename extension cannot replace a file in one step, so
+// newname is removed first and is briefly missing.
+func (e *SFTPEngine) rename(c *sftpConn, oldname string, newname string) error {
+	if _, ok := c.sftp.HasExtension(posixRename); ok {
+		return c.sftp.PosixRename(oldname, newname)
+	}
+	if err := c.sftp.Remove(newname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return c.sftp.Rename(oldname, newname)
+}
+
+func sftpError(err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func randomSuffix() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,129 @@
+package ops
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSFTPEngine(t *testing.T) {
+	e, err := NewSFTPEngine(sftpServer(t, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	testEngine(t, e)
+}
+
+func TestSFTPEngineWithoutPosixRename(t *testing.T) {
+	// servers only able to rename onto a missing file
+	if err := sftp.SetSFTPExtensions(); err != nil {
+		t.Fatal(err)
+	}
+	defer sftp.SetSFTPExtensions("hardlink@openssh.com", posixRename, "statvfs@openssh.com")
+	e, err := NewSFTPEngine(sftpServer(t, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	testEngine(t, e)
+}
+
+// sftpServer starts an SFTP server keeping its files in memory and returns
+// the config of an engine logging in to it. Without posix the server treats
+// a posix-rename as a plain rename.
+func sftpServer(t *testing.T, posix bool) SFTPConfig {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(tempDir(t), "id")
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	// every connection shares one filesystem
+	handlers := sftp.InMemHandler()
+	if !posix {
+		handlers.FileCmd = struct{ sftp.FileCmder }{handlers.FileCmd}
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSFTP(conn, config, handlers)
+		}
+	}()
+	return SFTPConfig{
+		Host:     l.Addr().String(),
+		User:     "objstore",
+		KeyFile:  keyFile,
+		Insecure: true,
+		Root:     "/upload",
+	}
+}
+
+// serveSFTP answers the sftp subsystem requests of an SSH connection
+func serveSFTP(conn net.Conn, config *ssh.ServerConfig, handlers sftp.Handlers) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions are served")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				// the payload is the length prefixed subsystem name
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server := sftp.NewRequestServer(channel, handlers)
+					go func() {
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,176 @@
+package ops
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of ring positions given to each shard
+const DefaultVirtualNodes = 128
+
+// ShardedEngine spreads keys over a set of named engines using consistent
+// hashing. Each shard owns several virtual nodes on the hash ring so that
+// adding or removing a shard only moves a small share of the keys. Shards
+// should be added before the engine is used.
+type ShardedEngine struct {
+	vnodes int
+	ring   []vnode
+	shards map[string]Engine
+
+	// Probe checks every shard when the owning shard does not hold a key,
+	// which keeps keys readable while a rebalance is in progress.
+	Probe bool
+}
+
+type vnode struct {
+	hash  uint64
+	shard string
+}
+
+// NewShardedEngine creates an empty ShardedEngine giving each shard vnodes
+// positions on the hash ring.
+func NewShardedEngine(vnodes int) *ShardedEngine {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	return &ShardedEngine{vnodes: vnodes, shards: map[string]Engine{}}
+}
+
+// Add places the engine e on the hash ring under name. The name, not the
+// order of addition, decides which keys the shard owns.
+func (e *ShardedEngine) Add(name string, en Engine) {
+	e.shards[name] = en
+	for i := 0; i < e.vnodes; i++ {
+		e.ring = append(e.ring, vnode{hash: ringHash(name + "#" + strconv.Itoa(i)), shard: name})
+	}
+	sort.Slice(e.ring, func(i, j int) bool {
+		return e.ring[i].hash < e.ring[j].hash
+	})
+}
+
+// Shards returns the engines on the ring by name
+func (e *ShardedEngine) Shards() map[string]Engine {
+	shards := make(map[string]Engine, len(e.shards))
+	for name, en := range e.shards {
+		shards[name] = en
+	}
+	return shards
+}
+
+// Owner returns the name of the shard owning key
+func (e *ShardedEngine) Owner(key string) string {
+	if len(e.ring) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(e.ring), func(i int) bool {
+		return e.ring[i].hash >= h
+	})
+	if i == len(e.ring) {
+		i = 0
+	}
+	return e.ring[i].shard
+}
+
+// WriteTo reads key from its shard and writes the bytes to w
+func (e *ShardedEngine) WriteTo(key string, w io.Writer) error {
+	owner, err := e.owner(key)
+	if err != nil {
+		return err
+	}
+	err = e.shards[owner].WriteTo(key, w)
+	if err != ErrNotFound || !e.Probe {
+		return err
+	}
+	for name, en := range e.shards {
+		if name == owner {
+			continue
+		}
+		err = en.WriteTo(key, w)
+		if err != ErrNotFound {
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+// ReadFrom reads data from r and stores it under key on its shard
+func (e *ShardedEngine) ReadFrom(key string, r io.Reader) error {
+	owner, err := e.owner(key)
+	if err != nil {
+		return err
+	}
+	return e.shards[owner].ReadFrom(key, r)
+}
+
+// Delete removes key from its shard
+func (e *ShardedEngine) Delete(key string) error {
+	owner, err := e.owner(key)
+	if err != nil {
+		return err
+	}
+	err = e.shards[owner].Delete(key)
+	if err != ErrNotFound || !e.Probe {
+		return err
+	}
+	for name, en := range e.shards {
+		if name == owner {
+			continue
+		}
+		err = en.Delete(key)
+		if err != ErrNotFound {
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+// List calls fn for every key beginning with prefix. Unless Probe is set,
+// keys left on a shard which no longer owns them are not listed as they
+// cannot be read.
+func (e *ShardedEngine) List(prefix string, fn func(key string) error) error {
+	names := make([]string, 0, len(e.shards))
+	for name := range e.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	listers := make([]Lister, 0, len(names))
+	for _, name := range names {
+		name := name
+		l, ok := e.shards[name].(Lister)
+		if !ok {
+			return ErrNoList
+		}
+		if e.Probe {
+			listers = append(listers, l)
+			continue
+		}
+		listers = append(listers, listerFunc(func(prefix string, fn func(key string) error) error {
+			return l.List(prefix, func(key string) error {
+				if e.Owner(key) != name {
+					return nil
+				}
+				return fn(key)
+			})
+		}))
+	}
+	return mergeList(prefix, fn, listers...)
+}
+
+func (e *ShardedEngine) owner(key string) (string, error) {
+	owner := e.Owner(key)
+	if owner == "" {
+		return "", errors.New("sharded engine has no shards")
+	}
+	return owner, nil
+}
+
+func ringHash(s string) uint64 {
+	sum := sha256.Sum256([]byte(s))
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,369 @@
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS objects (
+	key          TEXT PRIMARY KEY,
+	size         INTEGER NOT NULL,
+	content_type TEXT NOT NULL,
+	metadata     TEXT NOT NULL DEFAULT '{}',
+	created      INTEGER NOT NULL,
+	modified     INTEGER NOT NULL,
+	body         BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS objects_modified ON objects (modified);
+`
+
+const sqliteColumns = `key, size, content_type, metadata, modified`
+
+// SQLiteEngine implements Storage in a SQLite database. Bodies are streamed
+// in and out with incremental blob I/O, and each object keeps its size,
+// content type, user metadata and timestamps in the objects table so they
+// can be searched with Query or plain SQL. Timestamps are stored as unix
+// nanoseconds.
+type SQLiteEngine struct {
+	pool *sqlitex.Pool
+
+	// TempDir holds uploads while their size is measured. The OS default is used if empty.
+	TempDir string
+}
+
+// NewSQLiteEngine opens or creates the SQLite database at path.
+func NewSQLiteEngine(path string) (*SQLiteEngine, error) {
+	pool, err := sqlitex.NewPool(path, sqlitex.PoolOptions{
+		PrepareConn: func(conn *sqlite.Conn) error {
+			return sqlitex.ExecuteTransient(conn, "PRAGMA busy_timeout = 10000;", nil)
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	conn, err := pool.Take(context.Background())
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	err = sqlitex.ExecuteScript(conn, sqliteSchema, nil)
+	pool.Put(conn)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+	return &SQLiteEngine{pool: pool}, nil
+}
+
+// WriteTo streams the body of key to w
+func (e *SQLiteEngine) WriteTo(key string, w io.Writer) (err error) {
+	conn, err := e.pool.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	defer e.pool.Put(conn)
+
+	defer sqlitex.Transaction(conn)(&err)
+	row, err := e.rowid(conn, key)
+	if err != nil {
+		return err
+	}
+	blob, err := conn.OpenBlob("main", "objects", "body", row, false)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	_, err = blob.WriteTo(w)
+	return err
+}
+
+// ReadFrom reads data from r and stores it under key, without a content type
+// or metadata until they are given by Describe. The body is spooled to a
+// temporary file first since SQLite needs the size of a blob up front.
+func (e *SQLiteEngine) ReadFrom(key string, r io.Reader) (err error) {
+	f, err := ioutil.TempFile(e.TempDir, "objstore-sqlite-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	conn, err := e.pool.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	defer e.pool.Put(conn)
+
+	end, err := sqlitex.ImmediateTransaction(conn)
+	if err != nil {
+		return err
+	}
+	defer end(&err)
+
+	now := time.Now().UnixNano()
+	err = sqlitex.Execute(conn, `
+		INSERT INTO objects (key, size, content_type, created, modified, body)
+		VALUES (?1, ?2, '', ?3, ?3, zeroblob(?2))
+		ON CONFLICT (key) DO UPDATE SET
+			size = excluded.size,
+			content_type = excluded.content_type,
+			metadata = excluded.metadata,
+			modified = excluded.modified,
+			body = excluded.body`,
+		&sqlitex.ExecOptions{Args: []interface{}{key, size, now}})
+	if err != nil {
+		return err
+	}
+	row, err := e.rowid(conn, key)
+	if err != nil {
+		return err
+	}
+	blob, err := conn.OpenBlob("main", "objects", "body", row, true)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(blob, f)
+	if cerr := blob.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Delete removes key from the database
+func (e *SQLiteEngine) Delete(key string) error {
+	conn, err := e.pool.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	defer e.pool.Put(conn)
+	err = sqlitex.Execute(conn, `DELETE FROM objects WHERE key = ?`, &sqlitex.ExecOptions{Args: []interface{}{key}})
+	if err != nil {
+		return err
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List calls fn for every key beginning with prefix
+func (e *SQLiteEngine) List(prefix string, fn func(key string) error) error {
+	return e.Query(SQLiteFilter{Prefix: prefix}, func(info *ObjectInfo) error {
+		return fn(info.Key)
+	})
+}
+
+// Stat describes key without reading its body
+func (e *SQLiteEngine) Stat(key string) (*ObjectInfo, error) {
+	var found *ObjectInfo
+	err := e.Query(SQLiteFilter{Key: key}, func(info *ObjectInfo) error {
+		found = info
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrNotFound
+	}
+	return found, nil
+}
+
+// Describe sets the content type and user metadata of key
+func (e *SQLiteEngine) Describe(key string, contentType string, meta map[string]string) error {
+	if meta == nil {
+		meta = map[string]string{}
+	}
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	conn, err := e.pool.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	defer e.pool.Put(conn)
+	err = sqlitex.Execute(conn, `UPDATE objects SET content_type = ?2, metadata = ?3 WHERE key = ?1`,
+		&sqlitex.ExecOptions{Args: []interface{}{key, contentType, string(data)}})
+	if err != nil {
+		return err
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SetMetadata replaces the user metadata of key
+func (e *SQLiteEngine) SetMetadata(key string, meta map[string]string) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	conn, err := e.pool.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	defer e.pool.Put(conn)
+	err = sqlitex.Execute(conn, `UPDATE objects SET metadata = ?2 WHERE key = ?1`,
+		&sqlitex.ExecOptions{Args: []interface{}{key, string(data)}})
+	if err != nil {
+		return err
+	}
+	if conn.Changes() == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SQLiteFilter selects objects by the columns of the objects table. Fields
+// left zero match every object.
+type SQLiteFilter struct {
+	// Key matches the object stored under exactly this key
+	Key string
+	// Prefix matches keys beginning with it
+	Prefix string
+	// ContentType matches content types beginning with it, so "image/"
+	// matches every image
+	ContentType string
+	// MinSize and MaxSize bound the size of objects. A MaxSize of zero
+	// sets no bound.
+	MinSize int64
+	MaxSize int64
+	// ModifiedAfter and ModifiedBefore bound the last modification time
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+	// Metadata matches objects holding every name with its value
+	Metadata map[string]string
+	// Limit stops after this many objects if positive
+	Limit int
+}
+
+// where builds the SQL condition and arguments selecting the objects f
+// matches
+func (f *SQLiteFilter) where() (string, []interface{}) {
+	var conds []string
+	var args []interface{}
+	// arg binds v and returns its parameter
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "?" + strconv.Itoa(len(args))
+	}
+	if f.Key != "" {
+		conds = append(conds, `key = `+arg(f.Key))
+	}
+	if f.Prefix != "" {
+		conds = append(conds, `substr(key, 1, `+arg(len(f.Prefix))+`) = `+arg(f.Prefix))
+	}
+	if f.ContentType != "" {
+		conds = append(conds, `substr(content_type, 1, `+arg(len(f.ContentType))+`) = `+arg(f.ContentType))
+	}
+	if f.MinSize > 0 {
+		conds = append(conds, `size >= `+arg(f.MinSize))
+	}
+	if f.MaxSize > 0 {
+		conds = append(conds, `size <= `+arg(f.MaxSize))
+	}
+	if !f.ModifiedAfter.IsZero() {
+		conds = append(conds, `modified > `+arg(f.ModifiedAfter.UnixNano()))
+	}
+	if !f.ModifiedBefore.IsZero() {
+		conds = append(conds, `modified < `+arg(f.ModifiedBefore.UnixNano()))
+	}
+	names := make([]string, 0, len(f.Metadata))
+	for name := range f.Metadata {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		conds = append(conds, `EXISTS (SELECT 1 FROM json_each(metadata) WHERE json_each.key = `+
+			arg(name)+` AND json_each.value = `+arg(f.Metadata[name])+`)`)
+	}
+	if len(conds) == 0 {
+		return "1", nil
+	}
+	return strings.Join(conds, " AND "), args
+}
+
+// Query calls fn for every object matching f, in key order
+func (e *SQLiteEngine) Query(f SQLiteFilter, fn func(*ObjectInfo) error) error {
+	where, args := f.where()
+	query := `SELECT ` + sqliteColumns + ` FROM objects WHERE ` + where + ` ORDER BY key`
+	if f.Limit > 0 {
+		query += ` LIMIT ` + strconv.Itoa(f.Limit)
+	}
+
+	conn, err := e.pool.Take(context.Background())
+	if err != nil {
+		return err
+	}
+	// collect the rows first so fn may use the engine
+	var found []*ObjectInfo
+	err = sqlitex.Execute(conn, query, &sqlitex.ExecOptions{
+		Args: args,
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			info := &ObjectInfo{
+				Key:         stmt.ColumnText(0),
+				Size:        stmt.ColumnInt64(1),
+				ContentType: stmt.ColumnText(2),
+				Modified:    time.Unix(0, stmt.ColumnInt64(4)).UTC(),
+			}
+			if err := json.Unmarshal([]byte(stmt.ColumnText(3)), &info.Metadata); err != nil {
+				return err
+			}
+			found = append(found, info)
+			return nil
+		},
+	})
+	e.pool.Put(conn)
+	if err != nil {
+		return err
+	}
+	for _, info := range found {
+		if err = fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database
+func (e *SQLiteEngine) Close() error {
+	return e.pool.Close()
+}
+
+func (e *SQLiteEngine) rowid(conn *sqlite.Conn, key string) (int64, error) {
+	row := int64(-1)
+	err := sqlitex.Execute(conn, `SELECT rowid FROM objects WHERE key = ?`, &sqlitex.ExecOptions{
+		Args: []interface{}{key},
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			row = stmt.ColumnInt64(0)
+			return nil
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+	if row < 0 {
+		return 0, ErrNotFound
+	}
+	return row, nil
+}
@@ -1,8 +1,17 @@
 package ops
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"log"
 	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mshindle/objstore/api"
 	"github.com/newrelic/go-agent"
 	"github.com/sirupsen/logrus"
 )
@@ -10,26 +19,59 @@ import (
 // DefaultCapacity sets the initial capacity for a buffer
 const DefaultCapacity = 1024 * 1024 * 4
 
+// ErrNotFound is returned by an engine when the requested key does not exist
+var ErrNotFound = api.ErrNotFound
+
+// ErrNoList is returned when an engine is asked to list keys but cannot
+var ErrNoList = errors.New("engine cannot list keys")
+
 const txnRetrieve = "ops.retrieve"
 const txnStore = "ops.store"
 
 // Engine is a specific implementation of Storage
-type Engine interface {
-	WriteTo(string, io.Writer) error
-	ReadFrom(string, io.Reader) error
-	Delete(string) error
+type Engine = api.Engine
+
+// Lister is implemented by engines able to enumerate the keys they hold
+type Lister = api.Lister
+
+// ObjectInfo describes a stored object
+type ObjectInfo = api.ObjectInfo
+
+// Stater is implemented by engines able to describe an object without
+// reading it
+type Stater = api.Stater
+
+// Describer is implemented by engines keeping the content type and user
+// metadata given with an object
+type Describer interface {
+	Describe(key string, contentType string, meta map[string]string) error
 }
 
 // Storage is an implementation independent interface to underlying ops engines
 type Storage struct {
-	engine   Engine
-	newrelic newrelic.Application
+	engine     Engine
+	newrelic   newrelic.Application
+	checksums  bool
+	retention  time.Duration
+	expiration bool
+	lifecycle  []LifecycleRule
+	locks      keyLocks
 }
 
 // Config handles configuration of the ops proxy
 type Config struct {
 	Engine Engine
 	App    newrelic.Application
+	// Checksums records the sha256 of every object stored
+	Checksums bool
+	// Trash keeps deleted objects for this long before they are purged.
+	// Objects are deleted outright if zero.
+	Trash time.Duration
+	// Expiration lets objects be given a time they expire at
+	Expiration bool
+	// Lifecycle expires the objects matching a rule. Objects expire only
+	// when Expiration is set or there are rules.
+	Lifecycle []LifecycleRule
 }
 
 // NewStorage creates a new ops instance implementing engine.
@@ -46,7 +88,14 @@ func NewStorage(cfg *Config) *Storage {
 		}
 		cfg.App = app
 	}
-	return &Storage{engine: cfg.Engine, newrelic: cfg.App}
+	return &Storage{
+		engine:     cfg.Engine,
+		newrelic:   cfg.App,
+		checksums:  cfg.Checksums,
+		retention:  cfg.Trash,
+		expiration: cfg.Expiration,
+		lifecycle:  cfg.Lifecycle,
+	}
 }
 
 // Retrieve pulls the data from under key and puts the contents into data.
@@ -54,7 +103,14 @@ func (s *Storage) Retrieve(key string, data io.Writer) error {
 	txn := s.newrelic.StartTransaction(txnRetrieve, nil, nil)
 	defer txn.End()
 
-	err := s.engine.WriteTo(key, data)
+	// expired objects are gone even before they are reaped
+	expired, err := s.expired(key)
+	if err == nil && expired {
+		err = ErrNotFound
+	}
+	if err == nil {
+		err = s.engine.WriteTo(key, data)
+	}
 	if err != nil {
 		txn.NoticeError(err)
 		return err
@@ -74,10 +130,43 @@ func (s *Storage) RetrieveBytes(key string) ([]byte, error) {
 
 // Store reads the data from reader and persists it under the given key
 func (s *Storage) Store(key string, data io.Reader) error {
+	return s.StoreVerified(key, data, nil)
+}
+
+// StoreVerified is Store for an upload which must match want. An upload
+// which does not match fails with an *IntegrityError and leaves no object
+// behind. A nil want stores the data unchecked.
+func (s *Storage) StoreVerified(key string, data io.Reader, want *Integrity) error {
+	return s.StoreExpiring(key, data, want, time.Time{})
+}
+
+// store persists data under key, checking it against want if given
+func (s *Storage) store(key string, data io.Reader, want *Integrity) error {
 	txn := s.newrelic.StartTransaction(txnStore, nil, nil)
 	defer txn.End()
 
-	err := s.engine.ReadFrom(key, data)
+	h := sha256.New()
+	cw := &countWriter{}
+	if s.checksums {
+		data = io.TeeReader(data, io.MultiWriter(h, cw))
+	}
+	var err error
+	if want != nil {
+		err = readFromVerified(s.engine, key, data, want)
+	} else {
+		err = s.engine.ReadFrom(key, data)
+	}
+	if err == nil && s.checksums {
+		err = WriteChecksum(s.engine, key, &Checksum{
+			Sha256:   hex.EncodeToString(h.Sum(nil)),
+			Size:     cw.n,
+			Recorded: time.Now().UTC(),
+		})
+		if err != nil {
+			// the checksum of the object replaced must not vouch for this one
+			s.engine.Delete(ChecksumKey(key))
+		}
+	}
 	if err != nil {
 		txn.NoticeError(err)
 		return err
@@ -85,8 +174,157 @@ func (s *Storage) Store(key string, data io.Reader) error {
 	return nil
 }
 
-// Delete removes key from ops
+// Delete removes key from ops, moving it to the trash if one is kept
 func (s *Storage) Delete(key string) error {
-	return s.engine.Delete(key)
+	if s.locking() {
+		defer s.locks.lock(key)()
+	}
+	var err error
+	if s.retention > 0 && !strings.HasPrefix(key, SystemPrefix) {
+		err = s.trash(key)
+	} else {
+		err = s.engine.Delete(key)
+	}
+	if err != nil {
+		return err
+	}
+	if s.checksums {
+		if err := s.engine.Delete(ChecksumKey(key)); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	if s.expiring() {
+		if err := s.engine.Delete(expiresPrefix + key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// locking reports whether stores and deletes of a key take its lock, as
+// they must once a delete is more than one step or an object has sidecars
+// to keep in step with it
+func (s *Storage) locking() bool {
+	return s.retention > 0 || s.expiring()
+}
+
+// Describe records the content type and user metadata of the object under
+// key on engines which keep them. Other engines ignore them.
+func (s *Storage) Describe(key string, contentType string, meta map[string]string) error {
+	d, ok := s.engine.(Describer)
+	if !ok {
+		return nil
+	}
+	return d.Describe(key, contentType, meta)
+}
+
+// Stat describes the object under key
+func (s *Storage) Stat(key string) (*ObjectInfo, error) {
+	expired, err := s.expired(key)
+	if err != nil {
+		return nil, err
+	}
+	if expired {
+		return nil, ErrNotFound
+	}
+	return StatEngine(s.engine, key)
+}
+
+// ContentType returns the content type kept with the object under key, or
+// an empty one if there is none or the engine cannot describe the object
+// without reading it
+func (s *Storage) ContentType(key string) string {
+	st, ok := s.engine.(Stater)
+	if !ok {
+		return ""
+	}
+	info, err := st.Stat(key)
+	if err != nil {
+		return ""
+	}
+	return info.ContentType
+}
+
+// List calls fn for every key beginning with prefix, or returns ErrNoList
+// if the engine cannot list keys. Expired objects are left out.
+func (s *Storage) List(prefix string, fn func(key string) error) error {
+	l, ok := s.engine.(Lister)
+	if !ok {
+		return ErrNoList
+	}
+	return l.List(prefix, func(key string) error {
+		if strings.HasPrefix(key, SystemPrefix) {
+			return nil
+		}
+		// an object whose expiry cannot be read is listed, as it is by Reap
+		if expired, err := s.expired(key); err == nil && expired {
+			return nil
+		}
+		return fn(key)
+	})
+}
+
+// Versions returns the versions kept of key, newest first, or
+// ErrNoVersions if the engine does not keep them
+func (s *Storage) Versions(key string) ([]VersionInfo, error) {
+	v, ok := s.engine.(Versioner)
+	if !ok {
+		return nil, ErrNoVersions
+	}
+	return v.Versions(key)
+}
+
+// RetrieveVersion pulls version id of key and puts the contents into data
+func (s *Storage) RetrieveVersion(key string, id string, data io.Writer) error {
+	v, ok := s.engine.(Versioner)
+	if !ok {
+		return ErrNoVersions
+	}
+	return v.WriteVersion(key, id, data)
 }
 
+// Restore stores version id of key as its latest version
+func (s *Storage) Restore(key string, id string) error {
+	v, ok := s.engine.(Versioner)
+	if !ok {
+		return ErrNoVersions
+	}
+	// the version is read in full before it is stored, as reading it may
+	// hold the key the store waits for
+	f, err := ioutil.TempFile("", "objstore-restore-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if err = v.WriteVersion(key, id, f); err != nil {
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return s.Store(key, f)
+}
+
+// StatEngine describes the object under key in e. Engines which cannot
+// describe an object directly have it read to measure its size.
+func StatEngine(e Engine, key string) (*ObjectInfo, error) {
+	if st, ok := e.(Stater); ok {
+		return st.Stat(key)
+	}
+	cw := &countWriter{}
+	if err := e.WriteTo(key, cw); err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, Size: cw.n}, nil
+}
+
+// countWriter discards what is written to it, counting the bytes
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
@@ -1,6 +1,7 @@
 package ops
 
 import (
+	"encoding/hex"
 	"io"
 	"os"
 
@@ -48,6 +49,9 @@ func checkEnvDefault(param *string, envvar string) {
 // WriteTo reads key from Swift and writes the bytes to w
 func (e *SwiftEngine) WriteTo(key string, w io.Writer) error {
 	_, err := e.connection.ObjectGet(e.container, key, w, true, nil)
+	if err == swift.ObjectNotFound {
+		return ErrNotFound
+	}
 	return err
 }
 
@@ -58,8 +62,53 @@ func (e *SwiftEngine) ReadFrom(key string, r io.Reader) error {
 	return err
 }
 
+// ReadFromVerified stores r under key, passing its md5 to Swift as the
+// expected etag
+func (e *SwiftEngine) ReadFromVerified(key string, r io.Reader, want *Integrity) error {
+	_, err := e.connection.ObjectPut(e.container, key, r, true, hex.EncodeToString(want.MD5), "", nil)
+	return err
+}
+
 // Delete removes the object
 func (e *SwiftEngine) Delete(key string) error {
-	return e.connection.ObjectDelete(e.container, key)
+	err := e.connection.ObjectDelete(e.container, key)
+	if err == swift.ObjectNotFound {
+		return ErrNotFound
+	}
+	return err
 }
 
+// Stat describes the object from its HEAD, without downloading it
+func (e *SwiftEngine) Stat(key string) (*ObjectInfo, error) {
+	obj, headers, err := e.connection.Object(e.container, key)
+	if err == swift.ObjectNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{
+		Key:         key,
+		Size:        obj.Bytes,
+		ContentType: obj.ContentType,
+		Modified:    obj.LastModified,
+		Metadata:    headers.ObjectMetadata(),
+	}, nil
+}
+
+// List calls fn for every object in the container beginning with prefix
+func (e *SwiftEngine) List(prefix string, fn func(key string) error) error {
+	opts := &swift.ObjectsOpts{Prefix: prefix}
+	return e.connection.ObjectsWalk(e.container, opts, func(opts *swift.ObjectsOpts) (interface{}, error) {
+		names, err := e.connection.ObjectNames(e.container, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if err = fn(name); err != nil {
+				return nil, err
+			}
+		}
+		return names, nil
+	})
+}
@@ -0,0 +1,246 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// DefaultParallel is the number of objects copied at once
+const DefaultParallel = 4
+
+// Sync actions passed to Syncer.Report
+const (
+	SyncCopy   = "copy"
+	SyncDelete = "delete"
+)
+
+// Syncer makes a destination engine hold the same objects as a source
+// engine, copying only the objects which differ. Objects are compared by
+// size and modification time, or by content with Checksum.
+type Syncer struct {
+	src Engine
+	dst Engine
+
+	// Checksum compares the content of objects of the same size instead of
+	// their modification times
+	Checksum bool
+	// Delete removes destination objects missing from the source
+	Delete bool
+	// DryRun reports what would be done without changing the destination
+	DryRun bool
+	// Parallel is the number of objects copied at once
+	Parallel int
+	// Report is called for every copy and delete once it is done, with the
+	// error if it failed
+	Report func(action string, key string, err error)
+}
+
+// SyncStats counts the work done by a sync
+type SyncStats struct {
+	Scanned int
+	Copied  int
+	Skipped int
+	Deleted int
+	Failed  int
+	Bytes   int64
+}
+
+// NewSyncer creates a Syncer copying from src to dst. Both engines must be
+// able to list their keys.
+func NewSyncer(src Engine, dst Engine) *Syncer {
+	return &Syncer{src: src, dst: dst, Parallel: DefaultParallel}
+}
+
+// Run compares every source object with the destination and copies those
+// which differ. An error is returned if any object failed to sync.
+func (s *Syncer) Run() (*SyncStats, error) {
+	srcList, ok := s.src.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("sync source: %v", ErrNoList)
+	}
+	dstList, ok := s.dst.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("sync destination: %v", ErrNoList)
+	}
+	existing := map[string]bool{}
+	err := dstList.List("", func(key string) error {
+		if listed("", key) {
+			existing[key] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &SyncStats{}
+	var m sync.Mutex
+	record := func(action string, key string, n int64, err error) {
+		m.Lock()
+		switch {
+		case err != nil:
+			stats.Failed++
+		case action == SyncCopy:
+			stats.Copied++
+			stats.Bytes += n
+		case action == SyncDelete:
+			stats.Deleted++
+		default:
+			stats.Skipped++
+		}
+		m.Unlock()
+		if action != "" && s.Report != nil {
+			s.Report(action, key, err)
+		}
+	}
+
+	parallel := s.Parallel
+	if parallel <= 0 {
+		parallel = DefaultParallel
+	}
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				s.syncKey(key, existing, record)
+			}
+		}()
+	}
+	seen := map[string]bool{}
+	err = srcList.List("", func(key string) error {
+		if !listed("", key) {
+			return nil
+		}
+		m.Lock()
+		stats.Scanned++
+		m.Unlock()
+		if s.Delete {
+			seen[key] = true
+		}
+		keys <- key
+		return nil
+	})
+	close(keys)
+	wg.Wait()
+	// keys missing from a listing cut short are not deleted
+	if err != nil {
+		return stats, err
+	}
+
+	if s.Delete {
+		for key := range existing {
+			if seen[key] {
+				continue
+			}
+			var err error
+			if !s.DryRun {
+				err = s.dst.Delete(key)
+				if err == ErrNotFound {
+					err = nil
+				}
+			}
+			record(SyncDelete, key, 0, err)
+		}
+	}
+
+	if stats.Failed > 0 {
+		return stats, fmt.Errorf("%d objects failed to sync", stats.Failed)
+	}
+	return stats, nil
+}
+
+// syncKey copies key if the destination is missing it or holds a
+// different object
+func (s *Syncer) syncKey(key string, existing map[string]bool, record func(string, string, int64, error)) {
+	if existing[key] {
+		same, err := s.same(key)
+		if err != nil {
+			record(SyncCopy, key, 0, err)
+			return
+		}
+		if same {
+			record("", key, 0, nil)
+			return
+		}
+	}
+	if s.DryRun {
+		info, err := StatEngine(s.src, key)
+		var n int64
+		if err == nil {
+			n = info.Size
+		}
+		record(SyncCopy, key, n, err)
+		return
+	}
+	n, err := copyCounted(s.dst, s.src, key)
+	record(SyncCopy, key, n, err)
+}
+
+// same reports whether source and destination hold the same object
+func (s *Syncer) same(key string) (bool, error) {
+	si, err := StatEngine(s.src, key)
+	if err != nil {
+		return false, err
+	}
+	di, err := StatEngine(s.dst, key)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if si.Size != di.Size {
+		return false, nil
+	}
+	if s.Checksum {
+		sh, err := hashObject(s.src, key)
+		if err != nil {
+			return false, err
+		}
+		dh, err := hashObject(s.dst, key)
+		if err == ErrNotFound {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(sh, dh), nil
+	}
+	// a copy is always newer than its source, so only a source changed
+	// since it was copied is newer
+	if !si.Modified.IsZero() && !di.Modified.IsZero() && si.Modified.After(di.Modified) {
+		return false, nil
+	}
+	return true, nil
+}
+
+// hashObject returns the sha256 of the object under key
+func hashObject(e Engine, key string) ([]byte, error) {
+	h := sha256.New()
+	if err := e.WriteTo(key, h); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// copyCounted copies key from src to dst, returning the bytes copied
+func copyCounted(dst Engine, src Engine, key string) (int64, error) {
+	cw := &countWriter{}
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(src.WriteTo(key, io.MultiWriter(pw, cw)))
+	}()
+	err := dst.ReadFrom(key, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		// the source may still be writing
+		return 0, err
+	}
+	return cw.n, nil
+}
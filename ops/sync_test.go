@@ -0,0 +1,78 @@
+package ops
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSyncer(t *testing.T) {
+	dir := tempDir(t)
+	src, dst := NewLocalFile(filepath.Join(dir, "src")), NewLocalFile(filepath.Join(dir, "dst"))
+	for key, body := range map[string]string{"a": "a", "b/c": "b/c", "same": "same", "changed": "source", SystemPrefix + "sha256/a": "sum"} {
+		if err := src.ReadFrom(key, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key, body := range map[string]string{"same": "same", "changed": "target", "extra": "extra", SystemPrefix + "sha256/extra": "sum"} {
+		if err := dst.ReadFrom(key, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a dry run changes nothing
+	s := NewSyncer(src, dst)
+	s.DryRun, s.Delete = true, true
+	stats, err := s.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Scanned != 4 || stats.Copied != 2 || stats.Deleted != 1 {
+		t.Fatalf("dry run: %+v", stats)
+	}
+	if err := dst.WriteTo("a", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("dry run copied a: %v", err)
+	}
+
+	// objects of the same size and older than their copy are left unless
+	// compared by content
+	var reported []string
+	s = NewSyncer(src, dst)
+	s.Delete = true
+	s.Report = func(action string, key string, err error) {
+		reported = append(reported, action+" "+key)
+	}
+	if stats, err = s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 2 || stats.Skipped != 2 || stats.Deleted != 1 {
+		t.Fatalf("sync: %+v", stats)
+	}
+	sort.Strings(reported)
+	if strings.Join(reported, ",") != "copy a,copy b/c,delete extra" {
+		t.Fatalf("reported %q", reported)
+	}
+	s.Checksum = true
+	if stats, err = s.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 1 || stats.Skipped != 3 {
+		t.Fatalf("sync by checksum: %+v", stats)
+	}
+	for _, key := range []string{"a", "b/c", "same", "changed"} {
+		var want, got bytes.Buffer
+		src.WriteTo(key, &want)
+		if err := dst.WriteTo(key, &got); err != nil || got.String() != want.String() {
+			t.Fatalf("%s synced as %q, %v, want %q", key, got.String(), err, want.String())
+		}
+	}
+	// system keys are neither copied nor deleted
+	if err := dst.WriteTo(SystemPrefix+"sha256/a", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("system key copied: %v", err)
+	}
+	if err := dst.WriteTo(SystemPrefix+"sha256/extra", &bytes.Buffer{}); err != nil {
+		t.Fatalf("system key deleted: %v", err)
+	}
+}
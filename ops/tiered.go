@@ -0,0 +1,86 @@
+package ops
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TieredEngine reads from a primary engine and falls back to secondary
+// engines when the primary does not hold a key. All writes go to the primary.
+type TieredEngine struct {
+	primary   Engine
+	fallbacks []Engine
+
+	// Migrate copies objects found on a fallback engine up to the primary.
+	Migrate bool
+}
+
+// NewTieredEngine creates a TieredEngine in front of the fallback engines.
+func NewTieredEngine(primary Engine, fallbacks ...Engine) *TieredEngine {
+	return &TieredEngine{primary: primary, fallbacks: fallbacks}
+}
+
+// WriteTo reads key from the first engine holding it and writes the bytes to w
+func (e *TieredEngine) WriteTo(key string, w io.Writer) error {
+	err := e.primary.WriteTo(key, w)
+	if err != ErrNotFound {
+		return err
+	}
+	for i, f := range e.fallbacks {
+		if !e.Migrate {
+			err = f.WriteTo(key, w)
+			if err == ErrNotFound {
+				continue
+			}
+			return err
+		}
+
+		wb := NewWriteBuffer(make([]byte, 0, bytes.MinRead))
+		err = f.WriteTo(key, wb)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err = e.primary.ReadFrom(key, bytes.NewReader(wb.Bytes())); err != nil {
+			logrus.WithFields(logrus.Fields{"key": key, "tier": i + 1, "error": err}).Warn("could not migrate key to primary")
+		} else {
+			logrus.WithFields(logrus.Fields{"key": key, "tier": i + 1}).Info("migrated key to primary")
+		}
+		_, err = w.Write(wb.Bytes())
+		return err
+	}
+	return ErrNotFound
+}
+
+// ReadFrom reads data from r and stores it under key on the primary engine
+func (e *TieredEngine) ReadFrom(key string, r io.Reader) error {
+	return e.primary.ReadFrom(key, r)
+}
+
+// Delete removes key from every tier so a fallback copy cannot resurface
+func (e *TieredEngine) Delete(key string) error {
+	found := false
+	for _, en := range append([]Engine{e.primary}, e.fallbacks...) {
+		err := en.Delete(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List calls fn for every key held by any tier beginning with prefix
+func (e *TieredEngine) List(prefix string, fn func(key string) error) error {
+	return listEngines(prefix, fn, append([]Engine{e.primary}, e.fallbacks...)...)
+}
@@ -0,0 +1,47 @@
+package ops
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTieredEngine(t *testing.T) {
+	dir := tempDir(t)
+	testEngine(t, NewTieredEngine(NewLocalFile(filepath.Join(dir, "primary")), NewLocalFile(filepath.Join(dir, "fallback"))))
+}
+
+func TestTieredFallback(t *testing.T) {
+	dir := tempDir(t)
+	primary, fallback := NewLocalFile(filepath.Join(dir, "primary")), NewLocalFile(filepath.Join(dir, "fallback"))
+	if err := fallback.ReadFrom("old", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	e := NewTieredEngine(primary, fallback)
+	var b bytes.Buffer
+	if err := e.WriteTo("old", &b); err != nil || b.String() != "old" {
+		t.Fatalf("reading from the fallback: %q, %v", b.String(), err)
+	}
+	if err := primary.WriteTo("old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("copied to the primary without Migrate: %v", err)
+	}
+
+	e.Migrate = true
+	b.Reset()
+	if err := e.WriteTo("old", &b); err != nil || b.String() != "old" {
+		t.Fatalf("reading from the fallback: %q, %v", b.String(), err)
+	}
+	b.Reset()
+	if err := primary.WriteTo("old", &b); err != nil || b.String() != "old" {
+		t.Fatalf("primary holds %q, %v after migrating", b.String(), err)
+	}
+
+	// deletes reach every tier so no copy resurfaces
+	if err := e.Delete("old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteTo("old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading a deleted key: got %v, want ErrNotFound", err)
+	}
+}
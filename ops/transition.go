@@ -0,0 +1,547 @@
+package ops
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tierIndexPrefix holds where each object of a TransitionEngine lives
+const tierIndexPrefix = SystemPrefix + "tiers/"
+
+// errChanged is returned when an object changes while being moved
+var errChanged = errors.New("object changed while being moved")
+
+// TransitionRule moves the objects below Prefix to the tier named Tier once
+// they are older than After
+type TransitionRule struct {
+	Prefix string
+	After  time.Duration
+	Tier   string
+}
+
+// tierEntry is the index entry of an object, recording the tier holding it
+// and when it was stored, which moving it does not change
+type tierEntry struct {
+	Tier   string    `json:"tier"`
+	Stored time.Time `json:"stored"`
+}
+
+// TransitionEngine writes objects to its first tier and lets a Transitioner
+// move them down to the later, cheaper tiers as they age. An index records
+// the tier holding each object so reads go straight to it, wherever the
+// object has been moved.
+type TransitionEngine struct {
+	names []string
+	tiers map[string]Engine
+	index Engine
+	rules []TransitionRule
+	locks keyLocks
+}
+
+// NewTransitionEngine creates a TransitionEngine keeping its index on index.
+// Tiers and rules should be added before the engine is used.
+func NewTransitionEngine(index Engine) *TransitionEngine {
+	return &TransitionEngine{tiers: map[string]Engine{}, index: index}
+}
+
+// AddTier adds the tier name after the tiers already added. Objects are
+// written to the first tier.
+func (e *TransitionEngine) AddTier(name string, en Engine) {
+	e.names = append(e.names, name)
+	e.tiers[name] = en
+}
+
+// Handle moves the keys matching pattern to tier once they are older than
+// after. Patterns are written as for Router.Handle. Of the rules for the
+// longest prefix matching a key, the one with the longest age reached picks
+// its tier.
+func (e *TransitionEngine) Handle(pattern string, after time.Duration, tier string) error {
+	if _, ok := e.tiers[tier]; !ok {
+		return fmt.Errorf("unknown tier %s", tier)
+	}
+	prefix := strings.TrimSuffix(strings.TrimPrefix(pattern, "/"), "*")
+	e.rules = append(e.rules, TransitionRule{Prefix: prefix, After: after, Tier: tier})
+	return nil
+}
+
+// Tiers returns the names of the tiers, first tier first
+func (e *TransitionEngine) Tiers() []string {
+	return append([]string(nil), e.names...)
+}
+
+// WriteTo reads key from the tier holding it and writes the bytes to w
+func (e *TransitionEngine) WriteTo(key string, w io.Writer) error {
+	if strings.HasPrefix(key, SystemPrefix) {
+		return e.first().WriteTo(key, w)
+	}
+	entry, _, err := e.locate(key)
+	if err != nil {
+		return err
+	}
+	// the index may be behind an object moved by another process
+	for _, name := range e.order(entry.Tier) {
+		err = e.tiers[name].WriteTo(key, w)
+		if err != ErrNotFound {
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+// ReadFrom reads data from r and stores it under key on the first tier,
+// removing any copy held by a later tier
+func (e *TransitionEngine) ReadFrom(key string, r io.Reader) error {
+	if strings.HasPrefix(key, SystemPrefix) {
+		return e.first().ReadFrom(key, r)
+	}
+	defer e.locks.lock(key)()
+
+	old, found, err := e.locate(key)
+	if err != nil {
+		return err
+	}
+	moved := found && old.Tier != e.names[0]
+	if moved {
+		// reads fall through to the old copy until the new one is indexed
+		if err = e.index.Delete(tierIndexPrefix + key); err != nil && err != ErrNotFound {
+			return err
+		}
+	}
+	if err = e.first().ReadFrom(key, r); err != nil {
+		return err
+	}
+	if err = e.setTier(key, tierEntry{Tier: e.names[0], Stored: time.Now().UTC()}); err != nil {
+		return err
+	}
+	if moved {
+		if err = e.tiers[old.Tier].Delete(key); err != nil && err != ErrNotFound {
+			logrus.WithFields(logrus.Fields{"key": key, "tier": old.Tier, "error": err}).Warn("could not remove replaced copy")
+		}
+	}
+	return nil
+}
+
+// Delete removes key from every tier so no copy can resurface
+func (e *TransitionEngine) Delete(key string) error {
+	if strings.HasPrefix(key, SystemPrefix) {
+		return e.first().Delete(key)
+	}
+	defer e.locks.lock(key)()
+
+	found := false
+	for _, name := range e.names {
+		err := e.tiers[name].Delete(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if err := e.index.Delete(tierIndexPrefix + key); err != nil && err != ErrNotFound {
+		return err
+	}
+	if !found {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// List calls fn for every key held by any tier beginning with prefix
+func (e *TransitionEngine) List(prefix string, fn func(key string) error) error {
+	engines := make([]Engine, 0, len(e.names))
+	for _, name := range e.names {
+		engines = append(engines, e.tiers[name])
+	}
+	return listEngines(prefix, fn, engines...)
+}
+
+// Stat describes key, naming the tier holding it. The modification time is
+// when the object was stored rather than when it was last moved.
+func (e *TransitionEngine) Stat(key string) (*ObjectInfo, error) {
+	if strings.HasPrefix(key, SystemPrefix) {
+		return StatEngine(e.first(), key)
+	}
+	entry, _, err := e.locate(key)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range e.order(entry.Tier) {
+		info, err := StatEngine(e.tiers[name], key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		info.Tier = name
+		if name == entry.Tier && !entry.Stored.IsZero() {
+			info.Modified = entry.Stored
+		}
+		return info, nil
+	}
+	return nil, ErrNotFound
+}
+
+// first returns the tier objects are written to
+func (e *TransitionEngine) first() Engine {
+	return e.tiers[e.names[0]]
+}
+
+// locate reads the index entry of key, reporting whether there was one.
+// Objects without an entry, or whose entry names a tier no longer
+// configured, are looked for on every tier in turn.
+func (e *TransitionEngine) locate(key string) (tierEntry, bool, error) {
+	var b bytes.Buffer
+	err := e.index.WriteTo(tierIndexPrefix+key, &b)
+	if err == ErrNotFound {
+		return tierEntry{Tier: e.names[0]}, false, nil
+	}
+	if err != nil {
+		return tierEntry{}, false, err
+	}
+	var entry tierEntry
+	if err = json.Unmarshal(b.Bytes(), &entry); err != nil {
+		return tierEntry{}, false, fmt.Errorf("corrupt tier index for %s: %v", key, err)
+	}
+	if _, ok := e.tiers[entry.Tier]; !ok {
+		return tierEntry{Tier: e.names[0]}, false, nil
+	}
+	return entry, true, nil
+}
+
+// setTier writes the index entry of key
+func (e *TransitionEngine) setTier(key string, entry tierEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return e.index.ReadFrom(tierIndexPrefix+key, bytes.NewReader(data))
+}
+
+// order returns the tier names with tier first
+func (e *TransitionEngine) order(tier string) []string {
+	names := []string{tier}
+	for _, name := range e.names {
+		if name != tier {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// rank returns the position of tier, the first tier being 0
+func (e *TransitionEngine) rank(tier string) int {
+	for i, name := range e.names {
+		if name == tier {
+			return i
+		}
+	}
+	return -1
+}
+
+// target returns the tier key belongs on at age, or an empty name if no
+// rule has been reached
+func (e *TransitionEngine) target(key string, age time.Duration) string {
+	longest := -1
+	for _, r := range e.rules {
+		if strings.HasPrefix(key, r.Prefix) && len(r.Prefix) > longest {
+			longest = len(r.Prefix)
+		}
+	}
+	var best *TransitionRule
+	for i, r := range e.rules {
+		if len(r.Prefix) != longest || !strings.HasPrefix(key, r.Prefix) || r.After > age {
+			continue
+		}
+		if best == nil || r.After > best.After {
+			best = &e.rules[i]
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Tier
+}
+
+// move copies key from the tier in entry to tier to, verifying the copy,
+// then points the index at it and removes the original. errChanged is
+// returned if key has been written or moved meanwhile.
+func (e *TransitionEngine) move(key string, entry tierEntry, to string, bandwidth int64) (int64, error) {
+	defer e.locks.lock(key)()
+
+	cur, found, err := e.locate(key)
+	if err != nil {
+		return 0, err
+	}
+	if found && (cur.Tier != entry.Tier || !cur.Stored.Equal(entry.Stored)) {
+		return 0, errChanged
+	}
+	src, dst := e.tiers[entry.Tier], e.tiers[to]
+	m := &Migrator{src: src, dst: dst, Bandwidth: bandwidth, Verify: true}
+	n, err := m.migrate(key)
+	if err != nil {
+		dst.Delete(key)
+		return 0, err
+	}
+	if err = e.setTier(key, tierEntry{Tier: to, Stored: entry.Stored}); err != nil {
+		dst.Delete(key)
+		return 0, err
+	}
+	if err = src.Delete(key); err != nil && err != ErrNotFound {
+		// the copy left behind is removed by the next transition
+		logrus.WithFields(logrus.Fields{"key": key, "tier": entry.Tier, "error": err}).Warn("could not remove moved copy")
+	}
+	return n, nil
+}
+
+// removeStale removes the copy of key held by tier if the index places the
+// object on another tier
+func (e *TransitionEngine) removeStale(key string, tier string) (bool, error) {
+	defer e.locks.lock(key)()
+
+	entry, found, err := e.locate(key)
+	if err != nil || !found || entry.Tier == tier {
+		return false, err
+	}
+	if err = e.tiers[tier].Delete(key); err != nil && err != ErrNotFound {
+		return false, err
+	}
+	return true, nil
+}
+
+// Transitioner moves the objects of a TransitionEngine down to the tier
+// their age calls for. Progress is saved to a state file so an interrupted
+// transition resumes where it left off. Objects which fail to move are
+// retried by the next run.
+type Transitioner struct {
+	engine *TransitionEngine
+
+	// Rate limits the number of objects moved per second. Zero is unlimited.
+	Rate float64
+	// Bandwidth limits the bytes moved per second. Zero is unlimited.
+	Bandwidth int64
+	// State is the path of the progress file. No progress is kept if empty.
+	// It is locked while a transition runs.
+	State string
+	// DryRun only reports the objects which would be moved
+	DryRun bool
+	// Report is called for every object moved, with the error if it failed
+	Report func(key string, from string, to string, err error)
+
+	// unlock releases the state file held by TransitionLoop
+	unlock func()
+}
+
+// TransitionProgress records how far a transition has come
+type TransitionProgress struct {
+	Done    []string `json:"done"`
+	Tier    string   `json:"tier"`
+	Last    string   `json:"last"`
+	Scanned int      `json:"scanned"`
+	Moved   int      `json:"moved"`
+	Bytes   int64    `json:"bytes"`
+	Failed  int      `json:"failed"`
+	Removed int      `json:"removed"`
+}
+
+// DefaultTransitionState is the progress file of a transition unless
+// another is given
+const DefaultTransitionState = ".objstore-transition.json"
+
+// NewTransitioner creates a Transitioner for e
+func NewTransitioner(e *TransitionEngine) *Transitioner {
+	return &Transitioner{engine: e, State: DefaultTransitionState}
+}
+
+// Run scans every tier and moves the objects which have aged past a rule.
+// Copies left behind by an interrupted move are removed. An error is
+// returned if any object failed to move, or if another run holds the state
+// file.
+func (t *Transitioner) Run() (*TransitionProgress, error) {
+	p := &TransitionProgress{}
+	state := t.State
+	if t.DryRun {
+		state = ""
+	}
+	if t.unlock == nil {
+		unlock, err := lockState(state)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	found, err := loadState(state, p)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		logrus.WithFields(logrus.Fields{"tier": p.Tier, "last": p.Last}).Info("resuming transition")
+	}
+
+	var throttle <-chan time.Time
+	if t.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / t.Rate))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	e := t.engine
+	for _, name := range e.names {
+		if contains(p.Done, name) {
+			continue
+		}
+		lister, ok := e.tiers[name].(Lister)
+		if !ok {
+			return p, fmt.Errorf("tier %s: %v", name, ErrNoList)
+		}
+		if p.Tier != name {
+			p.Tier, p.Last = name, ""
+		}
+		logrus.WithField("tier", name).Info("transitioning tier")
+
+		err = lister.List("", func(key string) error {
+			if strings.HasPrefix(key, SystemPrefix) || key <= p.Last {
+				return nil
+			}
+			p.Scanned++
+			t.transition(p, name, key, throttle)
+			p.Last = key
+			if p.Scanned%checkpointEvery == 0 {
+				logrus.WithFields(logrus.Fields{"tier": name, "scanned": p.Scanned, "moved": p.Moved}).Info("transition progress")
+				return saveState(state, p)
+			}
+			return nil
+		})
+		if err != nil {
+			saveState(state, p)
+			return p, err
+		}
+		p.Done = append(p.Done, name)
+		p.Tier, p.Last = "", ""
+		if err = saveState(state, p); err != nil {
+			return p, err
+		}
+	}
+
+	if state != "" {
+		os.Remove(state)
+	}
+	if p.Failed > 0 {
+		return p, fmt.Errorf("%d objects failed to move", p.Failed)
+	}
+	return p, nil
+}
+
+// transition moves key off tier if its age calls for a later tier
+func (t *Transitioner) transition(p *TransitionProgress, tier string, key string, throttle <-chan time.Time) {
+	e := t.engine
+	entry, found, err := e.locate(key)
+	if err == nil && found && entry.Tier != tier {
+		if t.DryRun {
+			return
+		}
+		removed, err := e.removeStale(key, tier)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{"key": key, "tier": tier, "error": err}).Warn("could not remove stale copy")
+		} else if removed {
+			p.Removed++
+		}
+		return
+	}
+	if err == nil && entry.Stored.IsZero() {
+		// stored before the index, so aged by its modification time
+		var info *ObjectInfo
+		if info, err = StatEngine(e.tiers[tier], key); err == nil {
+			entry.Stored = info.Modified
+		}
+	}
+	if err != nil {
+		t.fail(p, key, tier, "", err)
+		return
+	}
+	entry.Tier = tier
+	if entry.Stored.IsZero() {
+		return
+	}
+	to := e.target(key, time.Since(entry.Stored))
+	if to == "" || e.rank(to) <= e.rank(tier) {
+		return
+	}
+
+	if throttle != nil && !t.DryRun {
+		<-throttle
+	}
+	var n int64
+	if !t.DryRun {
+		n, err = e.move(key, entry, to, t.Bandwidth)
+	}
+	if err == errChanged {
+		return
+	}
+	if err != nil {
+		t.fail(p, key, tier, to, err)
+		return
+	}
+	p.Moved++
+	p.Bytes += n
+	logrus.WithFields(logrus.Fields{"key": key, "from": tier, "to": to}).Debug("moved key")
+	if t.Report != nil {
+		t.Report(key, tier, to, nil)
+	}
+}
+
+func (t *Transitioner) fail(p *TransitionProgress, key string, from string, to string, err error) {
+	p.Failed++
+	logrus.WithFields(logrus.Fields{"key": key, "from": from, "to": to, "error": err}).Warn("failed to move key")
+	if t.Report != nil {
+		t.Report(key, from, to, err)
+	}
+}
+
+// TransitionLoop calls Run every interval. It never returns.
+//
+// The state file stays locked for as long as the loop runs. A transition
+// run by another process cannot exclude the writes of this one, and could
+// point the index at a copy older than an object just written, so it
+// refuses to start instead.
+func (t *Transitioner) TransitionLoop(interval time.Duration) {
+	t.hold()
+	for range time.Tick(interval) {
+		if !t.hold() {
+			continue
+		}
+		p, err := t.Run()
+		if err != nil {
+			logrus.WithError(err).Error("transition stopped")
+			continue
+		}
+		if p.Moved > 0 || p.Removed > 0 {
+			logrus.WithFields(logrus.Fields{"scanned": p.Scanned, "moved": p.Moved, "bytes": p.Bytes}).Info("transitioned objects")
+		}
+	}
+}
+
+// hold locks the state file for the rest of the process, reporting whether
+// it is held
+func (t *Transitioner) hold() bool {
+	if t.unlock != nil {
+		return true
+	}
+	unlock, err := lockState(t.State)
+	if err != nil {
+		logrus.WithError(err).Error("could not lock transition state")
+		return false
+	}
+	t.unlock = unlock
+	return true
+}
@@ -0,0 +1,127 @@
+package ops
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransitionEngine(t *testing.T) {
+	dir := tempDir(t)
+	e := NewTransitionEngine(NewLocalFile(filepath.Join(dir, "hot")))
+	e.AddTier("hot", NewLocalFile(filepath.Join(dir, "hot")))
+	e.AddTier("cold", NewLocalFile(filepath.Join(dir, "cold")))
+	testEngine(t, e)
+}
+
+func TestTransition(t *testing.T) {
+	dir := tempDir(t)
+	hot, cold := NewLocalFile(filepath.Join(dir, "hot")), NewLocalFile(filepath.Join(dir, "cold"))
+	e := NewTransitionEngine(hot)
+	e.AddTier("hot", hot)
+	e.AddTier("cold", cold)
+	if err := e.Handle("/logs/*", time.Hour, "cold"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Handle("/logs/*", time.Hour, "missing"); err == nil {
+		t.Fatal("handling a missing tier: got no error")
+	}
+	for _, key := range []string{"logs/old", "logs/new", "other"} {
+		if err := e.ReadFrom(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	aged := time.Now().Add(-2 * time.Hour).UTC()
+	for _, key := range []string{"logs/old", "other"} {
+		if err := e.setTier(key, tierEntry{Tier: "hot", Stored: aged}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr := NewTransitioner(e)
+	tr.State = filepath.Join(dir, "transition.json")
+	p, err := tr.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the object moved is scanned again on the tier it was moved to
+	if p.Moved != 1 || p.Scanned != 4 {
+		t.Fatalf("moved %d of %d scanned, want 1 of 4", p.Moved, p.Scanned)
+	}
+	if err := hot.WriteTo("logs/old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("moved object left on the first tier: %v", err)
+	}
+	info, err := e.Stat("logs/old")
+	if err != nil || info.Tier != "cold" || !info.Modified.Equal(aged) {
+		t.Fatalf("stat of a moved object: %+v, %v", info, err)
+	}
+	var b bytes.Buffer
+	if err := e.WriteTo("logs/old", &b); err != nil || b.String() != "logs/old" {
+		t.Fatalf("reading a moved object: %q, %v", b.String(), err)
+	}
+	for _, key := range []string{"logs/new", "other"} {
+		if info, err := e.Stat(key); err != nil || info.Tier != "hot" {
+			t.Fatalf("stat of %s: %+v, %v", key, info, err)
+		}
+	}
+
+	// a copy left by an interrupted move is removed
+	if err := hot.ReadFrom("logs/old", strings.NewReader("logs/old")); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = tr.Run(); err != nil || p.Removed != 1 || p.Moved != 0 {
+		t.Fatalf("second run: %+v, %v", p, err)
+	}
+	if err := hot.WriteTo("logs/old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("stale copy left on the first tier: %v", err)
+	}
+
+	// writing again puts the object back on the first tier
+	if err := e.ReadFrom("logs/old", strings.NewReader("rewritten")); err != nil {
+		t.Fatal(err)
+	}
+	if err := cold.WriteTo("logs/old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("replaced copy left on a later tier: %v", err)
+	}
+	if info, err := e.Stat("logs/old"); err != nil || info.Tier != "hot" {
+		t.Fatalf("stat of a rewritten object: %+v, %v", info, err)
+	}
+
+	// an object written while it was being moved stays
+	if _, err := e.move("logs/old", tierEntry{Tier: "hot", Stored: aged}, "cold", 0); err != errChanged {
+		t.Fatalf("moving a rewritten object: got %v, want errChanged", err)
+	}
+
+	if err := e.Delete("logs/old"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteTo("logs/old", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading a deleted object: got %v, want ErrNotFound", err)
+	}
+}
+
+func TestTransitionLocked(t *testing.T) {
+	dir := tempDir(t)
+	e := NewTransitionEngine(NewLocalFile(filepath.Join(dir, "hot")))
+	e.AddTier("hot", NewLocalFile(filepath.Join(dir, "hot")))
+	e.AddTier("cold", NewLocalFile(filepath.Join(dir, "cold")))
+
+	// a server holds the state while it runs
+	serving := NewTransitioner(e)
+	serving.State = filepath.Join(dir, "transition.json")
+	if !serving.hold() {
+		t.Fatal("could not hold the state")
+	}
+	defer serving.unlock()
+	if _, err := serving.Run(); err != nil {
+		t.Fatalf("running while holding the state: %v", err)
+	}
+
+	tool := NewTransitioner(e)
+	tool.State = serving.State
+	if _, err := tool.Run(); err == nil {
+		t.Fatal("running while the state is held: got no error")
+	}
+}
@@ -0,0 +1,166 @@
+package ops
+
+import (
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/mshindle/objstore/api"
+	"github.com/sirupsen/logrus"
+)
+
+// trashPrefix holds the objects moved aside by deletes
+const trashPrefix = SystemPrefix + "trash/"
+
+// ErrNoTrash is returned when trash is asked of storage which does not keep
+// one
+var ErrNoTrash = api.ErrNoTrash
+
+// ErrExists is returned when restoring over an object which exists
+var ErrExists = api.ErrExists
+
+// TrashEntry describes a deleted object held in the trash
+type TrashEntry = api.TrashEntry
+
+// TrashEngine is implemented by engines keeping a trash of their own, such
+// as a remote objstore
+type TrashEngine = api.TrashEngine
+
+// trash moves key into the trash. Expects the trash to be enabled.
+func (s *Storage) trash(key string) error {
+	err := copyKey(s.engine, trashKey(key, newVersionID()), s.engine, key)
+	if err != nil {
+		return err
+	}
+	return s.engine.Delete(key)
+}
+
+// ListTrash calls fn for every trashed object whose key begins with
+// prefix, oldest first for each key
+func (s *Storage) ListTrash(prefix string, fn func(TrashEntry) error) error {
+	if s.retention <= 0 {
+		if t, ok := s.engine.(TrashEngine); ok {
+			return t.ListTrash(prefix, fn)
+		}
+		return ErrNoTrash
+	}
+	l, ok := s.engine.(Lister)
+	if !ok {
+		return ErrNoList
+	}
+	return l.List(trashPrefix+prefix, func(name string) error {
+		key, id := path.Split(strings.TrimPrefix(name, trashPrefix))
+		key = strings.TrimSuffix(key, "/")
+		entry := TrashEntry{Key: key, ID: id, Deleted: versionTime(id, time.Time{})}
+		entry.Expires = entry.Deleted.Add(s.retention)
+		info, err := StatEngine(s.engine, name)
+		if err == ErrNotFound {
+			// purged meanwhile
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry.Size = info.Size
+		return fn(entry)
+	})
+}
+
+// Undelete moves the trashed object id back under key. An empty id picks
+// the latest object deleted under key. ErrExists is returned if an object
+// has been stored under key since.
+func (s *Storage) Undelete(key string, id string) error {
+	if s.retention <= 0 {
+		if t, ok := s.engine.(TrashEngine); ok {
+			return t.Undelete(key, id)
+		}
+		return ErrNoTrash
+	}
+	if id == "" {
+		err := s.ListTrash(key, func(e TrashEntry) error {
+			if e.Key == key {
+				id = e.ID
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if id == "" {
+			return ErrNotFound
+		}
+	}
+	if strings.Contains(id, "/") {
+		return ErrNotFound
+	}
+	if _, err := StatEngine(s.engine, key); err != ErrNotFound {
+		if err == nil {
+			err = ErrExists
+		}
+		return err
+	}
+
+	name := trashKey(key, id)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(s.engine.WriteTo(name, pw))
+	}()
+	err := s.Store(key, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if err != nil {
+		return err
+	}
+	return s.engine.Delete(name)
+}
+
+// Purge removes the trashed objects deleted before the retention period,
+// returning how many were removed
+func (s *Storage) Purge() (int, error) {
+	if s.retention <= 0 {
+		return 0, ErrNoTrash
+	}
+	l, ok := s.engine.(Lister)
+	if !ok {
+		return 0, ErrNoList
+	}
+	cutoff := time.Now().Add(-s.retention)
+	// collect the expired objects first so the listing is not changed
+	// under us
+	var expired []string
+	err := l.List(trashPrefix, func(name string) error {
+		if versionTime(path.Base(name), cutoff).Before(cutoff) {
+			expired = append(expired, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, name := range expired {
+		if err = s.engine.Delete(name); err != nil && err != ErrNotFound {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// PurgeLoop calls Purge every interval. It never returns.
+func (s *Storage) PurgeLoop(interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := s.Purge()
+		if err != nil {
+			logrus.WithError(err).Error("could not purge trash")
+			continue
+		}
+		if n > 0 {
+			logrus.WithField("purged", n).Info("purged expired trash")
+		}
+	}
+}
+
+func trashKey(key string, id string) string {
+	return trashPrefix + key + "/" + id
+}
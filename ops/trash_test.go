@@ -0,0 +1,130 @@
+package ops
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTrash(t *testing.T) {
+	engine := NewLocalFile(tempDir(t))
+	s := NewStorage(&Config{Engine: engine, Trash: time.Hour, Checksums: true})
+	for _, body := range []string{"first", "second"} {
+		if err := s.Store("key", strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Delete("key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Retrieve("key", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading a trashed key: got %v, want ErrNotFound", err)
+	}
+	var keys []string
+	s.List("", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if len(keys) != 0 {
+		t.Fatalf("trash listed as objects: %q", keys)
+	}
+	entries := listTrash(t, s, "")
+	if len(entries) != 2 || entries[0].Key != "key" || entries[1].Size != int64(len("second")) {
+		t.Fatalf("trash holds %+v", entries)
+	}
+	if !entries[0].Expires.Equal(entries[0].Deleted.Add(time.Hour)) {
+		t.Fatalf("trashed at %v expires at %v", entries[0].Deleted, entries[0].Expires)
+	}
+
+	// an object stored since is not replaced
+	if err := s.Store("key", strings.NewReader("third")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Undelete("key", ""); err != ErrExists {
+		t.Fatalf("undeleting over an object: got %v, want ErrExists", err)
+	}
+	if err := s.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the latest deleted is undeleted unless another is picked
+	if err := s.Undelete("key", ""); err != nil {
+		t.Fatal(err)
+	}
+	checkBody(t, s, "key", "third")
+	if err := s.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Undelete("key", entries[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	checkBody(t, s, "key", "first")
+	if err := s.Undelete("key", "missing"); err != ErrExists {
+		t.Fatalf("undeleting over an object: got %v, want ErrExists", err)
+	}
+	if err := s.Undelete("other", ""); err != ErrNotFound {
+		t.Fatalf("undeleting a key never deleted: got %v, want ErrNotFound", err)
+	}
+	if err := s.Undelete("key/"+entries[1].ID, "../"+entries[1].ID); err != ErrNotFound {
+		t.Fatalf("undeleting by a path: got %v, want ErrNotFound", err)
+	}
+	if n := len(listTrash(t, s, "key")); n != 2 {
+		t.Fatalf("trash holds %d objects after undeleting, want 2", n)
+	}
+
+	// nothing is purged before the retention has passed
+	if n, err := s.Purge(); err != nil || n != 0 {
+		t.Fatalf("purged %d, %v", n, err)
+	}
+	expired := NewStorage(&Config{Engine: engine, Trash: time.Nanosecond})
+	if n, err := expired.Purge(); err != nil || n != 2 {
+		t.Fatalf("purged %d, %v, want 2", n, err)
+	}
+	if n := len(listTrash(t, s, "")); n != 0 {
+		t.Fatalf("trash holds %d objects after purging", n)
+	}
+	checkBody(t, s, "key", "first")
+}
+
+func TestNoTrash(t *testing.T) {
+	s := NewStorage(&Config{Engine: NewLocalFile(tempDir(t))})
+	if err := s.Store("key", strings.NewReader("body")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ListTrash("", func(TrashEntry) error { return nil }); err != ErrNoTrash {
+		t.Fatalf("listing storage without a trash: got %v, want ErrNoTrash", err)
+	}
+	if err := s.Undelete("key", ""); err != ErrNoTrash {
+		t.Fatalf("undeleting from storage without a trash: got %v, want ErrNoTrash", err)
+	}
+}
+
+// listTrash returns the trashed objects whose key begins with prefix
+func listTrash(t *testing.T, s *Storage, prefix string) []TrashEntry {
+	t.Helper()
+	var entries []TrashEntry
+	err := s.ListTrash(prefix, func(entry TrashEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// checkBody checks the object under key holds body
+func checkBody(t *testing.T, s *Storage, key string, body string) {
+	t.Helper()
+	var b bytes.Buffer
+	if err := s.Retrieve(key, &b); err != nil {
+		t.Fatalf("reading %s: %v", key, err)
+	}
+	if b.String() != body {
+		t.Fatalf("%s holds %q, want %q", key, b.String(), body)
+	}
+}
@@ -0,0 +1,146 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// Integrity is what an upload is expected to hold. Checks left unset are
+// skipped.
+type Integrity struct {
+	// Size is the length of the upload, or -1 if unknown
+	Size int64
+	// MD5 is the md5 digest of the upload
+	MD5 []byte
+	// Sha256 is the sha256 digest of the upload
+	Sha256 []byte
+}
+
+// IntegrityError is returned when an upload does not match what was expected
+type IntegrityError struct {
+	Check    string
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("upload failed its %s check: expected %s, got %s", e.Check, e.Expected, e.Actual)
+}
+
+// IntegrityEngine is implemented by engines whose backing store can check
+// an upload itself, such as by its md5. The reader still fails if the
+// upload does not match.
+type IntegrityEngine interface {
+	ReadFromVerified(key string, r io.Reader, want *Integrity) error
+}
+
+// VerifyingReader checks what is read through it against an Integrity. A
+// mismatch is returned by the read which would have returned io.EOF, or as
+// soon as more bytes than expected are read, so an engine sees a failed
+// read rather than the end of a good upload.
+type VerifyingReader struct {
+	r    io.Reader
+	want *Integrity
+	md5  hash.Hash
+	sha  hash.Hash
+	n    int64
+	err  error
+}
+
+// NewVerifyingReader creates a reader checking r against want
+func NewVerifyingReader(r io.Reader, want *Integrity) *VerifyingReader {
+	v := &VerifyingReader{r: r, want: want}
+	if len(want.MD5) > 0 {
+		v.md5 = md5.New()
+	}
+	if len(want.Sha256) > 0 {
+		v.sha = sha256.New()
+	}
+	return v
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		return 0, v.err
+	}
+	n, err := v.r.Read(p)
+	if n > 0 {
+		v.n += int64(n)
+		if v.md5 != nil {
+			v.md5.Write(p[:n])
+		}
+		if v.sha != nil {
+			v.sha.Write(p[:n])
+		}
+		if v.want.Size >= 0 && v.n > v.want.Size {
+			v.err = v.mismatch("length", v.want.Size, v.n)
+			return 0, v.err
+		}
+	}
+	switch {
+	case err == io.EOF:
+		if v.err = v.check(); v.err != nil {
+			return n, v.err
+		}
+	case err != nil:
+		v.err = err
+	}
+	return n, err
+}
+
+// Err returns why the upload failed, or nil if it has been read in full and
+// matched
+func (v *VerifyingReader) Err() error {
+	return v.err
+}
+
+// check compares the complete upload with what was expected
+func (v *VerifyingReader) check() error {
+	if v.want.Size >= 0 && v.n != v.want.Size {
+		return v.mismatch("length", v.want.Size, v.n)
+	}
+	if v.md5 != nil {
+		if sum := v.md5.Sum(nil); !bytes.Equal(sum, v.want.MD5) {
+			return &IntegrityError{Check: "md5", Expected: hex.EncodeToString(v.want.MD5), Actual: hex.EncodeToString(sum)}
+		}
+	}
+	if v.sha != nil {
+		if sum := v.sha.Sum(nil); !bytes.Equal(sum, v.want.Sha256) {
+			return &IntegrityError{Check: "sha256", Expected: hex.EncodeToString(v.want.Sha256), Actual: hex.EncodeToString(sum)}
+		}
+	}
+	return nil
+}
+
+func (v *VerifyingReader) mismatch(check string, want int64, got int64) error {
+	return &IntegrityError{Check: check, Expected: fmt.Sprint(want), Actual: fmt.Sprint(got)}
+}
+
+// readFromVerified stores the upload r under key in e, failing if it does not
+// match want. An engine which stores the object despite the failed read has
+// it removed again.
+func readFromVerified(e Engine, key string, r io.Reader, want *Integrity) error {
+	v := NewVerifyingReader(r, want)
+	err := passVerified(e, key, v, want)
+	if verr := v.Err(); verr != nil {
+		if err == nil {
+			e.Delete(key)
+		}
+		return verr
+	}
+	return err
+}
+
+// passVerified hands r on to e, letting e check it against want if it can.
+// Engines wrapping another use it so the engine below still sees want.
+func passVerified(e Engine, key string, r io.Reader, want *Integrity) error {
+	if ie, ok := e.(IntegrityEngine); ok && want != nil {
+		return ie.ReadFromVerified(key, r, want)
+	}
+	return e.ReadFrom(key, r)
+}
@@ -0,0 +1,59 @@
+package ops
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestVerifyingReader(t *testing.T) {
+	body := "the upload"
+	md5sum, shasum := md5.Sum([]byte(body)), sha256.Sum256([]byte(body))
+	tests := []struct {
+		name  string
+		want  Integrity
+		check string
+	}{
+		{"matching", Integrity{Size: int64(len(body)), MD5: md5sum[:], Sha256: shasum[:]}, ""},
+		{"unknown size", Integrity{Size: -1, Sha256: shasum[:]}, ""},
+		{"short", Integrity{Size: int64(len(body)) + 1}, "length"},
+		{"long", Integrity{Size: int64(len(body)) - 1}, "length"},
+		{"md5", Integrity{Size: -1, MD5: make([]byte, md5.Size)}, "md5"},
+		{"sha256", Integrity{Size: -1, Sha256: make([]byte, sha256.Size)}, "sha256"},
+	}
+	for _, tt := range tests {
+		v := NewVerifyingReader(strings.NewReader(body), &tt.want)
+		_, err := ioutil.ReadAll(v)
+		if tt.check == "" {
+			if err != nil || v.Err() != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		ierr, ok := err.(*IntegrityError)
+		if !ok || ierr.Check != tt.check || v.Err() != err {
+			t.Errorf("%s: got %v, want a failed %s check", tt.name, err, tt.check)
+		}
+	}
+}
+
+func TestStoreVerified(t *testing.T) {
+	engine := NewLocalFile(tempDir(t))
+	s := NewStorage(&Config{Engine: engine})
+	shasum := sha256.Sum256([]byte("good"))
+	if err := s.StoreVerified("key", strings.NewReader("good"), &Integrity{Size: 4, Sha256: shasum[:]}); err != nil {
+		t.Fatal(err)
+	}
+	// a failed upload leaves nothing behind
+	err := s.StoreVerified("bad", strings.NewReader("tampered"), &Integrity{Size: -1, Sha256: shasum[:]})
+	if _, ok := err.(*IntegrityError); !ok {
+		t.Fatalf("storing a tampered upload: got %v, want an IntegrityError", err)
+	}
+	if err := engine.WriteTo("bad", &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("tampered upload stored: %v", err)
+	}
+	checkBody(t, s, "key", "good")
+}
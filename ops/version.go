@@ -0,0 +1,364 @@
+package ops
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mshindle/objstore/api"
+)
+
+const (
+	versionsPrefix = SystemPrefix + "versions/"
+	headsPrefix    = SystemPrefix + "heads/"
+	markerSuffix   = ".deleted"
+)
+
+// NullVersion is the version of an object stored before versioning was
+// turned on
+const NullVersion = "null"
+
+// ErrNoVersions is returned when versions are asked of an engine which does
+// not keep them
+var ErrNoVersions = api.ErrNoVersions
+
+// VersionInfo describes a version of an object
+type VersionInfo = api.VersionInfo
+
+// Versioner is implemented by engines keeping the earlier versions of the
+// objects they hold
+type Versioner = api.Versioner
+
+// NativeVersioner is implemented by engines whose backing store can keep
+// versions itself once it is set up to
+type NativeVersioner interface {
+	Versioner
+	// Versioning reports whether the backing store keeps versions
+	Versioning() (bool, error)
+}
+
+// VersionedEngine keeps the previous version of an object whenever it is
+// overwritten or deleted, on any engine able to list its keys. The latest
+// version stays under its key, earlier versions and delete markers are kept
+// below the system prefix.
+type VersionedEngine struct {
+	engine   Engine
+	prefixes []string
+	locks    keyLocks
+}
+
+// NewVersionedEngine creates a VersionedEngine on top of e versioning the
+// keys beginning with any of prefixes, or every key if none are given.
+func NewVersionedEngine(e Engine, prefixes ...string) *VersionedEngine {
+	return &VersionedEngine{engine: e, prefixes: prefixes}
+}
+
+// WriteTo reads the latest version of key and writes the bytes to w
+func (e *VersionedEngine) WriteTo(key string, w io.Writer) error {
+	return e.engine.WriteTo(key, w)
+}
+
+// ReadFrom reads data from r and stores it as the latest version of key,
+// keeping the version it replaces
+func (e *VersionedEngine) ReadFrom(key string, r io.Reader) error {
+	return e.readFrom(key, r, nil)
+}
+
+// ReadFromVerified is ReadFrom passing want on to the engine below
+func (e *VersionedEngine) ReadFromVerified(key string, r io.Reader, want *Integrity) error {
+	return e.readFrom(key, r, want)
+}
+
+func (e *VersionedEngine) readFrom(key string, r io.Reader, want *Integrity) error {
+	if !e.versioned(key) {
+		return passVerified(e.engine, key, r, want)
+	}
+	defer e.locks.lock(key)()
+
+	old, err := e.archive(key)
+	if err != nil {
+		return err
+	}
+	// the new head is written before the data, so the id of the version
+	// replaced never names the new data. Should the data not be written
+	// the old head is put back.
+	if err = e.setHead(key, newVersionID()); err != nil {
+		e.unarchive(key, old)
+		return err
+	}
+	if err = passVerified(e.engine, key, r, want); err != nil {
+		if e.setHead(key, old) == nil {
+			e.unarchive(key, old)
+		}
+		return err
+	}
+	return nil
+}
+
+// Delete keeps the latest version of key and replaces it with a delete
+// marker
+func (e *VersionedEngine) Delete(key string) error {
+	if !e.versioned(key) {
+		return e.engine.Delete(key)
+	}
+	defer e.locks.lock(key)()
+
+	old, err := e.archive(key)
+	if err != nil {
+		return err
+	}
+	if old == "" {
+		return ErrNotFound
+	}
+	if err = e.engine.Delete(key); err != nil {
+		return err
+	}
+	marker := versionKey(key, newVersionID()) + markerSuffix
+	if err = e.engine.ReadFrom(marker, strings.NewReader("")); err != nil {
+		return err
+	}
+	return e.setHead(key, "")
+}
+
+// List calls fn for every key beginning with prefix
+func (e *VersionedEngine) List(prefix string, fn func(key string) error) error {
+	lister, ok := e.engine.(Lister)
+	if !ok {
+		return ErrNoList
+	}
+	return lister.List(prefix, fn)
+}
+
+// Stat describes the latest version of key
+func (e *VersionedEngine) Stat(key string) (*ObjectInfo, error) {
+	return StatEngine(e.engine, key)
+}
+
+// Versions returns the versions of key, newest first. Once key is deleted
+// its latest version is a delete marker.
+func (e *VersionedEngine) Versions(key string) ([]VersionInfo, error) {
+	lister, ok := e.engine.(Lister)
+	if !ok {
+		return nil, ErrNoList
+	}
+	var versions []VersionInfo
+	if info, err := StatEngine(e.engine, key); err == nil {
+		id, err := e.head(key)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, VersionInfo{ID: id, Size: info.Size, Modified: versionTime(id, info.Modified), Latest: true})
+	} else if err != ErrNotFound {
+		return nil, err
+	}
+
+	var earlier []VersionInfo
+	dir := versionsPrefix + key + "/"
+	err := lister.List(dir, func(name string) error {
+		id := strings.TrimPrefix(name, dir)
+		if strings.Contains(id, "/") {
+			// a version of a key below this one
+			return nil
+		}
+		if strings.HasSuffix(id, markerSuffix) {
+			id = strings.TrimSuffix(id, markerSuffix)
+			earlier = append(earlier, VersionInfo{ID: id, Modified: versionTime(id, time.Time{}), DeleteMarker: true})
+			return nil
+		}
+		info, err := StatEngine(e.engine, name)
+		if err != nil {
+			return err
+		}
+		earlier = append(earlier, VersionInfo{ID: id, Size: info.Size, Modified: versionTime(id, info.Modified)})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// ids sort by the time they were made and the null version is the
+	// oldest of all
+	sort.Slice(earlier, func(i, j int) bool {
+		if earlier[j].ID == NullVersion {
+			return earlier[i].ID != NullVersion
+		}
+		return earlier[i].ID > earlier[j].ID
+	})
+	if len(versions) == 0 && len(earlier) > 0 && earlier[0].DeleteMarker {
+		earlier[0].Latest = true
+	}
+	versions = append(versions, earlier...)
+	if len(versions) == 0 {
+		return nil, ErrNotFound
+	}
+	return versions, nil
+}
+
+// WriteVersion writes version id of key to w. Delete markers are not found.
+func (e *VersionedEngine) WriteVersion(key string, id string, w io.Writer) error {
+	if id == "" || strings.Contains(id, "/") {
+		return ErrNotFound
+	}
+	// the key is not replaced between finding its head and reading it, or
+	// the new data would be read as the version replaced
+	defer e.locks.lock(key)()
+	head, err := e.head(key)
+	if err != nil {
+		return err
+	}
+	if id == head {
+		err = e.engine.WriteTo(key, w)
+		// a deleted key has no head, yet its null version may be kept
+		if err != ErrNotFound {
+			return err
+		}
+	}
+	return e.engine.WriteTo(versionKey(key, id), w)
+}
+
+// versioned reports whether key keeps its versions
+func (e *VersionedEngine) versioned(key string) bool {
+	if strings.HasPrefix(key, SystemPrefix) {
+		return false
+	}
+	if len(e.prefixes) == 0 {
+		return true
+	}
+	for _, p := range e.prefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// head returns the id of the latest version of key. Objects stored before
+// versioning have the null version.
+func (e *VersionedEngine) head(key string) (string, error) {
+	var b strings.Builder
+	err := e.engine.WriteTo(headsPrefix+key, &b)
+	if err == ErrNotFound {
+		return NullVersion, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// archive copies the latest version of key below the system prefix and
+// returns its id, or an empty id if key does not exist. Expects key locked.
+func (e *VersionedEngine) archive(key string) (string, error) {
+	id, err := e.head(key)
+	if err != nil {
+		return "", err
+	}
+	err = copyKey(e.engine, versionKey(key, id), e.engine, key)
+	if err == ErrNotFound {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not keep version %s of %s: %v", id, key, err)
+	}
+	return id, nil
+}
+
+// unarchive removes the copy of version id of key made by archive, if any.
+// Expects key locked.
+func (e *VersionedEngine) unarchive(key string, id string) {
+	if id != "" {
+		e.engine.Delete(versionKey(key, id))
+	}
+}
+
+// setHead records id as the latest version of key. Without an id, or with
+// the null version, key is left without a head. Expects key locked.
+func (e *VersionedEngine) setHead(key string, id string) error {
+	if id == "" || id == NullVersion {
+		err := e.engine.Delete(headsPrefix + key)
+		if err == ErrNotFound {
+			err = nil
+		}
+		return err
+	}
+	return e.engine.ReadFrom(headsPrefix+key, strings.NewReader(id))
+}
+
+func versionKey(key string, id string) string {
+	return versionsPrefix + key + "/" + id
+}
+
+// newVersionID returns an id which sorts after every id made before it
+func newVersionID() string {
+	return fmt.Sprintf("%016x%s", time.Now().UnixNano(), randomSuffix()[:8])
+}
+
+// versionTime returns when the version id was made, or fallback for the
+// null version
+func versionTime(id string, fallback time.Time) time.Time {
+	if len(id) < 16 {
+		return fallback
+	}
+	nanos, err := strconv.ParseInt(id[:16], 16, 64)
+	if err != nil {
+		return fallback
+	}
+	return time.Unix(0, nanos).UTC()
+}
+
+// copyKey copies srcKey of src to dstKey of dst. An error reading the
+// source is returned in preference to the error it causes writing.
+func copyKey(dst Engine, dstKey string, src Engine, srcKey string) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := src.WriteTo(srcKey, pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	err := dst.ReadFrom(dstKey, pr)
+	pr.CloseWithError(io.ErrClosedPipe)
+	if serr := <-done; serr != nil && serr != io.ErrClosedPipe {
+		return serr
+	}
+	return err
+}
+
+// keyLocks serialises the writers of each key
+type keyLocks struct {
+	m     sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks key and returns the function unlocking it
+func (l *keyLocks) lock(key string) func() {
+	l.m.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*keyLock{}
+	}
+	k, ok := l.locks[key]
+	if !ok {
+		k = &keyLock{}
+		l.locks[key] = k
+	}
+	k.waiters++
+	l.m.Unlock()
+
+	k.Lock()
+	return func() {
+		k.Unlock()
+		l.m.Lock()
+		if k.waiters--; k.waiters == 0 {
+			delete(l.locks, key)
+		}
+		l.m.Unlock()
+	}
+}
@@ -0,0 +1,165 @@
+package ops
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVersionedEngine(t *testing.T) {
+	testEngine(t, NewVersionedEngine(NewLocalFile(tempDir(t))))
+}
+
+func TestVersions(t *testing.T) {
+	inner := &failingEngine{LocalFile: NewLocalFile(tempDir(t)), fail: map[string]bool{}}
+	e := NewVersionedEngine(inner, "versioned/")
+	key := "versioned/key"
+	for _, body := range []string{"one", "two", "three"} {
+		if err := e.ReadFrom(key, strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	versions, err := e.Versions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, e, key, versions, "three", "two", "one")
+	if !versions[0].Latest {
+		t.Fatal("the newest version is not the latest")
+	}
+
+	// a failed write keeps the versions as they were
+	for _, fail := range []string{key, headsPrefix + key} {
+		inner.fail[fail] = true
+		if err := e.ReadFrom(key, strings.NewReader("four")); err == nil {
+			t.Fatalf("failing to write %s: got no error", fail)
+		}
+		delete(inner.fail, fail)
+		after, err := e.Versions(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(after) != len(versions) || after[0].ID != versions[0].ID {
+			t.Fatalf("failing to write %s: versions %v, want %v", fail, after, versions)
+		}
+		checkVersions(t, e, key, after, "three", "two", "one")
+	}
+
+	// deleting leaves a delete marker as the latest version
+	if err := e.Delete(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.WriteTo(key, &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading a deleted key: got %v, want ErrNotFound", err)
+	}
+	deleted, err := e.Versions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 4 || !deleted[0].DeleteMarker || !deleted[0].Latest {
+		t.Fatalf("versions after delete: %v", deleted)
+	}
+	if err := e.WriteVersion(key, deleted[0].ID, &bytes.Buffer{}); err != ErrNotFound {
+		t.Fatalf("reading a delete marker: got %v, want ErrNotFound", err)
+	}
+	checkVersions(t, e, key, deleted[1:], "three", "two", "one")
+
+	// restoring a version makes a new latest version of it
+	s := NewStorage(&Config{Engine: e})
+	if err := s.Restore(key, versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	restored, err := e.Versions(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVersions(t, e, key, restored[:1], "two")
+	if len(restored) != 5 {
+		t.Fatalf("versions after restore: %v", restored)
+	}
+
+	// keys outside the prefixes are not versioned
+	for _, body := range []string{"one", "two"} {
+		if err := e.ReadFrom("other", strings.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if other, err := e.Versions("other"); err != nil || len(other) != 1 {
+		t.Fatalf("versions of an unversioned key: %v, %v", other, err)
+	}
+}
+
+func TestWriteVersionOverwritten(t *testing.T) {
+	inner := &hookEngine{LocalFile: NewLocalFile(tempDir(t))}
+	e := NewVersionedEngine(inner)
+	if err := e.ReadFrom("key", strings.NewReader("old")); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := e.Versions("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the key is overwritten once, as soon as its head has been read
+	overwrite := make(chan struct{}, 1)
+	overwrite <- struct{}{}
+	inner.read = func(key string) {
+		if key != headsPrefix+"key" {
+			return
+		}
+		select {
+		case <-overwrite:
+		default:
+			return
+		}
+		written := make(chan struct{})
+		go func() {
+			e.ReadFrom("key", strings.NewReader("new"))
+			close(written)
+		}()
+		select {
+		case <-written:
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	var b bytes.Buffer
+	if err := e.WriteVersion("key", versions[0].ID, &b); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "old" {
+		t.Fatalf("version %s read %q, want %q", versions[0].ID, b.String(), "old")
+	}
+}
+
+// checkVersions checks the versions of key hold bodies, in order
+func checkVersions(t *testing.T, e *VersionedEngine, key string, versions []VersionInfo, bodies ...string) {
+	t.Helper()
+	if len(versions) < len(bodies) {
+		t.Fatalf("got %d versions, want %d", len(versions), len(bodies))
+	}
+	for i, body := range bodies {
+		var b bytes.Buffer
+		if err := e.WriteVersion(key, versions[i].ID, &b); err != nil {
+			t.Fatalf("reading version %s: %v", versions[i].ID, err)
+		}
+		if b.String() != body {
+			t.Fatalf("version %s read %q, want %q", versions[i].ID, b.String(), body)
+		}
+	}
+}
+
+// hookEngine is a local engine calling read once each key has been read
+type hookEngine struct {
+	*LocalFile
+	read func(key string)
+}
+
+func (e *hookEngine) WriteTo(key string, w io.Writer) error {
+	err := e.LocalFile.WriteTo(key, w)
+	if e.read != nil {
+		e.read(key)
+	}
+	return err
+}
@@ -1,7 +1,14 @@
 package server
 
 import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/newrelic/go-agent"
 
@@ -9,9 +16,39 @@ import (
 	"time"
 
 	"github.com/gocraft/web"
+	"github.com/mshindle/objstore/ops"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+// MetaHeaderPrefix starts the response headers carrying user metadata
+const MetaHeaderPrefix = "X-Objstore-Meta-"
+
+// ChecksumHeader carries the sha256 of an upload, as hex or base64
+const ChecksumHeader = "X-Objstore-Checksum-Sha256"
+
+// ExpiresHeader carries the time an object expires at
+const ExpiresHeader = "X-Objstore-Expires"
+
+// TTLHeader carries how long an object lives for, in seconds or as a
+// duration such as "36h"
+const TTLHeader = "X-Objstore-TTL"
+
+// TierHeader names the tier holding an object
+const TierHeader = "X-Objstore-Tier"
+
+// ListEntry is a line of a key listing
+type ListEntry struct {
+	Key string `json:"key"`
+}
+
+// ListTrailer is the last line of a listing. A listing which does not end
+// with Done was cut short, by the error given if there is one.
+type ListTrailer struct {
+	Done  bool   `json:"done,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
 // StoreContext holds object store contextual request information
 type StoreContext struct {
 	key string
@@ -28,9 +65,12 @@ func routeBuilder() error {
 	router.Middleware(web.ShowErrorsMiddleware)
 
 	router.Get(wrapHandle(relic, "/:*", GetObject))
+	router.Head(wrapHandle(relic, "/:*", HeadObject))
 	router.Put(wrapHandle(relic, "/:*", PutObject))
-	router.Get("/", RootHandler)
+	router.Delete(wrapHandle(relic, "/:*", DeleteObject))
+	router.Get(wrapHandle(relic, "/", ListObjects))
 	router.Put("/", RootHandler)
+	router.Delete("/", RootHandler)
 
 	return nil
 }
@@ -74,9 +114,15 @@ func loggerMiddleware(rw web.ResponseWriter, req *web.Request, next web.NextMidd
 	}).Info(req.URL.Path)
 }
 
-// ParseKey pulls the storage key out of the request and stores it into context
+// ParseKey pulls the storage key out of the request and stores it into context.
+// Keys below ops.SystemPrefix belong to objstore itself, so a request for one
+// is a bad request.
 func ParseKey(c *StoreContext, rw web.ResponseWriter, req *web.Request, next web.NextMiddlewareFunc) {
 	c.key = req.PathParams["*"]
+	if strings.HasPrefix(c.key, ops.SystemPrefix) {
+		http.Error(rw, "cannot use "+ops.SystemPrefix+" keys", http.StatusBadRequest)
+		return
+	}
 	next(rw, req)
 }
 
@@ -84,13 +130,40 @@ func ParseKey(c *StoreContext, rw web.ResponseWriter, req *web.Request, next web
 // Leading slashes are stripped out. Getting "/" will return a bad request.
 func GetObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
 	logrus.WithField("key", c.key).Info("starting GetObject")
-	rw.Header().Set("Content-Type", "application/octet-stream")
-	err := objstore.Retrieve(c.key, rw)
-	if err != nil {
-		logrus.WithField("key", c.key).Error("unable to read key from storage")
+	query := req.URL.Query()
+	if _, ok := query["versions"]; ok {
+		ListVersions(c, rw, req)
+		return
+	}
+	id := query.Get("versionId")
+	// only the latest version is described
+	var contentType string
+	if id == "" {
+		contentType = objstore.ContentType(c.key)
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	var err error
+	if id != "" {
+		err = objstore.RetrieveVersion(c.key, id, rw)
+	} else {
+		err = objstore.Retrieve(c.key, rw)
+	}
+	if err == ops.ErrNotFound {
 		http.NotFound(rw, req.Request)
 		return
 	}
+	if err == ops.ErrNoVersions {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"key": c.key, "error": err}).Error("unable to read key from storage")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
 }
 
 // PutObject stores an object using the URI Path as the key.
@@ -98,7 +171,40 @@ func GetObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
 // return a bad request.
 func PutObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
 	logrus.WithField("key", c.key).Info("starting PutObject")
-	err := objstore.Store(c.key, req.Body)
+	query := req.URL.Query()
+	if id := query.Get("restore"); id != "" {
+		RestoreObject(c, rw, req)
+		return
+	}
+	if _, ok := query["undelete"]; ok {
+		UndeleteObject(c, rw, req)
+		return
+	}
+	want, err := uploadIntegrity(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	expires, err := uploadExpiry(req)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = objstore.StoreExpiring(c.key, req.Body, want, expires)
+	if err == ops.ErrNoExpiry {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if ierr, ok := err.(*ops.IntegrityError); ok {
+		logrus.WithFields(logrus.Fields{"key": c.key, "error": ierr}).Warn("rejected upload")
+		http.Error(rw, ierr.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		if contentType, meta := uploadDescription(req); contentType != "" || len(meta) > 0 {
+			err = objstore.Describe(c.key, contentType, meta)
+		}
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusPreconditionFailed)
 		return
@@ -106,6 +212,252 @@ func PutObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
 	rw.WriteHeader(http.StatusAccepted)
 }
 
+// uploadDescription reads the content type and user metadata of an upload
+// from its Content-Type and metadata headers
+func uploadDescription(req *web.Request) (string, map[string]string) {
+	meta := map[string]string{}
+	for name := range req.Header {
+		if strings.HasPrefix(name, MetaHeaderPrefix) {
+			meta[strings.ToLower(strings.TrimPrefix(name, MetaHeaderPrefix))] = req.Header.Get(name)
+		}
+	}
+	return req.Header.Get("Content-Type"), meta
+}
+
+// uploadIntegrity reads what an upload must hold from its Content-Length,
+// Content-MD5 and checksum headers
+func uploadIntegrity(req *web.Request) (*ops.Integrity, error) {
+	want := &ops.Integrity{Size: req.ContentLength}
+	if v := req.Header.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err != nil || len(sum) != md5.Size {
+			return nil, errors.Errorf("invalid Content-MD5 %q", v)
+		}
+		want.MD5 = sum
+	}
+	if v := req.Header.Get(ChecksumHeader); v != "" {
+		decode := base64.StdEncoding.DecodeString
+		if len(v) == hex.EncodedLen(sha256.Size) {
+			decode = hex.DecodeString
+		}
+		sum, err := decode(v)
+		if err != nil || len(sum) != sha256.Size {
+			return nil, errors.Errorf("invalid %s %q", ChecksumHeader, v)
+		}
+		want.Sha256 = sum
+	}
+	return want, nil
+}
+
+// ListVersions answers "/<key>?versions" with the versions kept of the
+// object, newest first, as JSON lines.
+func ListVersions(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
+	versions, err := objstore.Versions(c.key)
+	if err == ops.ErrNotFound {
+		http.NotFound(rw, req.Request)
+		return
+	}
+	if err == ops.ErrNoVersions {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"key": c.key, "error": err}).Error("unable to list versions")
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(rw)
+	for _, v := range versions {
+		enc.Encode(v)
+	}
+}
+
+// RestoreObject answers "PUT /<key>?restore=<versionId>" by making that
+// version of the object its latest.
+func RestoreObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
+	id := req.URL.Query().Get("restore")
+	logrus.WithFields(logrus.Fields{"key": c.key, "version": id}).Info("restoring object")
+	err := objstore.Restore(c.key, id)
+	if err == ops.ErrNotFound {
+		http.NotFound(rw, req.Request)
+		return
+	}
+	if err == ops.ErrNoVersions {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	rw.WriteHeader(http.StatusAccepted)
+}
+
+// uploadExpiry reads when an upload expires from its expiry headers. The
+// zero time is returned if neither is given.
+func uploadExpiry(req *web.Request) (time.Time, error) {
+	if v := req.Header.Get(TTLHeader); v != "" {
+		ttl, err := time.ParseDuration(v)
+		if secs, serr := strconv.ParseInt(v, 10, 64); serr == nil {
+			ttl, err = time.Duration(secs)*time.Second, nil
+		}
+		if err != nil || ttl <= 0 {
+			return time.Time{}, errors.Errorf("invalid %s %q", TTLHeader, v)
+		}
+		return time.Now().Add(ttl), nil
+	}
+	if v := req.Header.Get(ExpiresHeader); v != "" {
+		t, err := http.ParseTime(v)
+		if err != nil {
+			t, err = time.Parse(time.RFC3339, v)
+		}
+		if err != nil {
+			return time.Time{}, errors.Errorf("invalid %s %q", ExpiresHeader, v)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
+
+// HeadObject describes an object in the response headers without sending
+// its body.
+func HeadObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
+	info, err := objstore.Stat(c.key)
+	if err == ops.ErrNotFound {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"key": c.key, "error": err}).Error("unable to stat key")
+		rw.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	if !info.Modified.IsZero() {
+		rw.Header().Set("Last-Modified", info.Modified.UTC().Format(http.TimeFormat))
+	}
+	for k, v := range info.Metadata {
+		rw.Header().Set(MetaHeaderPrefix+k, v)
+	}
+	if info.Tier != "" {
+		rw.Header().Set(TierHeader, info.Tier)
+	}
+	if expires, err := objstore.Expiry(c.key); err == nil && !expires.IsZero() {
+		rw.Header().Set(ExpiresHeader, expires.UTC().Format(http.TimeFormat))
+	}
+	rw.WriteHeader(http.StatusOK)
+}
+
+// ListObjects answers "/?list" with the keys beginning with the prefix
+// parameter as JSON lines of the form {"key": "..."}, ended by a
+// ListTrailer. Any other request for "/" is a bad request.
+func ListObjects(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
+	query := req.URL.Query()
+	if _, ok := query["trash"]; ok {
+		ListTrash(c, rw, req)
+		return
+	}
+	if _, ok := query["list"]; !ok {
+		RootHandler(rw, req)
+		return
+	}
+	prefix := strings.TrimPrefix(query.Get("prefix"), "/")
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(rw)
+	started := false
+	err := objstore.List(prefix, func(key string) error {
+		started = true
+		return enc.Encode(ListEntry{Key: key})
+	})
+	if err == ops.ErrNoList {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"prefix": prefix, "error": err}).Error("unable to list keys")
+		if !started {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeTrailer(enc, err)
+}
+
+// writeTrailer ends a listing, marking it done or failed by err
+func writeTrailer(enc *json.Encoder, err error) {
+	trailer := ListTrailer{Done: err == nil}
+	if err != nil {
+		trailer.Error = err.Error()
+	}
+	enc.Encode(trailer)
+}
+
+// ListTrash answers "/?trash" with the trashed objects whose keys begin
+// with the prefix parameter as JSON lines, ended by a ListTrailer.
+func ListTrash(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
+	prefix := strings.TrimPrefix(req.URL.Query().Get("prefix"), "/")
+	rw.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(rw)
+	started := false
+	err := objstore.ListTrash(prefix, func(entry ops.TrashEntry) error {
+		started = true
+		return enc.Encode(entry)
+	})
+	if err == ops.ErrNoTrash || err == ops.ErrNoList {
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		logrus.WithFields(logrus.Fields{"prefix": prefix, "error": err}).Error("unable to list trash")
+		if !started {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	writeTrailer(enc, err)
+}
+
+// UndeleteObject answers "PUT /<key>?undelete[=<id>]" by moving a trashed
+// object back under its key, the latest one deleted if no id is given.
+func UndeleteObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
+	id := req.URL.Query().Get("undelete")
+	logrus.WithFields(logrus.Fields{"key": c.key, "id": id}).Info("undeleting object")
+	err := objstore.Undelete(c.key, id)
+	switch err {
+	case nil:
+		rw.WriteHeader(http.StatusAccepted)
+	case ops.ErrNotFound:
+		http.NotFound(rw, req.Request)
+	case ops.ErrExists:
+		http.Error(rw, err.Error(), http.StatusConflict)
+	case ops.ErrNoTrash:
+		http.Error(rw, err.Error(), http.StatusNotImplemented)
+	default:
+		http.Error(rw, err.Error(), http.StatusPreconditionFailed)
+	}
+}
+
+// DeleteObject removes the object stored under the URI Path.
+func DeleteObject(c *StoreContext, rw web.ResponseWriter, req *web.Request) {
+	logrus.WithField("key", c.key).Info("starting DeleteObject")
+	err := objstore.Delete(c.key)
+	if err == ops.ErrNotFound {
+		http.NotFound(rw, req.Request)
+		return
+	}
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
+
 // RootHandler takes care of bare root requests
 func RootHandler(rw web.ResponseWriter, req *web.Request) {
 	http.Error(rw, "cannot use / as a key", http.StatusBadRequest)
@@ -1,6 +1,10 @@
 package server
 
-import "github.com/pkg/errors"
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
 
 const (
 	// EngineLocal is constant for setting a local filesystem engine
@@ -9,22 +13,58 @@ const (
 	EngineS3 = "s3"
 	// EngineSwift is constant for setting a swiftstack engine
 	EngineSwift = "swift"
+	// EngineReplicated is constant for setting a replicated engine
+	EngineReplicated = "replicated"
+	// EngineTiered is constant for setting a tiered fallback engine
+	EngineTiered = "tiered"
+	// EngineRouter is constant for setting a prefix routing engine
+	EngineRouter = "router"
+	// EngineSharded is constant for setting a consistent hash sharding engine
+	EngineSharded = "sharded"
+	// EngineDedup is constant for setting a deduplicating engine
+	EngineDedup = "dedup"
+	// EngineErasure is constant for setting an erasure coded local engine
+	EngineErasure = "erasure"
+	// EnginePack is constant for setting a pack file engine
+	EnginePack = "pack"
+	// EngineBolt is constant for setting a bbolt database engine
+	EngineBolt = "bolt"
+	// EngineSQLite is constant for setting a SQLite database engine
+	EngineSQLite = "sqlite"
+	// EngineAzure is constant for setting an Azure Blob Storage engine
+	EngineAzure = "azure"
+	// EngineGCS is constant for setting a Google Cloud Storage engine
+	EngineGCS = "gcs"
+	// EngineSFTP is constant for setting an SFTP remote filesystem engine
+	EngineSFTP = "sftp"
+	// EngineRemote is constant for setting a remote objstore engine
+	EngineRemote = "remote"
+	// EngineRedis is constant for setting a Redis engine
+	EngineRedis = "redis"
+	// EngineVersioned is constant for setting a versioning engine
+	EngineVersioned = "versioned"
+	// EngineTransition is constant for setting an age based tiering engine
+	EngineTransition = "transition"
 )
 
 // Settings holds the configuration data for objstore
 type Settings struct {
-	// aws configuration settings
-	Aws struct {
-		AccessKey string
-		SecretKey string
-		Region    string
-		Bucket    string
+	// top level engine configuration
+	EngineSettings `mapstructure:",squash" yaml:",inline"`
+	// named engine instances
+	Engines map[string]EngineSettings
+	// record a sha256 of every object stored
+	Checksums bool
+	// keep deleted objects in a trash
+	Trash struct {
+		Retention time.Duration
+		Purge     time.Duration
 	}
-	// engine type
-	Engine string
-	// local engine configuration
-	Local struct {
-		Root string
+	// expire objects at a time given on upload or by rules
+	Expiration struct {
+		Enabled bool
+		Rules   []Rule
+		Reap    time.Duration
 	}
 	// newrelic configuration
 	NewRelic struct {
@@ -34,6 +74,117 @@ type Settings struct {
 	}
 	// binding port for objstore
 	Port int
+}
+
+// EngineSettings holds the configuration for an engine. The top level
+// settings and every named engine instance share this layout.
+type EngineSettings struct {
+	// aws configuration settings
+	Aws struct {
+		AccessKey   string
+		SecretKey   string
+		Region      string
+		Bucket      string
+		PartSize    int64
+		Concurrency int
+	}
+	// azure engine configuration
+	Azure struct {
+		Connection string
+		Account    string
+		Key        string
+		Endpoint   string
+		Container  string
+		BlockSize  int
+	}
+	// bolt engine configuration
+	Bolt struct {
+		Path      string
+		ChunkSize int
+		TempDir   string
+	}
+	// dedup engine configuration
+	Dedup struct {
+		Engine  string
+		TempDir string
+		Grace   time.Duration
+	}
+	// engine type
+	Engine string
+	// erasure coded engine configuration
+	Erasure struct {
+		Roots  []string
+		Data   int
+		Parity int
+	}
+	// gcs engine configuration
+	GCS struct {
+		Credentials string
+		Endpoint    string
+		Bucket      string
+		ChunkSize   int
+	}
+	// local engine configuration
+	Local struct {
+		Root string
+	}
+	// pack file engine configuration
+	Pack struct {
+		Dir     string
+		MaxSize int64
+		Garbage float64
+		Compact time.Duration
+		Sync    bool
+	}
+	// redis engine configuration
+	Redis struct {
+		Addr      string
+		Password  string
+		DB        int
+		Prefix    string
+		MaxSize   int64
+		ChunkSize int
+		TTL       time.Duration
+	}
+	// remote objstore engine configuration
+	Remote struct {
+		URL     string
+		Retries int
+	}
+	// replicated engine configuration
+	Replicated struct {
+		Engines []string
+		Quorum  int
+		Journal string
+		Retry   time.Duration
+	}
+	// router engine configuration
+	Router struct {
+		Routes  []Route
+		Default string
+	}
+	// sharded engine configuration
+	Sharded struct {
+		Shards       []string
+		VirtualNodes int
+		Probe        bool
+	}
+	// sftp engine configuration
+	SFTP struct {
+		Host       string
+		User       string
+		KeyFile    string
+		Passphrase string
+		KnownHosts string
+		Insecure   bool
+		Root       string
+		MaxConns   int
+	}
+	// sqlite engine configuration
+	SQLite struct {
+		Path    string
+		TempDir string
+	}
 	// swift engine configuration
 	Swift struct {
 		User      string `yaml:"apiuser"`
@@ -41,6 +192,47 @@ type Settings struct {
 		Container string
 		AuthURL   string `yaml:"authurl"`
 	}
+	// tiered engine configuration
+	Tiered struct {
+		Primary   string
+		Fallbacks []string
+		Migrate   bool
+	}
+	// transition engine configuration
+	Transition struct {
+		Tiers     []string
+		Index     string
+		Rules     []TransitionRule
+		Interval  time.Duration
+		Rate      float64
+		Bandwidth int64
+		State     string
+	}
+	// versioned engine configuration
+	Versioned struct {
+		Engine   string
+		Prefixes []string
+	}
+}
+
+// Route sends keys matching Prefix to the named engine
+type Route struct {
+	Prefix string
+	Engine string
+}
+
+// Rule expires the objects below Prefix once they are older than After
+type Rule struct {
+	Prefix string
+	After  time.Duration
+}
+
+// TransitionRule moves the objects below Prefix to the named Tier once they
+// are older than After
+type TransitionRule struct {
+	Prefix string
+	After  time.Duration
+	Tier   string
 }
 
 // server settings
@@ -1,29 +1,44 @@
 package server
 
 import (
+	"strings"
+	"time"
+
+	"github.com/mshindle/objstore/client"
 	"github.com/mshindle/objstore/ops"
 	"github.com/newrelic/go-agent"
 	"github.com/sirupsen/logrus"
 	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
 )
 
+// defaultRetry is how often failed replica writes are retried
+const defaultRetry = time.Minute
+
+// defaultCompact is how often pack files are compacted
+const defaultCompact = time.Hour
+
+// defaultPurge is how often expired objects are purged from the trash
+const defaultPurge = time.Hour
+
+// defaultReap is how often expired objects are deleted
+const defaultReap = 10 * time.Minute
+
+// defaultTransition is how often aged objects are moved between tiers
+const defaultTransition = time.Hour
+
+// loops holds the background loops of the engines built, which are only
+// run by a serving server. Commands building an engine leave them to it.
+var loops []func()
+
+// building tracks the engines under construction to catch cycles between
+// composite engines
+var building = map[string]bool{}
+
 func storageBuilder() error {
-	var (
-		e   ops.Engine
-		err error
-	)
 	// select engine
-	switch config.Engine {
-	case EngineLocal:
-		e = ops.NewLocalFile(config.Local.Root)
-	case EngineS3:
-		e = ops.NewS3(config.Aws.Region, config.Aws.Bucket)
-	case EngineSwift:
-		e, err = ops.NewSwiftEngine(config.Swift.User, config.Swift.Key, config.Swift.AuthURL, config.Swift.Container)
-	default:
-		logrus.WithField("engine", config.Engine).Error("unknown engine type specified")
-		err = errors.New("unknown engine type specified")
-	}
+	loops = nil
+	e, err := engineBuilder(&config.EngineSettings)
 	if err != nil {
 		return err
 	}
@@ -35,9 +50,383 @@ func storageBuilder() error {
 		return err
 	}
 
+	// expired trash is found by listing it
+	if config.Trash.Retention > 0 && !ops.CanList(e) {
+		return errors.New("trash retention requires an engine able to list keys")
+	}
+
 	objstore = ops.NewStorage(&ops.Config{
-		Engine: e,
-		App:    relic,
+		Engine:     e,
+		App:        relic,
+		Checksums:  config.Checksums,
+		Trash:      config.Trash.Retention,
+		Expiration: config.Expiration.Enabled,
+		Lifecycle:  config.Lifecycle(),
 	})
+	if config.Trash.Retention > 0 {
+		purge := config.Trash.Purge
+		if purge <= 0 {
+			purge = defaultPurge
+		}
+		go objstore.PurgeLoop(purge)
+	}
+	if config.Expiration.Enabled || len(config.Expiration.Rules) > 0 {
+		reap := config.Expiration.Reap
+		if reap <= 0 {
+			reap = defaultReap
+		}
+		go objstore.ReapLoop(reap)
+	}
+	for _, loop := range loops {
+		go loop()
+	}
 	return nil
 }
+
+// Lifecycle returns the expiration rules. Prefixes may be written as
+// "/tmp/*" for the keys below tmp/.
+func (s *Settings) Lifecycle() []ops.LifecycleRule {
+	rules := make([]ops.LifecycleRule, 0, len(s.Expiration.Rules))
+	for _, r := range s.Expiration.Rules {
+		prefix := strings.TrimSuffix(strings.TrimPrefix(r.Prefix, "/"), "*")
+		rules = append(rules, ops.LifecycleRule{Prefix: prefix, After: r.After})
+	}
+	return rules
+}
+
+// BuildEngine creates the engine referred to by name from settings. An
+// empty name creates the top level engine.
+func BuildEngine(settings *Settings, name string) (ops.Engine, error) {
+	config = settings
+	if name == "" {
+		return engineBuilder(&config.EngineSettings)
+	}
+	return namedEngineBuilder(name)
+}
+
+// namedEngineBuilder creates the engine referred to by name. Names are
+// looked up in the named engine instances first, otherwise the name is taken
+// as an engine type configured by the top level settings.
+func namedEngineBuilder(name string) (ops.Engine, error) {
+	if building[name] {
+		return nil, errors.Errorf("engine %s refers to itself", name)
+	}
+	building[name] = true
+	defer delete(building, name)
+
+	if s, ok := config.Engines[name]; ok {
+		return engineBuilder(&s)
+	}
+	s := config.EngineSettings
+	s.Engine = name
+	return engineBuilder(&s)
+}
+
+// engineBuilder creates the engine described by s
+func engineBuilder(s *EngineSettings) (ops.Engine, error) {
+	switch s.Engine {
+	case EngineLocal:
+		return ops.NewLocalFile(s.Local.Root), nil
+	case EngineS3:
+		e := ops.NewS3(s.Aws.Region, s.Aws.Bucket)
+		e.PartSize = s.Aws.PartSize
+		e.Concurrency = s.Aws.Concurrency
+		return e, nil
+	case EngineSwift:
+		return ops.NewSwiftEngine(s.Swift.User, s.Swift.Key, s.Swift.AuthURL, s.Swift.Container)
+	case EngineReplicated:
+		return replicatedBuilder(s)
+	case EngineTiered:
+		return tieredBuilder(s)
+	case EngineRouter:
+		return routerBuilder(s)
+	case EngineSharded:
+		return shardedBuilder(s)
+	case EngineDedup:
+		return dedupBuilder(s)
+	case EngineErasure:
+		return ops.NewErasureFile(s.Erasure.Roots, s.Erasure.Data, s.Erasure.Parity)
+	case EnginePack:
+		return packBuilder(s)
+	case EngineBolt:
+		return boltBuilder(s)
+	case EngineSQLite:
+		return sqliteBuilder(s)
+	case EngineAzure:
+		return azureBuilder(s)
+	case EngineGCS:
+		return gcsBuilder(s)
+	case EngineSFTP:
+		return ops.NewSFTPEngine(ops.SFTPConfig(s.SFTP))
+	case EngineRemote:
+		return remoteBuilder(s)
+	case EngineRedis:
+		return redisBuilder(s)
+	case EngineVersioned:
+		return versionedBuilder(s)
+	case EngineTransition:
+		return transitionBuilder(s)
+	}
+	logrus.WithField("engine", s.Engine).Error("unknown engine type specified")
+	return nil, errors.New("unknown engine type specified")
+}
+
+func replicatedBuilder(s *EngineSettings) (ops.Engine, error) {
+	engines := make([]ops.Engine, 0, len(s.Replicated.Engines))
+	for _, name := range s.Replicated.Engines {
+		e, err := namedEngineBuilder(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not build replica %s", name)
+		}
+		engines = append(engines, e)
+	}
+
+	var journal *ops.Journal
+	if s.Replicated.Journal != "" {
+		journal = ops.NewJournal(s.Replicated.Journal)
+	}
+	e, err := ops.NewReplicatedEngine(s.Replicated.Quorum, journal, engines...)
+	if err != nil {
+		return nil, err
+	}
+	if journal != nil {
+		retry := s.Replicated.Retry
+		if retry <= 0 {
+			retry = defaultRetry
+		}
+		loops = append(loops, func() { e.RetryLoop(retry) })
+	}
+	return e, nil
+}
+
+func tieredBuilder(s *EngineSettings) (ops.Engine, error) {
+	primary, err := namedEngineBuilder(s.Tiered.Primary)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not build primary tier %s", s.Tiered.Primary)
+	}
+	fallbacks := make([]ops.Engine, 0, len(s.Tiered.Fallbacks))
+	for _, name := range s.Tiered.Fallbacks {
+		e, err := namedEngineBuilder(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not build fallback tier %s", name)
+		}
+		fallbacks = append(fallbacks, e)
+	}
+
+	e := ops.NewTieredEngine(primary, fallbacks...)
+	e.Migrate = s.Tiered.Migrate
+	return e, nil
+}
+
+func routerBuilder(s *EngineSettings) (ops.Engine, error) {
+	// routes sharing an engine share a single instance of it
+	engines := map[string]ops.Engine{}
+
+	var fallback ops.Engine
+	if s.Router.Default != "" {
+		e, err := namedEngineBuilder(s.Router.Default)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not build default route %s", s.Router.Default)
+		}
+		engines[s.Router.Default] = e
+		fallback = e
+	}
+
+	router := ops.NewRouter(fallback)
+	for _, rt := range s.Router.Routes {
+		e, ok := engines[rt.Engine]
+		if !ok {
+			var err error
+			e, err = namedEngineBuilder(rt.Engine)
+			if err != nil {
+				return nil, errors.Wrapf(err, "could not build route %s", rt.Prefix)
+			}
+			engines[rt.Engine] = e
+		}
+		router.Handle(rt.Prefix, e)
+	}
+	return router, nil
+}
+
+func shardedBuilder(s *EngineSettings) (ops.Engine, error) {
+	e := ops.NewShardedEngine(s.Sharded.VirtualNodes)
+	e.Probe = s.Sharded.Probe
+	for _, name := range s.Sharded.Shards {
+		shard, err := namedEngineBuilder(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not build shard %s", name)
+		}
+		e.Add(name, shard)
+	}
+	return e, nil
+}
+
+func dedupBuilder(s *EngineSettings) (ops.Engine, error) {
+	backing, err := namedEngineBuilder(s.Dedup.Engine)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not build dedup engine %s", s.Dedup.Engine)
+	}
+	e := ops.NewDedupEngine(backing)
+	e.TempDir = s.Dedup.TempDir
+	if s.Dedup.Grace > 0 {
+		e.Grace = s.Dedup.Grace
+	}
+	return e, nil
+}
+
+func versionedBuilder(s *EngineSettings) (ops.Engine, error) {
+	backing, err := namedEngineBuilder(s.Versioned.Engine)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not build versioned engine %s", s.Versioned.Engine)
+	}
+	// stores keeping versions themselves version every key
+	if native, ok := backing.(ops.NativeVersioner); ok {
+		enabled, err := native.Versioning()
+		if err != nil {
+			return nil, errors.Wrap(err, "could not check for native versioning")
+		}
+		if enabled {
+			logrus.WithField("engine", s.Versioned.Engine).Info("using native versioning")
+			return backing, nil
+		}
+	}
+	return ops.NewVersionedEngine(backing, s.Versioned.Prefixes...), nil
+}
+
+func transitionBuilder(s *EngineSettings) (ops.Engine, error) {
+	if len(s.Transition.Tiers) == 0 {
+		return nil, errors.New("transition engine requires tiers")
+	}
+	tiers := make(map[string]ops.Engine, len(s.Transition.Tiers))
+	for _, name := range s.Transition.Tiers {
+		e, err := namedEngineBuilder(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not build tier %s", name)
+		}
+		tiers[name] = e
+	}
+
+	// the index is kept on the first tier unless named
+	index := tiers[s.Transition.Tiers[0]]
+	if s.Transition.Index != "" {
+		var err error
+		index, err = namedEngineBuilder(s.Transition.Index)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not build tier index %s", s.Transition.Index)
+		}
+	}
+	e := ops.NewTransitionEngine(index)
+	for _, name := range s.Transition.Tiers {
+		e.AddTier(name, tiers[name])
+	}
+	for _, r := range s.Transition.Rules {
+		if err := e.Handle(r.Prefix, r.After, r.Tier); err != nil {
+			return nil, errors.Wrapf(err, "invalid transition rule %s", r.Prefix)
+		}
+	}
+
+	t := ops.NewTransitioner(e)
+	t.Rate = s.Transition.Rate
+	t.Bandwidth = s.Transition.Bandwidth
+	if s.Transition.State != "" {
+		t.State = s.Transition.State
+	}
+	interval := s.Transition.Interval
+	if interval <= 0 {
+		interval = defaultTransition
+	}
+	loops = append(loops, func() { t.TransitionLoop(interval) })
+	return e, nil
+}
+
+func packBuilder(s *EngineSettings) (ops.Engine, error) {
+	e, err := ops.OpenPackFile(s.Pack.Dir)
+	if err != nil {
+		return nil, err
+	}
+	if s.Pack.MaxSize > 0 {
+		e.MaxSize = s.Pack.MaxSize
+	}
+	if s.Pack.Garbage > 0 {
+		e.Garbage = s.Pack.Garbage
+	}
+	e.Sync = s.Pack.Sync
+
+	compact := s.Pack.Compact
+	if compact <= 0 {
+		compact = defaultCompact
+	}
+	loops = append(loops, func() { e.CompactLoop(compact) })
+	return e, nil
+}
+
+func boltBuilder(s *EngineSettings) (ops.Engine, error) {
+	e, err := ops.NewBoltEngine(s.Bolt.Path)
+	if err != nil {
+		return nil, err
+	}
+	if s.Bolt.ChunkSize > 0 {
+		e.ChunkSize = s.Bolt.ChunkSize
+	}
+	e.TempDir = s.Bolt.TempDir
+	return e, nil
+}
+
+func sqliteBuilder(s *EngineSettings) (ops.Engine, error) {
+	e, err := ops.NewSQLiteEngine(s.SQLite.Path)
+	if err != nil {
+		return nil, err
+	}
+	e.TempDir = s.SQLite.TempDir
+	return e, nil
+}
+
+func azureBuilder(s *EngineSettings) (ops.Engine, error) {
+	e, err := ops.NewAzureEngine(s.Azure.Connection, s.Azure.Account, s.Azure.Key, s.Azure.Endpoint, s.Azure.Container)
+	if err != nil {
+		return nil, err
+	}
+	if s.Azure.BlockSize > 0 {
+		e.BlockSize = s.Azure.BlockSize
+	}
+	return e, nil
+}
+
+func gcsBuilder(s *EngineSettings) (ops.Engine, error) {
+	e, err := ops.NewGCSEngine(s.GCS.Credentials, s.GCS.Endpoint, s.GCS.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if s.GCS.ChunkSize > 0 {
+		e.ChunkSize = s.GCS.ChunkSize
+	}
+	return e, nil
+}
+
+func remoteBuilder(s *EngineSettings) (ops.Engine, error) {
+	e, err := client.New(s.Remote.URL)
+	if err != nil {
+		return nil, err
+	}
+	if s.Remote.Retries > 0 {
+		e.Retries = s.Remote.Retries
+	}
+	return e, nil
+}
+
+func redisBuilder(s *EngineSettings) (ops.Engine, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     s.Redis.Addr,
+		Password: s.Redis.Password,
+		DB:       s.Redis.DB,
+	})
+	e := ops.NewRedisEngine(client, s.Redis.Prefix)
+	if s.Redis.MaxSize > 0 {
+		e.MaxSize = s.Redis.MaxSize
+	}
+	if s.Redis.ChunkSize > 0 {
+		e.ChunkSize = s.Redis.ChunkSize
+	}
+	e.TTL = s.Redis.TTL
+	return e, nil
+}